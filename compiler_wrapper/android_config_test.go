@@ -11,6 +11,7 @@ import (
 )
 
 const androidGoldenDir = "testdata/android_golden"
+const androidNoCompatGoldenDir = "testdata/android_nocompat_golden"
 
 func TestAndroidConfig(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
@@ -30,6 +31,23 @@ func TestAndroidConfig(t *testing.T) {
 	})
 }
 
+func TestAndroidConfigWithoutOldWrapperCompat(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		useLlvmNext := false
+		useCCache := false
+		cfg, err := getConfig("android", useCCache, useLlvmNext, "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.disableOldWrapperCompat = true
+		ctx.updateConfig(cfg)
+
+		runGoldenRecords(ctx, androidNoCompatGoldenDir, []goldenFile{
+			createAndroidClangPathGoldenInputs(ctx),
+		})
+	})
+}
+
 func createAndroidClangPathGoldenInputs(ctx *testContext) goldenFile {
 	gomaPath := path.Join(ctx.tempDir, "gomacc")
 	ctx.writeFile(gomaPath, "")
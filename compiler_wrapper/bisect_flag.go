@@ -56,7 +56,7 @@ func calcBisectCommand(env env, cfg *config, bisectStage string, compilerCmd *co
 	if err != nil {
 		return nil, err
 	}
-	pythonPath, err = filepath.EvalSymlinks(pythonPath)
+	pythonPath, err = env.fs().evalSymlinks(pythonPath)
 	if err != nil {
 		return nil, err
 	}
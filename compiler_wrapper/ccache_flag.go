@@ -4,12 +4,92 @@
 
 package main
 
-func processCCacheFlag(sysroot string, builder *commandBuilder) {
-	// We should be able to share the objects across compilers as
-	// the pre-processed output will differ.  This allows boards
-	// that share compiler flags (like x86 boards) to share caches.
-	const ccacheDir = "/var/cache/distfiles/ccache"
+import (
+	"path/filepath"
+)
+
+// Settings for the local cache launcher that wraps the compiler.
+// The zero value uses ccache with the defaults of the old wrapper.
+type cacheLauncher struct {
+	// Name of the launcher kind, see cacheLauncherKinds.
+	// Defaults to "ccache".
+	kind string
+	// Path of the launcher binary. Defaults to /usr/bin/<kind>.
+	path string
+	// Directory of the cache. Defaults to /var/cache/distfiles/<kind>.
+	cacheDir string
+	// Directory that paths in the cache key are made relative to:
+	// "sysroot" or "none". Defaults to "sysroot" if the launcher
+	// supports it.
+	baseDirPolicy string
+	// Value for CCACHE_SLOPPINESS. Empty to not set it.
+	sloppiness string
+	// Value for CCACHE_COMPILERCHECK, e.g. "content". Empty to not set it.
+	compilerCheck string
+}
+
+// The env variables a launcher kind is configured with.
+// Empty names mean that the launcher has no such setting.
+type cacheLauncherKind struct {
+	name             string
+	cacheDirEnv      string
+	baseDirEnv       string
+	umaskEnv         string
+	sloppinessEnv    string
+	compilerCheckEnv string
+	// Env variable that portage sets to disable the launcher.
+	disableEnv string
+	// Env updates for clang.
+	clangEnvUpdates []string
+	// Whether the launcher can cache rustc invocations.
+	supportsRustc bool
+}
+
+var cacheLauncherKinds = []*cacheLauncherKind{
+	{
+		name:          "sccache",
+		cacheDirEnv:   "SCCACHE_DIR",
+		supportsRustc: true,
+	},
+	{
+		name:             "ccache",
+		cacheDirEnv:      "CCACHE_DIR",
+		baseDirEnv:       "CCACHE_BASEDIR",
+		umaskEnv:         "CCACHE_UMASK",
+		sloppinessEnv:    "CCACHE_SLOPPINESS",
+		compilerCheckEnv: "CCACHE_COMPILERCHECK",
+		disableEnv:       "CCACHE_DISABLE",
+		// ccache may generate false positive warnings.
+		// Workaround bug https://crbug.com/649740
+		clangEnvUpdates: []string{"CCACHE_CPP2=yes"},
+	},
+}
 
+func getCacheLauncherKind(name string) (*cacheLauncherKind, error) {
+	if name == "" {
+		name = "ccache"
+	}
+	for _, kind := range cacheLauncherKinds {
+		if kind.name == name {
+			return kind, nil
+		}
+	}
+	return nil, newErrorwithSourceLocf("unknown cache launcher: %s", name)
+}
+
+// Returns the path of the launcher binary.
+func getCacheLauncherPath(launcher cacheLauncher) string {
+	if launcher.path != "" {
+		return launcher.path
+	}
+	kind := launcher.kind
+	if kind == "" {
+		kind = "ccache"
+	}
+	return "/usr/bin/" + kind
+}
+
+func processCCacheFlag(sysroot string, builder *commandBuilder) error {
 	useCCache := true
 	builder.transformArgs(func(arg builderArg) string {
 		if arg.value == "-noccache" {
@@ -19,7 +99,37 @@ func processCCacheFlag(sysroot string, builder *commandBuilder) {
 		return arg.value
 	})
 
-	if builder.cfg.useCCache && useCCache {
+	if !builder.cfg.useCCache || !useCCache {
+		return nil
+	}
+	launcher := builder.cfg.cacheLauncher
+	kind, err := getCacheLauncherKind(launcher.kind)
+	if err != nil {
+		return err
+	}
+	if builder.target.compilerType == rustcType && !kind.supportsRustc {
+		return nil
+	}
+	// We should be able to share the objects across compilers as
+	// the pre-processed output will differ.  This allows boards
+	// that share compiler flags (like x86 boards) to share caches.
+	cacheDir := launcher.cacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join("/var/cache/distfiles", kind.name)
+	}
+
+	baseDirPolicy := launcher.baseDirPolicy
+	if baseDirPolicy == "" {
+		baseDirPolicy = "sysroot"
+		if kind.baseDirEnv == "" {
+			baseDirPolicy = "none"
+		}
+	}
+	switch baseDirPolicy {
+	case "sysroot":
+		if kind.baseDirEnv == "" {
+			return newErrorwithSourceLocf("%s does not support a base dir", kind.name)
+		}
 		// We need to get ccache to make relative paths from within the
 		// sysroot.  This lets us share cached files across boards (if
 		// all other things are equal of course like CFLAGS) as well as
@@ -37,28 +147,47 @@ func processCCacheFlag(sysroot string, builder *commandBuilder) {
 		//   $ emerge-$BOARD cros-disks
 		// All of those will get cache hits (ignoring the first one
 		// which will seed the cache) due to this setting.
-		builder.updateEnv("CCACHE_BASEDIR=" + sysroot)
-		if _, present := builder.env.getenv("CCACHE_DISABLE"); present {
+		builder.updateEnv(kind.baseDirEnv + "=" + sysroot)
+	case "none":
+	default:
+		return newErrorwithSourceLocf("unknown base dir policy: %s", launcher.baseDirPolicy)
+	}
+	if kind.disableEnv != "" {
+		if _, present := builder.env.getenv(kind.disableEnv); present {
 			// Portage likes to set this for us when it has FEATURES=-ccache.
 			// The other vars we need to setup manually because of tools like
 			// scons that scrubs the env before we get executed.
-			builder.updateEnv("CCACHE_DISABLE=")
-		}
-		// If RESTRICT=sandbox is enabled, then sandbox won't be setup,
-		// and the env vars won't be available for appending.
-		if sandboxRewrite, present := builder.env.getenv("SANDBOX_WRITE"); present {
-			builder.updateEnv("SANDBOX_WRITE=" + sandboxRewrite + ":" + ccacheDir)
+			builder.updateEnv(kind.disableEnv + "=")
 		}
+	}
+	// If RESTRICT=sandbox is enabled, then sandbox won't be setup,
+	// and the env vars won't be available for appending.
+	if sandboxRewrite, present := builder.env.getenv("SANDBOX_WRITE"); present {
+		builder.updateEnv("SANDBOX_WRITE=" + sandboxRewrite + ":" + cacheDir)
+	}
 
+	builder.updateEnv(kind.cacheDirEnv + "=" + cacheDir)
+	if kind.umaskEnv != "" {
 		// Make sure we keep the cached files group writable.
-		builder.updateEnv("CCACHE_DIR="+ccacheDir, "CCACHE_UMASK=002")
-
-		// ccache may generate false positive warnings.
-		// Workaround bug https://crbug.com/649740
-		if builder.target.compilerType == clangType {
-			builder.updateEnv("CCACHE_CPP2=yes")
+		builder.updateEnv(kind.umaskEnv + "=002")
+	}
+	if launcher.sloppiness != "" {
+		if kind.sloppinessEnv == "" {
+			return newErrorwithSourceLocf("%s does not support sloppiness settings", kind.name)
+		}
+		builder.updateEnv(kind.sloppinessEnv + "=" + launcher.sloppiness)
+	}
+	if launcher.compilerCheck != "" {
+		if kind.compilerCheckEnv == "" {
+			return newErrorwithSourceLocf("%s does not support compiler check settings", kind.name)
 		}
+		builder.updateEnv(kind.compilerCheckEnv + "=" + launcher.compilerCheck)
+	}
 
-		builder.wrapPath("/usr/bin/ccache")
+	if builder.target.compilerType == clangType {
+		builder.updateEnv(kind.clangEnvUpdates...)
 	}
+
+	builder.wrapPath(kind.name, getCacheLauncherPath(launcher))
+	return nil
 }
@@ -165,6 +165,75 @@ func TestOmitCCacheCpp2FlagForGcc(t *testing.T) {
 	})
 }
 
+func TestCallSCCacheGivenConfig(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		ctx.cfg.cacheLauncher = cacheLauncher{kind: "sccache"}
+		ctx.env = []string{"SANDBOX_WRITE=xyz", "CCACHE_DISABLE=1"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, "/usr/bin/sccache"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyEnvUpdate(cmd, "SCCACHE_DIR=/var/cache/distfiles/sccache"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyEnvUpdate(cmd, "SANDBOX_WRITE=xyz:/var/cache/distfiles/sccache"); err != nil {
+			t.Error(err)
+		}
+		for _, envVar := range []string{"CCACHE_DIR", "CCACHE_BASEDIR", "CCACHE_UMASK", "CCACHE_CPP2", "CCACHE_DISABLE"} {
+			if err := verifyNoEnvUpdate(cmd, envVar); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestSetCCacheLauncherSettings(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		ctx.cfg.cacheLauncher = cacheLauncher{
+			path:          "/opt/bin/ccache",
+			cacheDir:      "/somedir",
+			baseDirPolicy: "none",
+			sloppiness:    "time_macros",
+			compilerCheck: "content",
+		}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, mainCc)))
+		if err := verifyPath(cmd, "/opt/bin/ccache"); err != nil {
+			t.Error(err)
+		}
+		for _, envUpdate := range []string{"CCACHE_DIR=/somedir", "CCACHE_UMASK=002",
+			"CCACHE_SLOPPINESS=time_macros", "CCACHE_COMPILERCHECK=content"} {
+			if err := verifyEnvUpdate(cmd, envUpdate); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := verifyNoEnvUpdate(cmd, "CCACHE_BASEDIR"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestErrorOnUnsupportedCacheLauncherSettings(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		for _, launcher := range []cacheLauncher{
+			{kind: "unknown"},
+			{baseDirPolicy: "unknown"},
+			{kind: "sccache", baseDirPolicy: "sysroot"},
+			{kind: "sccache", sloppiness: "time_macros"},
+			{kind: "sccache", compilerCheck: "content"},
+		} {
+			ctx.cfg.cacheLauncher = launcher
+			ctx.stderrBuffer.Reset()
+			stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+				ctx.newCommand(gccX86_64, mainCc)))
+			if err := verifyInternalError(stderr); err != nil {
+				t.Errorf("launcher %#v: %s", launcher, err)
+			}
+		}
+	})
+}
+
 func withCCacheEnabledTestContext(t *testing.T, work func(ctx *testContext)) {
 	withTestContext(t, func(ctx *testContext) {
 		ctx.cfg.useCCache = true
@@ -16,10 +16,14 @@ func processClangFlags(builder *commandBuilder) error {
 	clangDir, _ := env.getenv("CLANG")
 
 	if clangDir == "" {
-		if builder.cfg.isHostWrapper {
+		if builder.cfg.useLlvmNext && builder.cfg.llvmNextClangRelDir != "" {
+			clangDir = filepath.Join(builder.rootPath, builder.cfg.llvmNextClangRelDir)
+		} else if builder.cfg.isHostWrapper {
 			clangDir = filepath.Dir(builder.absWrapperPath)
 		} else {
 			clangDir = filepath.Join(builder.rootPath, "usr/bin/")
+		}
+		if !builder.cfg.isHostWrapper {
 			if !filepath.IsAbs(builder.path) {
 				// If sysroot_wrapper is invoked by relative path, call actual compiler in
 				// relative form. This is neccesary to remove absolute path from compile
@@ -119,7 +123,7 @@ func processClangFlags(builder *commandBuilder) error {
 
 		if clangPath := "-Xclang-path="; strings.HasPrefix(arg.value, clangPath) {
 			clangPathValue := arg.value[len(clangPath):]
-			resourceDir, err := getClangResourceDir(env, filepath.Join(clangDir, clangBasename))
+			resourceDir, err := getClangResourceDir(env, builder.cfg, filepath.Join(clangDir, clangBasename))
 			if err != nil {
 				return err
 			}
@@ -133,12 +137,13 @@ func processClangFlags(builder *commandBuilder) error {
 		addNewArg(arg.value)
 	}
 	builder.args = newArgs
+	builder.updateInvocation()
 
 	builder.path = filepath.Join(clangDir, clangBasename)
 
 	// Specify the target for clang.
 	if !builder.cfg.isHostWrapper {
-		linkerPath := getLinkerPath(env, builder.target.target+"-ld", builder.rootPath)
+		linkerPath := getLinkerPath(env, builder.cfg, builder.target.target+"-ld", builder.rootPath)
 		relLinkerPath, err := filepath.Rel(env.getwd(), linkerPath)
 		if err != nil {
 			return wrapErrorwithSourceLocf(err, "failed to make linker path %s relative to %s",
@@ -161,7 +166,24 @@ func processClangFlags(builder *commandBuilder) error {
 	return nil
 }
 
-func getClangResourceDir(env env, clangPath string) (string, error) {
+// Returns the resource dir of the given clang. The result is cached,
+// see probe_cache.go.
+func getClangResourceDir(env env, cfg *config, clangPath string) (string, error) {
+	if !strings.ContainsRune(clangPath, filepath.Separator) {
+		// The command is resolved against PATH, so we don't know
+		// which file the result depends on.
+		return probeClangResourceDir(env, clangPath)
+	}
+	absClangPath := clangPath
+	if !filepath.IsAbs(absClangPath) {
+		absClangPath = filepath.Join(env.getwd(), absClangPath)
+	}
+	return cachedProbe(env, cfg, "resource-dir\x00"+absClangPath, []string{absClangPath}, func() (string, error) {
+		return probeClangResourceDir(env, clangPath)
+	})
+}
+
+func probeClangResourceDir(env env, clangPath string) (string, error) {
 	readResourceCmd := &command{
 		Path: clangPath,
 		Args: []string{"--print-resource-dir"},
@@ -177,33 +199,43 @@ func getClangResourceDir(env env, clangPath string) (string, error) {
 }
 
 // Return the a directory which contains an 'ld' that gcc is using.
-func getLinkerPath(env env, linkerCmd string, rootPath string) string {
+func getLinkerPath(env env, cfg *config, linkerCmd string, rootPath string) string {
+	if linkerDir := findLinkerDirInPath(env, cfg, linkerCmd); linkerDir != "" {
+		return linkerDir
+	}
+
+	// When using the sdk outside chroot, we need to provide the cross linker path
+	// to the compiler via -B ${linker_path}. This is because for gcc, it can
+	// find the right linker via searching its internal paths. Clang does not have
+	// such feature, and it falls back to $PATH search only. However, the path of
+	// ${SDK_LOCATION}/bin is not necessarily in the ${PATH}. To fix this, we
+	// provide the directory that contains the cross linker wrapper to clang.
+	// Outside chroot, it is the top bin directory form the sdk tarball.
+	return filepath.Join(rootPath, "bin")
+}
+
+// Returns the directory of the linker in PATH, or "" if it was not found.
+func findLinkerDirInPath(env env, cfg *config, linkerCmd string) string {
 	// We did not pass the tuple i686-pc-linux-gnu to x86-32 clang. Instead,
 	// we passed '-m32' to clang. As a result, clang does not want to use the
 	// i686-pc-linux-gnu-ld, so we need to add this to help clang find the right
 	// linker.
 	if linkerPath, err := resolveAgainstPathEnv(env, linkerCmd); err == nil {
-		// FIXME: We are not using filepath.EvalSymlinks to only unpack
-		// one layer of symlinks to match the old wrapper. Investigate
-		// why this is important or simplify to filepath.EvalSymlinks.
-		if fi, err := os.Lstat(linkerPath); err == nil {
+		if cfg.disableOldWrapperCompat {
+			if evaledPath, err := env.fs().evalSymlinks(linkerPath); err == nil {
+				return filepath.Dir(evaledPath)
+			}
+		} else if fi, err := env.fs().lstat(linkerPath); err == nil {
+			// Note: The old wrapper only unpacks one layer of symlinks.
 			if fi.Mode()&os.ModeSymlink != 0 {
-				if linkPath, err := os.Readlink(linkerPath); err == nil {
+				if linkPath, err := env.fs().readlink(linkerPath); err == nil {
 					linkerPath = linkPath
 				}
 			}
 			return filepath.Dir(linkerPath)
 		}
 	}
-
-	// When using the sdk outside chroot, we need to provide the cross linker path
-	// to the compiler via -B ${linker_path}. This is because for gcc, it can
-	// find the right linker via searching its internal paths. Clang does not have
-	// such feature, and it falls back to $PATH search only. However, the path of
-	// ${SDK_LOCATION}/bin is not necessarily in the ${PATH}. To fix this, we
-	// provide the directory that contains the cross linker wrapper to clang.
-	// Outside chroot, it is the top bin directory form the sdk tarball.
-	return filepath.Join(rootPath, "bin")
+	return ""
 }
 
 func hasAtLeastOnePrefix(s string, prefixes []string) bool {
@@ -288,6 +288,48 @@ func TestClangLinkerPathEvaluatesSymlinksForBinariesOnPath(t *testing.T) {
 	})
 }
 
+func TestClangLinkerPathEvaluatesAllSymlinksWithoutOldWrapperCompat(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		realLinkerPath := filepath.Join(ctx.tempDir, "a/original/path/somelinker")
+		ctx.writeFile(realLinkerPath, "")
+		firstLinkLinkerPath := filepath.Join(ctx.tempDir, "a/first/somelinker")
+		ctx.symlink(realLinkerPath, firstLinkLinkerPath)
+		secondLinkLinkerPath := filepath.Join(ctx.tempDir, "a/second/x86_64-cros-linux-gnu-ld")
+		ctx.symlink(firstLinkLinkerPath, secondLinkLinkerPath)
+
+		ctx.cfg.disableOldWrapperCompat = true
+		ctx.env = []string{"PATH=nonExistantPath:" + filepath.Dir(secondLinkLinkerPath)}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./x86_64-cros-linux-gnu-clang", mainCc)))
+		if err := verifyArgOrder(cmd, "-Ba/original/path"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestClangLinkerPathWithBrokenSymlink(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		memfs := ctx.useMemFileSystem()
+		linkerPath := filepath.Join(ctx.tempDir, "a/second/x86_64-cros-linux-gnu-ld")
+		memfs.symlink(t, filepath.Join(ctx.tempDir, "a/missing/somelinker"), linkerPath)
+		ctx.env = []string{"PATH=" + filepath.Dir(linkerPath)}
+
+		// Note: The old wrapper only reads the link, so the broken link is used.
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-Ba/missing"); err != nil {
+			t.Error(err)
+		}
+
+		ctx.cfg.disableOldWrapperCompat = true
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-Bbin"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestClangFallbackLinkerPathRelativeToRootDir(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
 		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
@@ -20,10 +20,13 @@ func processClangSyntaxFlag(builder *commandBuilder) (clangSyntax bool) {
 }
 
 func checkClangSyntax(env env, clangCmd *command, gccCmd *command) (exitCode int, err error) {
+	clangCmd = forceColorDiagnostics(env, clangCmd)
+	gccCmd = forceColorDiagnostics(env, gccCmd)
 	clangSyntaxCmd := &command{
-		Path:       clangCmd.Path,
-		Args:       append(clangCmd.Args, "-fsyntax-only", "-stdlib=libstdc++"),
-		EnvUpdates: clangCmd.EnvUpdates,
+		Path:         clangCmd.Path,
+		Args:         append(clangCmd.Args, "-fsyntax-only", "-stdlib=libstdc++"),
+		EnvUpdates:   clangCmd.EnvUpdates,
+		launcherName: clangCmd.launcherName,
 	}
 
 	stdinBuffer := &bytes.Buffer{}
@@ -5,37 +5,101 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-func processClangTidyFlags(builder *commandBuilder) (cSrcFile string, useClangTidy bool) {
-	withTidy, _ := builder.env.getenv("WITH_TIDY")
-	if withTidy == "" {
-		return "", false
+const clangTidyJobsKey = "CLANG_TIDY_JOBS"
+
+func shouldRunClangTidy(env env) bool {
+	withTidy, _ := env.getenv("WITH_TIDY")
+	return withTidy != ""
+}
+
+// Languages of the inputs that clang-tidy is run for. Note that this
+// honors -x, e.g. `-x c++ foo.inc` is checked, but `foo.S` is not.
+var clangTidyLanguages = map[string]bool{
+	"c":             true,
+	"c++":           true,
+	"objective-c":   true,
+	"objective-c++": true,
+}
+
+func processClangTidyFlags(builder *commandBuilder) (srcFiles []string, useClangTidy bool) {
+	for _, input := range builder.invocation.sourceInputs() {
+		if clangTidyLanguages[input.language] {
+			srcFiles = append(srcFiles, input.path)
+		}
 	}
-	srcFileSuffixes := []string{
-		".c",
-		".cc",
-		".cpp",
-		".C",
-		".cxx",
-		".c++",
+	useClangTidy = len(srcFiles) > 0
+	return srcFiles, useClangTidy
+}
+
+// Returns the maximum number of clang-tidy processes to run in parallel.
+// Can be set via CLANG_TIDY_JOBS and defaults to the number of CPUs.
+func getClangTidyJobs(env env) (int, error) {
+	value, _ := env.getenv(clangTidyJobsKey)
+	if value == "" {
+		return runtime.NumCPU(), nil
+	}
+	jobs, err := strconv.Atoi(value)
+	if err != nil || jobs < 1 {
+		return 0, newUserErrorf("invalid value for %s: %q", clangTidyJobsKey, value)
 	}
-	cSrcFile = ""
-	lastArg := ""
-	for _, arg := range builder.args {
-		if hasAtLeastOneSuffix(arg.value, srcFileSuffixes) && lastArg != "-o" {
-			cSrcFile = arg.value
+	return jobs, nil
+}
+
+// Runs clang-tidy for all given source files in parallel. The output
+// of each clang-tidy run is buffered and forwarded in the order of the
+// source files so that the outputs don't get interleaved.
+func runClangTidy(env env, cfg *config, clangCmd *command, srcFiles []string) error {
+	jobs, err := getClangTidyJobs(env)
+	if err != nil {
+		return err
+	}
+	resourceDir, err := getClangResourceDir(env, cfg, clangCmd.Path)
+	if err != nil {
+		return err
+	}
+
+	type clangTidyResult struct {
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+		err    error
+	}
+	results := make([]clangTidyResult, len(srcFiles))
+	semaphore := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, srcFile := range srcFiles {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(result *clangTidyResult, srcFile string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			result.err = runClangTidyForFile(env, clangCmd, resourceDir, srcFile, &result.stdout, &result.stderr)
+		}(&results[i], srcFile)
+	}
+	wg.Wait()
+
+	for i := range results {
+		io.Copy(env.stdout(), &results[i].stdout)
+		io.Copy(env.stderr(), &results[i].stderr)
+		if results[i].err != nil {
+			return results[i].err
 		}
-		lastArg = arg.value
 	}
-	useClangTidy = cSrcFile != ""
-	return cSrcFile, useClangTidy
+	return nil
 }
 
-func runClangTidy(env env, clangCmd *command, cSrcFile string) error {
+func runClangTidyForFile(env env, clangCmd *command, resourceDir string, cSrcFile string, stdout io.Writer, stderr io.Writer) error {
 	defaultTidyChecks := strings.Join([]string{
 		"*",
 		"google*",
@@ -61,11 +125,6 @@ func runClangTidy(env env, clangCmd *command, cSrcFile string) error {
 		"-readability-*",
 	}, ",")
 
-	resourceDir, err := getClangResourceDir(env, clangCmd.Path)
-	if err != nil {
-		return err
-	}
-
 	clangTidyPath := filepath.Join(filepath.Dir(clangCmd.Path), "clang-tidy")
 	clangTidyCmd := &command{
 		Path: clangTidyPath,
@@ -81,11 +140,11 @@ func runClangTidy(env env, clangCmd *command, cSrcFile string) error {
 	// Note: We pass nil as stdin as we checked before that the compiler
 	// was invoked with a source file argument.
 	exitCode, err := wrapSubprocessErrorWithSourceLoc(clangTidyCmd,
-		env.run(clangTidyCmd, nil, env.stdout(), env.stderr()))
+		env.run(clangTidyCmd, nil, stdout, stderr))
 	if err == nil && exitCode != 0 {
 		// Note: We continue on purpose when clang-tidy fails
 		// to maintain compatibility with the previous wrapper.
-		fmt.Fprint(env.stderr(), "clang-tidy failed")
+		fmt.Fprint(stderr, "clang-tidy failed")
 	}
 	return err
 }
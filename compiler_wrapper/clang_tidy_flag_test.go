@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -208,6 +210,85 @@ func TestUseClangTidyBasedOnFileExtension(t *testing.T) {
 	})
 }
 
+func TestRunClangTidyForAllSourceFiles(t *testing.T) {
+	withClangTidyTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "CLANG_TIDY_JOBS=4")
+		var mu sync.Mutex
+		tidiedFiles := map[string]bool{}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if strings.HasSuffix(cmd.Path, "clang-tidy") {
+				mu.Lock()
+				defer mu.Unlock()
+				tidiedFiles[cmd.Args[1]] = true
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "a.c", "b.cxx", "c.m", "d.S", "e.o", "lib.a", "-x", "c++", "f.inc", "-o", "prog")))
+		expected := map[string]bool{"a.c": true, "b.cxx": true, "c.m": true, "f.inc": true}
+		if !reflect.DeepEqual(tidiedFiles, expected) {
+			t.Errorf("unexpected files checked by clang-tidy. Got: %v, expected: %v", tidiedFiles, expected)
+		}
+		// 1 call for the resource dir, 4 calls to clang-tidy, 1 call to clang.
+		if ctx.cmdCount != 6 {
+			t.Errorf("expected 6 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestForwardClangTidyOutputInSourceFileOrder(t *testing.T) {
+	withClangTidyTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "CLANG_TIDY_JOBS=3")
+		// Let the runs complete in reverse order: c.c, b.c, a.c.
+		done := map[string]chan struct{}{
+			"a.c": make(chan struct{}),
+			"b.c": make(chan struct{}),
+			"c.c": make(chan struct{}),
+		}
+		waitFor := map[string]string{"a.c": "b.c", "b.c": "c.c"}
+		var mu sync.Mutex
+		completed := []string{}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if !strings.HasSuffix(cmd.Path, "clang-tidy") {
+				return nil
+			}
+			srcFile := cmd.Args[1]
+			if other, ok := waitFor[srcFile]; ok {
+				<-done[other]
+			}
+			fmt.Fprintf(stdout, "%s;", srcFile)
+			fmt.Fprintf(stderr, "%s!", srcFile)
+			mu.Lock()
+			completed = append(completed, srcFile)
+			mu.Unlock()
+			close(done[srcFile])
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "a.c", "b.c", "c.c", "-o", "prog")))
+		if !reflect.DeepEqual(completed, []string{"c.c", "b.c", "a.c"}) {
+			t.Errorf("unexpected completion order: %s", completed)
+		}
+		if ctx.stdoutString() != "a.c;b.c;c.c;" {
+			t.Errorf("unexpected stdout. Got: %s", ctx.stdoutString())
+		}
+		if ctx.stderrString() != "a.c!b.c!c.c!" {
+			t.Errorf("unexpected stderr. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestReportErrorForInvalidClangTidyJobs(t *testing.T) {
+	withClangTidyTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "CLANG_TIDY_JOBS=0")
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid value for CLANG_TIDY_JOBS: "0"`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestOmitCCacheWithClangTidy(t *testing.T) {
 	withClangTidyTestContext(t, func(ctx *testContext) {
 		ctx.cfg.useCCache = true
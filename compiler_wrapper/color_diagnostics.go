@@ -0,0 +1,65 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+)
+
+// Compilers only print colored diagnostics if their stderr is a terminal.
+// When the wrapper captures the output of the compiler, e.g. to retry
+// without -Werror, stderr is a pipe, so the wrapper forces colors if its
+// own stderr is a terminal. Anything written into log files is stripped
+// of the color codes.
+
+// Flags that force colored diagnostics.
+var colorDiagnosticsFlags = map[compilerType][]string{
+	clangType: {"-fcolor-diagnostics"},
+	gccType:   {"-fdiagnostics-color=always"},
+	rustcType: {"--color=always"},
+}
+
+// Prefixes of flags that choose whether to color diagnostics.
+var colorDiagnosticsFlagPrefixes = []string{
+	"-fcolor-diagnostics",
+	"-fno-color-diagnostics",
+	"-fdiagnostics-color",
+	"-fno-diagnostics-color",
+	"--color",
+}
+
+// Matches the escape sequences compilers use for colors, e.g. "\x1b[1;31m"
+// and "\x1b[K".
+var ansiEscapeRegex = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// Returns the flags that force colored diagnostics for the command,
+// or nil if the command already chooses whether to use colors.
+func getColorDiagnosticsArgs(builder *commandBuilder) []string {
+	for _, arg := range builder.args {
+		if hasAtLeastOnePrefix(arg.value, colorDiagnosticsFlagPrefixes) {
+			return nil
+		}
+	}
+	return colorDiagnosticsFlags[builder.target.compilerType]
+}
+
+// Returns the command with colored diagnostics if the stderr of the
+// wrapper is a terminal. Needs to be called for commands whose stderr
+// is captured.
+func forceColorDiagnostics(env env, cmd *command) *command {
+	if len(cmd.colorDiagnosticsArgs) == 0 || !env.stderrIsTerminal() {
+		return cmd
+	}
+	return &command{
+		Path:         cmd.Path,
+		Args:         append(append([]string{}, cmd.Args...), cmd.colorDiagnosticsArgs...),
+		EnvUpdates:   cmd.EnvUpdates,
+		launcherName: cmd.launcherName,
+	}
+}
+
+func stripANSIEscapes(s string) string {
+	return ansiEscapeRegex.ReplaceAllString(s, "")
+}
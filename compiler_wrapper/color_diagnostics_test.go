@@ -0,0 +1,109 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStripANSIEscapes(t *testing.T) {
+	input := "\x1b[1mmain.cc:1:1: \x1b[0;1;31merror: \x1b[0m\x1b[1msomeerror\x1b[0m\x1b[K\n"
+	if actual := stripANSIEscapes(input); actual != "main.cc:1:1: error: someerror\n" {
+		t.Errorf("unexpected output. Got: %q", actual)
+	}
+}
+
+func TestOmitColorFlagsIfStderrIsNotTerminal(t *testing.T) {
+	withForceDisableWErrorTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fcolor-diagnostics"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestForceColorsForDoubleBuildIfStderrIsTerminal(t *testing.T) {
+	withForceDisableWErrorTestContext(t, func(ctx *testContext) {
+		ctx.stderrTerminal = true
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if err := verifyArgCount(cmd, 1, "-fcolor-diagnostics"); err != nil {
+				return err
+			}
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprint(stderr, "\x1b[1;31merror:\x1b[0m -Werror")
+				return newExitCodeError(1)
+			case 2:
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+		if loggedWarnings := readLoggedWarnings(ctx); loggedWarnings.Stdout != "error: -Werror" {
+			t.Errorf("unexpected warnings. Got: %q", loggedWarnings.Stdout)
+		}
+	})
+}
+
+func TestKeepUserColorChoiceIfStderrIsTerminal(t *testing.T) {
+	withForceDisableWErrorTestContext(t, func(ctx *testContext) {
+		ctx.stderrTerminal = true
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-fdiagnostics-color=never", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fdiagnostics-color=always"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestForceGccColorsForLauncherIfStderrIsTerminal(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		ctx.stderrTerminal = true
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if err := verifyPath(cmd, "/usr/bin/ccache"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, mainCc, "-fdiagnostics-color=always"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestCompileWithFallbackForcesColorsIfStderrIsTerminal(t *testing.T) {
+	withCompileWithFallbackTestContext(t, func(ctx *testContext) {
+		ctx.stderrTerminal = true
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				if err := verifyArgCount(cmd, 1, "-fcolor-diagnostics"); err != nil {
+					return err
+				}
+				if err := verifyArgCount(cmd, 0, "-fno-color-diagnostics"); err != nil {
+					return err
+				}
+				fmt.Fprint(stderr, "\x1b[1;31merror:\x1b[0m someerror")
+				return newExitCodeError(1)
+			case 2:
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand("./clang", mainCc)))
+		log := readCompileWithFallbackErrorLog(ctx)
+		if !strings.Contains(log, "error: someerror") || strings.Contains(log, "\x1b") {
+			t.Errorf("unexpected log. Got: %q", log)
+		}
+	})
+}
@@ -21,6 +21,11 @@ type command struct {
 	// Removals have the form:
 	// `NAME=`.
 	EnvUpdates []string `json:"env_updates,omitempty"`
+	// Flags that force colored diagnostics, see forceColorDiagnostics.
+	colorDiagnosticsArgs []string
+	// Name of the launcher that Path refers to, e.g. "ccache".
+	// Empty if the compiler is called directly.
+	launcherName string
 }
 
 func newProcessCommand() *command {
@@ -74,7 +79,7 @@ func resolveAgainstPathEnv(env env, cmd string) (string, error) {
 	path, _ := env.getenv("PATH")
 	for _, path := range strings.Split(path, ":") {
 		resolvedPath := filepath.Join(path, cmd)
-		if _, err := os.Lstat(resolvedPath); err == nil {
+		if _, err := env.fs().lstat(resolvedPath); err == nil {
 			return resolvedPath, nil
 		}
 	}
@@ -133,6 +138,8 @@ func newCommandBuilder(env env, cfg *config, cmd *command) (*commandBuilder, err
 		compilerType = clangTidyType
 	case strings.HasPrefix(target.compiler, "clang"):
 		compilerType = clangType
+	case target.compiler == "rustc":
+		compilerType = rustcType
 	default:
 		compilerType = gccType
 	}
@@ -142,7 +149,7 @@ func newCommandBuilder(env env, cfg *config, cmd *command) (*commandBuilder, err
 		return nil, err
 	}
 	rootPath := filepath.Join(filepath.Dir(absWrapperPath), cfg.rootRelPath)
-	return &commandBuilder{
+	builder := &commandBuilder{
 		path:           cmd.Path,
 		args:           createBuilderArgs( /*fromUser=*/ true, cmd.Args),
 		env:            env,
@@ -150,7 +157,9 @@ func newCommandBuilder(env env, cfg *config, cmd *command) (*commandBuilder, err
 		rootPath:       rootPath,
 		absWrapperPath: absWrapperPath,
 		target:         target,
-	}, nil
+	}
+	builder.updateInvocation()
+	return builder, nil
 }
 
 type commandBuilder struct {
@@ -162,6 +171,13 @@ type commandBuilder struct {
 	cfg            *config
 	rootPath       string
 	absWrapperPath string
+	// The meaning of args. Kept in sync with args.
+	invocation *invocation
+	// Number of leading args that belong to launchers added
+	// via wrapPath, e.g. the path of the compiler for gomacc.
+	numLauncherArgs int
+	// Name of the outermost launcher added via wrapPath, e.g. "ccache".
+	launcherName string
 }
 
 type builderArg struct {
@@ -175,6 +191,7 @@ const (
 	gccType compilerType = iota
 	clangType
 	clangTidyType
+	rustcType
 )
 
 type builderTarget struct {
@@ -197,19 +214,28 @@ func createBuilderArgs(fromUser bool, args []string) []builderArg {
 
 func (builder *commandBuilder) clone() *commandBuilder {
 	return &commandBuilder{
-		path:           builder.path,
-		args:           append([]builderArg{}, builder.args...),
-		env:            builder.env,
-		cfg:            builder.cfg,
-		rootPath:       builder.rootPath,
-		target:         builder.target,
-		absWrapperPath: builder.absWrapperPath,
+		path:            builder.path,
+		args:            append([]builderArg{}, builder.args...),
+		env:             builder.env,
+		cfg:             builder.cfg,
+		rootPath:        builder.rootPath,
+		target:          builder.target,
+		absWrapperPath:  builder.absWrapperPath,
+		invocation:      builder.invocation,
+		numLauncherArgs: builder.numLauncherArgs,
+		launcherName:    builder.launcherName,
 	}
 }
 
-func (builder *commandBuilder) wrapPath(path string) {
+func (builder *commandBuilder) wrapPath(launcherName string, path string) {
 	builder.args = append([]builderArg{{value: builder.path, fromUser: false}}, builder.args...)
 	builder.path = path
+	builder.numLauncherArgs++
+	builder.launcherName = launcherName
+}
+
+func (builder *commandBuilder) updateInvocation() {
+	builder.invocation = parseBuilderInvocation(builder.args[builder.numLauncherArgs:])
 }
 
 func (builder *commandBuilder) addPreUserArgs(args ...string) {
@@ -221,10 +247,12 @@ func (builder *commandBuilder) addPreUserArgs(args ...string) {
 		index++
 	}
 	builder.args = append(builder.args[:index], append(createBuilderArgs( /*fromUser=*/ false, args), builder.args[index:]...)...)
+	builder.updateInvocation()
 }
 
 func (builder *commandBuilder) addPostUserArgs(args ...string) {
 	builder.args = append(builder.args, createBuilderArgs( /*fromUser=*/ false, args)...)
+	builder.updateInvocation()
 }
 
 // Allows to map and filter arguments. Filters when the callback returns an empty string.
@@ -241,6 +269,24 @@ func (builder *commandBuilder) transformArgs(transform func(arg builderArg) stri
 		}
 	}
 	builder.args = newArgs
+	builder.updateInvocation()
+}
+
+// Removes all arguments that have one of the given values.
+func (builder *commandBuilder) removeArgs(values ...string) {
+	if len(values) == 0 {
+		return
+	}
+	toRemove := map[string]bool{}
+	for _, value := range values {
+		toRemove[value] = true
+	}
+	builder.transformArgs(func(arg builderArg) string {
+		if toRemove[arg.value] {
+			return ""
+		}
+		return arg.value
+	})
 }
 
 func (builder *commandBuilder) updateEnv(updates ...string) {
@@ -253,8 +299,10 @@ func (builder *commandBuilder) build() *command {
 		cmdArgs[i] = builderArg.value
 	}
 	return &command{
-		Path:       builder.path,
-		Args:       cmdArgs,
-		EnvUpdates: builder.envUpdates,
+		Path:                 builder.path,
+		Args:                 cmdArgs,
+		EnvUpdates:           builder.envUpdates,
+		colorDiagnosticsArgs: getColorDiagnosticsArgs(builder),
+		launcherName:         builder.launcherName,
 	}
 }
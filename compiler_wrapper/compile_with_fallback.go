@@ -26,20 +26,22 @@ func shouldCompileWithFallback(env env) bool {
 // FIXME: Deduplicate this logic with the logic for FORCE_DISABLE_WERROR
 // (the logic here is from Android, the logic for FORCE_DISABLE_WERROR is from ChromeOS)
 func compileWithFallback(env env, cfg *config, originalCmd *command, absWrapperPath string) (exitCode int, err error) {
+	coloredCmd := forceColorDiagnostics(env, originalCmd)
 	firstCmd := &command{
-		Path:       originalCmd.Path,
-		Args:       originalCmd.Args,
-		EnvUpdates: originalCmd.EnvUpdates,
+		Path:         coloredCmd.Path,
+		Args:         coloredCmd.Args,
+		EnvUpdates:   coloredCmd.EnvUpdates,
+		launcherName: coloredCmd.launcherName,
 	}
 	// We only want to pass extra flags to clang and clang++.
 	if base := filepath.Base(originalCmd.Path); base == "clang.real" || base == "clang++.real" {
+		if !env.stderrIsTerminal() {
+			firstCmd.Args = append(firstCmd.Args, "-fno-color-diagnostics")
+		}
 		// We may introduce some new warnings after rebasing and we need to
 		// disable them before we fix those warnings.
 		extraArgs, _ := env.getenv("ANDROID_LLVM_FALLBACK_DISABLED_WARNINGS")
-		firstCmd.Args = append(
-			append(firstCmd.Args, "-fno-color-diagnostics"),
-			strings.Split(extraArgs, " ")...,
-		)
+		firstCmd.Args = append(firstCmd.Args, strings.Split(extraArgs, " ")...)
 	}
 
 	firstCmdStdinBuffer := &bytes.Buffer{}
@@ -54,13 +56,13 @@ func compileWithFallback(env env, cfg *config, originalCmd *command, absWrapperP
 		return 0, nil
 	}
 	stderrRedirectPath, _ := env.getenv("ANDROID_LLVM_STDERR_REDIRECT")
-	f, err := os.OpenFile(stderrRedirectPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	f, err := env.fs().openFile(stderrRedirectPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return 0, wrapErrorwithSourceLocf(err, "error opening stderr file %s", stderrRedirectPath)
 	}
 	lockSuccess := false
 	for i := 0; i < 30; i++ {
-		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		err := env.fs().tryLock(f)
 		if err == nil {
 			lockSuccess = true
 			break
@@ -81,7 +83,7 @@ func compileWithFallback(env env, cfg *config, originalCmd *command, absWrapperP
 	w := bufio.NewWriter(f)
 	w.WriteString("==================COMMAND:====================\n")
 	fmt.Fprintf(w, "%s %s\n\n", firstCmd.Path, strings.Join(firstCmd.Args, " "))
-	firstCmdStderrBuffer.WriteTo(w)
+	w.WriteString(stripANSIEscapes(firstCmdStderrBuffer.String()))
 	w.WriteString("==============================================\n\n")
 	if err := w.Flush(); err != nil {
 		return 0, wrapErrorwithSourceLocf(err, "unable to write to file %s", stderrRedirectPath)
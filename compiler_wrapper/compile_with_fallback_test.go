@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestOmitFallbackCompileForSuccessfulCall(t *testing.T) {
@@ -271,6 +272,39 @@ func TestCompileWithFallbackAppendToLog(t *testing.T) {
 	})
 }
 
+func TestCompileWithFallbackWaitsForLockedLogFile(t *testing.T) {
+	withCompileWithFallbackTestContext(t, func(ctx *testContext) {
+		memfs := ctx.useMemFileSystem()
+		logFile := filepath.Join(ctx.tempDir, "fallback_stderr")
+		f, err := memfs.openFile(logFile, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := memfs.tryLock(f); err != nil {
+			t.Fatal(err)
+		}
+		// Simulates another wrapper that releases the lock while we wait.
+		time.AfterFunc(100*time.Millisecond, func() { f.Close() })
+
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprint(stderr, "someerror")
+				return newExitCodeError(1)
+			case 2:
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangAndroid, mainCc)))
+		if log := memfs.readFileString(t, logFile); !strings.Contains(log, "someerror") {
+			t.Errorf("unexpected log. Got: %s", log)
+		}
+	})
+}
+
 func withCompileWithFallbackTestContext(t *testing.T, work func(ctx *testContext)) {
 	withTestContext(t, func(ctx *testContext) {
 		ctx.cfg.isAndroidWrapper = true
@@ -5,7 +5,6 @@
 package main
 
 import (
-	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
@@ -28,10 +27,10 @@ func callCompiler(env env, cfg *config, inputCmd *command) int {
 	}
 	exitCode := 0
 	if compilerErr == nil {
-		exitCode, compilerErr = callCompilerInternal(env, cfg, inputCmd)
+		exitCode, compilerErr = callCompilerWithRecover(env, cfg, inputCmd)
 	}
 	if compilerErr != nil {
-		printCompilerError(env.stderr(), compilerErr)
+		printCompilerError(env, cfg, inputCmd, compilerErr)
 		exitCode = 1
 	}
 	return exitCode
@@ -41,26 +40,65 @@ func callCompilerInternal(env env, cfg *config, inputCmd *command) (exitCode int
 	if err := checkUnsupportedFlags(inputCmd); err != nil {
 		return 0, err
 	}
+	cfg, err = selectLlvmNext(env, cfg)
+	if err != nil {
+		return 0, err
+	}
 	mainBuilder, err := newCommandBuilder(env, cfg, inputCmd)
 	if err != nil {
 		return 0, err
 	}
-	processPrintConfigFlag(mainBuilder)
+	pkgOverride, err := findPackageOverride(env, cfg, mainBuilder.rootPath)
+	if err != nil {
+		return 0, err
+	}
+	cfg = pkgOverride.applyToConfig(cfg)
+	mainBuilder.cfg = cfg
+	if err := pkgOverride.applyCompiler(mainBuilder); err != nil {
+		return 0, err
+	}
+	if processDoctorFlag(mainBuilder) {
+		return runDoctor(mainBuilder)
+	}
+	if reportsDir, regenerate := processRegenerateWarningBaselinesFlag(mainBuilder); regenerate {
+		return regenerateWarningBaselines(env, cfg, mainBuilder.rootPath, reportsDir)
+	}
+	sourceRules, err := loadSourceRules(env, cfg, mainBuilder.rootPath)
+	if err != nil {
+		return 0, err
+	}
+	if processPrintConfigFlag(mainBuilder) {
+		printPackageOverride(env.stderr(), pkgOverride)
+	}
 	processPrintCmdlineFlag(mainBuilder)
+	printLinker := processPrintLinkerFlag(mainBuilder)
 	env = mainBuilder.env
 	var compilerCmd *command
+	shadowSettings, err := getShadowCompilerSettings(env)
+	if err != nil {
+		return 0, err
+	}
 	clangSyntax := processClangSyntaxFlag(mainBuilder)
+	// The command of the shadow compiler, if any. Uses its own builder
+	// so that it gets the flags for its own compiler type.
+	var shadowCmd *command
+	// Note: Source rules and shadow compilers only apply to C / C++.
+	isCCompiler := mainBuilder.target.compilerType == clangType || mainBuilder.target.compilerType == gccType
+	if shadowSettings != nil && isCCompiler && !clangSyntax {
+		shadowCmd, err = calcShadowCommand(shadowSettings, mainBuilder.clone(), sourceRules, pkgOverride)
+		if err != nil {
+			return 0, err
+		}
+	}
 	if cfg.isAndroidWrapper {
-		// FIXME: This combination of using the directory of the symlink but the
-		// basename of the link target is strange but is the logic that old android
-		// wrapper uses. Change this to use directory and basename either from the
-		// absWrapperPath or from the builder.path, but don't mix anymore.
-		mainBuilder.path = filepath.Join(filepath.Dir(mainBuilder.path), filepath.Base(mainBuilder.absWrapperPath)+".real")
+		mainBuilder.path = getAndroidRealCompilerPath(mainBuilder)
 
 		switch mainBuilder.target.compilerType {
 		case clangType:
 			mainBuilder.addPreUserArgs(mainBuilder.cfg.clangFlags...)
 			mainBuilder.addPreUserArgs(mainBuilder.cfg.commonFlags...)
+			pkgOverride.processFlags(mainBuilder)
+			processSourceRules(mainBuilder, sourceRules)
 			if _, err := processGomaCccFlags(mainBuilder); err != nil {
 				return 0, err
 			}
@@ -71,16 +109,22 @@ func callCompilerInternal(env env, cfg *config, inputCmd *command) (exitCode int
 			return 0, newErrorwithSourceLocf("unsupported compiler: %s", mainBuilder.target.compiler)
 		}
 	} else if mainBuilder.target.compilerType == clangType {
-		cSrcFile, useClangTidy := processClangTidyFlags(mainBuilder)
+		var srcFiles []string
+		useClangTidy := false
+		if pkgOverride.useClangTidy(shouldRunClangTidy(env)) {
+			srcFiles, useClangTidy = processClangTidyFlags(mainBuilder)
+		}
 		sysroot, err := prepareClangCommand(mainBuilder)
 		if err != nil {
 			return 0, err
 		}
+		pkgOverride.processFlags(mainBuilder)
+		processSourceRules(mainBuilder, sourceRules)
 		allowCCache := true
 		if useClangTidy {
 			allowCCache = false
 			clangCmdWithoutGomaAndCCache := mainBuilder.build()
-			if err := runClangTidy(env, clangCmdWithoutGomaAndCCache, cSrcFile); err != nil {
+			if err := runClangTidy(env, cfg, clangCmdWithoutGomaAndCCache, srcFiles); err != nil {
 				return 0, err
 			}
 		}
@@ -88,6 +132,17 @@ func callCompilerInternal(env env, cfg *config, inputCmd *command) (exitCode int
 			return 0, err
 		}
 		compilerCmd = mainBuilder.build()
+	} else if mainBuilder.target.compilerType == rustcType {
+		sysroot, err := prepareRustcCommand(mainBuilder)
+		if err != nil {
+			return 0, err
+		}
+		// Note: Source rules only apply to C / C++,
+		// and goma doesn't support rustc.
+		if err := processCCacheFlag(sysroot, mainBuilder); err != nil {
+			return 0, err
+		}
+		compilerCmd = mainBuilder.build()
 	} else {
 		if clangSyntax {
 			allowCCache := false
@@ -101,31 +156,80 @@ func callCompilerInternal(env env, cfg *config, inputCmd *command) (exitCode int
 			}
 			return checkClangSyntax(env, clangCmd, gccCmd)
 		}
-		compilerCmd, err = calcGccCommand(mainBuilder)
+		sysroot, err := prepareGccCommand(mainBuilder)
 		if err != nil {
 			return 0, err
 		}
+		pkgOverride.processFlags(mainBuilder)
+		processSourceRules(mainBuilder, sourceRules)
+		if err := processGccGomaCCacheFlags(sysroot, mainBuilder); err != nil {
+			return 0, err
+		}
+		compilerCmd = mainBuilder.build()
+	}
+	checkLinkerFlags(mainBuilder)
+	if printLinker {
+		printLinkerReport(mainBuilder)
+	}
+	if shouldAuditFlags(env) {
+		auditFlags(env, cfg, mainBuilder)
 	}
 	rusageLogfileName := getRusageLogFilename(env)
 	bisectStage := getBisectStage(env)
-	if shouldForceDisableWError(env) {
+	// The -Werror retry and the fallback compilers only apply to C / C++.
+	isRustc := mainBuilder.target.compilerType == rustcType
+	if !isRustc {
+		baseline, err := findWarningBaseline(env, cfg, mainBuilder.rootPath)
+		if err != nil {
+			return 0, err
+		}
+		if baseline != nil {
+			if rusageLogfileName != "" {
+				return 0, newUserErrorf("GETRUSAGE is meaningless with the warning baseline of %s", baseline.pkg)
+			}
+			if bisectStage != "" {
+				return 0, newUserErrorf("BISECT_STAGE is meaningless with the warning baseline of %s", baseline.pkg)
+			}
+			if shadowCmd != nil {
+				return 0, newUserErrorf("%s is meaningless with the warning baseline of %s", shadowCompilerKey, baseline.pkg)
+			}
+			forceDisableWError := pkgOverride.useWErrorRetry(shouldForceDisableWError(env))
+			return runWithWarningBaseline(env, cfg, baseline, compilerCmd, forceDisableWError)
+		}
+	}
+	if !isRustc && pkgOverride.useWErrorRetry(shouldForceDisableWError(env)) {
 		if rusageLogfileName != "" {
 			return 0, newUserErrorf("GETRUSAGE is meaningless with FORCE_DISABLE_WERROR")
 		}
 		if bisectStage != "" {
 			return 0, newUserErrorf("BISECT_STAGE is meaningless with FORCE_DISABLE_WERROR")
 		}
+		if shadowCmd != nil {
+			return 0, newUserErrorf("%s is meaningless with FORCE_DISABLE_WERROR", shadowCompilerKey)
+		}
 		return doubleBuildWithWNoError(env, cfg, compilerCmd)
 	}
-	if shouldCompileWithFallback(env) {
+	if !isRustc && shouldCompileWithFallback(env) {
 		if rusageLogfileName != "" {
 			return 0, newUserErrorf("GETRUSAGE is meaningless with FORCE_DISABLE_WERROR")
 		}
 		if bisectStage != "" {
 			return 0, newUserErrorf("BISECT_STAGE is meaningless with FORCE_DISABLE_WERROR")
 		}
+		if shadowCmd != nil {
+			return 0, newUserErrorf("%s is meaningless with %s", shadowCompilerKey, prebuiltCompilerPathKey)
+		}
 		return compileWithFallback(env, cfg, compilerCmd, mainBuilder.absWrapperPath)
 	}
+	if shadowCmd != nil {
+		if rusageLogfileName != "" {
+			return 0, newUserErrorf("GETRUSAGE is meaningless with %s", shadowCompilerKey)
+		}
+		if bisectStage != "" {
+			return 0, newUserErrorf("BISECT_STAGE is meaningless with %s", shadowCompilerKey)
+		}
+		return runWithShadowCompiler(env, cfg, shadowSettings, compilerCmd, shadowCmd)
+	}
 	if rusageLogfileName != "" {
 		if bisectStage != "" {
 			return 0, newUserErrorf("BISECT_STAGE is meaningless with GETRUSAGE")
@@ -137,6 +241,8 @@ func callCompilerInternal(env env, cfg *config, inputCmd *command) (exitCode int
 		if err != nil {
 			return 0, err
 		}
+	} else if mainBuilder.launcherName != "" && !cfg.strictLaunchers {
+		return runWithLauncherFallback(env, cfg, mainBuilder.launcherName, compilerCmd)
 	}
 	// Note: We return an exit code only if the underlying env is not
 	// really doing an exec, e.g. commandRecordingEnv.
@@ -150,10 +256,19 @@ func prepareClangCommand(builder *commandBuilder) (sysroot string, err error) {
 	}
 	builder.addPreUserArgs(builder.cfg.clangFlags...)
 	builder.addPostUserArgs(builder.cfg.clangPostFlags...)
-	calcCommonPreUserArgs(builder)
+	if err := calcCommonPreUserArgs(builder); err != nil {
+		return "", err
+	}
+	if err := processProfileFlags(builder); err != nil {
+		return "", err
+	}
+	if err := processOrderfileFlags(builder); err != nil {
+		return "", err
+	}
 	if err := processClangFlags(builder); err != nil {
 		return "", err
 	}
+	processLinkFlags(builder)
 	return sysroot, nil
 }
 
@@ -169,25 +284,41 @@ func calcClangCommand(allowCCache bool, builder *commandBuilder) (*command, erro
 }
 
 func calcGccCommand(builder *commandBuilder) (*command, error) {
-	sysroot := ""
+	sysroot, err := prepareGccCommand(builder)
+	if err != nil {
+		return nil, err
+	}
+	if err := processGccGomaCCacheFlags(sysroot, builder); err != nil {
+		return nil, err
+	}
+	return builder.build(), nil
+}
+
+func prepareGccCommand(builder *commandBuilder) (sysroot string, err error) {
+	sysroot = ""
 	if !builder.cfg.isHostWrapper {
 		sysroot = processSysrootFlag(builder)
 	}
 	builder.addPreUserArgs(builder.cfg.gccFlags...)
 	if !builder.cfg.isHostWrapper {
-		calcCommonPreUserArgs(builder)
+		if err := calcCommonPreUserArgs(builder); err != nil {
+			return "", err
+		}
 	}
 	processGccFlags(builder)
-	if !builder.cfg.isHostWrapper {
-		allowCCache := true
-		if err := processGomaCCacheFlags(sysroot, allowCCache, builder); err != nil {
-			return nil, err
-		}
+	processLinkFlags(builder)
+	return sysroot, nil
+}
+
+func processGccGomaCCacheFlags(sysroot string, builder *commandBuilder) error {
+	if builder.cfg.isHostWrapper {
+		return nil
 	}
-	return builder.build(), nil
+	allowCCache := true
+	return processGomaCCacheFlags(sysroot, allowCCache, builder)
 }
 
-func calcCommonPreUserArgs(builder *commandBuilder) {
+func calcCommonPreUserArgs(builder *commandBuilder) error {
 	builder.addPreUserArgs(builder.cfg.commonFlags...)
 	if !builder.cfg.isHostWrapper {
 		processPieFlags(builder)
@@ -195,7 +326,11 @@ func calcCommonPreUserArgs(builder *commandBuilder) {
 		processStackProtectorFlags(builder)
 		processX86Flags(builder)
 	}
-	processSanitizerFlags(builder)
+	if err := processHardeningFlags(builder); err != nil {
+		return err
+	}
+	processCoverageFlags(builder)
+	return processSanitizerFlags(builder)
 }
 
 func processGomaCCacheFlags(sysroot string, allowCCache bool, builder *commandBuilder) (err error) {
@@ -207,40 +342,38 @@ func processGomaCCacheFlags(sysroot string, allowCCache bool, builder *commandBu
 		}
 	}
 	if !gomaccUsed && allowCCache {
-		processCCacheFlag(sysroot, builder)
+		return processCCacheFlag(sysroot, builder)
 	}
 	return nil
 }
 
 func getAbsWrapperPath(env env, wrapperCmd *command) (string, error) {
 	wrapperPath := getAbsCmdPath(env, wrapperCmd)
-	evaledCmdPath, err := filepath.EvalSymlinks(wrapperPath)
+	evaledCmdPath, err := env.fs().evalSymlinks(wrapperPath)
 	if err != nil {
 		return "", wrapErrorwithSourceLocf(err, "failed to evaluate symlinks for %s", wrapperPath)
 	}
 	return evaledCmdPath, nil
 }
 
-func printCompilerError(writer io.Writer, compilerErr error) {
-	if _, ok := compilerErr.(userError); ok {
-		fmt.Fprintf(writer, "%s\n", compilerErr)
-	} else {
-		fmt.Fprintf(writer,
-			"Internal error. Please report to chromeos-toolchain@google.com.\n%s\n",
-			compilerErr)
+// Returns the path of the compiler that the android wrapper calls, which
+// is installed next to the wrapper with a ".real" suffix.
+func getAndroidRealCompilerPath(builder *commandBuilder) string {
+	if builder.cfg.disableOldWrapperCompat {
+		return builder.absWrapperPath + ".real"
 	}
+	// Note: This combination of using the directory of the symlink but the
+	// basename of the link target is strange but is the logic that old android
+	// wrapper uses.
+	return filepath.Join(filepath.Dir(builder.path), filepath.Base(builder.absWrapperPath)+".real")
 }
 
 func teeStdinIfNeeded(env env, inputCmd *command, dest io.Writer) io.Reader {
 	// We can't use io.TeeReader unconditionally, as that would block
 	// calls to exec.Cmd.Run(), even if the underlying process has already
 	// terminated. See https://github.com/golang/go/issues/7990 for more details.
-	lastArg := ""
-	for _, arg := range inputCmd.Args {
-		if arg == "-" && lastArg != "-o" {
-			return io.TeeReader(env.stdin(), dest)
-		}
-		lastArg = arg
+	if parseInvocation(inputCmd.Args).readsStdin {
+		return io.TeeReader(env.stdin(), dest)
 	}
 	return env.stdin()
 }
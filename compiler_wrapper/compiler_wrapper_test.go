@@ -5,7 +5,6 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -82,6 +81,8 @@ func TestForwardStdin(t *testing.T) {
 func TestLogMissingCCacheExecError(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
 		ctx.cfg.useCCache = true
+		// Note: Without strict launchers, the wrapper retries without ccache.
+		ctx.cfg.strictLaunchers = true
 
 		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 			return syscall.ENOENT
@@ -134,17 +135,21 @@ func TestErrorOnBisectAndForceDisableWError(t *testing.T) {
 }
 
 func TestPrintUserCompilerError(t *testing.T) {
-	buffer := bytes.Buffer{}
-	printCompilerError(&buffer, newUserErrorf("abcd"))
-	if buffer.String() != "abcd\n" {
-		t.Errorf("Unexpected string. Got: %s", buffer.String())
-	}
+	withTestContext(t, func(ctx *testContext) {
+		printCompilerError(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc), newUserErrorf("abcd"))
+		if ctx.stderrString() != "abcd\n" {
+			t.Errorf("Unexpected string. Got: %s", ctx.stderrString())
+		}
+	})
 }
 
 func TestPrintOtherCompilerError(t *testing.T) {
-	buffer := bytes.Buffer{}
-	printCompilerError(&buffer, errors.New("abcd"))
-	if buffer.String() != "Internal error. Please report to chromeos-toolchain@google.com.\nabcd\n" {
-		t.Errorf("Unexpected string. Got: %s", buffer.String())
-	}
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.errorReportDir = ""
+		ctx.cfg.errorContact = "chromeos-toolchain@google.com"
+		printCompilerError(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc), errors.New("abcd"))
+		if ctx.stderrString() != "Internal error. Please report to chromeos-toolchain@google.com.\nabcd\n" {
+			t.Errorf("Unexpected string. Got: %s", ctx.stderrString())
+		}
+	})
 }
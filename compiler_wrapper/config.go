@@ -14,6 +14,23 @@ type config struct {
 	isAndroidWrapper bool
 	// Whether to use ccache.
 	useCCache bool
+	// The launcher to use if useCCache is set. See ccache_flag.go.
+	cacheLauncher cacheLauncher
+	// Whether to fail the compile if a launcher like ccache or gomacc
+	// fails. By default, the compile is retried without the launcher, and
+	// the compiler runs as a subprocess of the wrapper.
+	// See launcher_fallback.go.
+	strictLaunchers bool
+	// Directory to log launcher failures to.
+	launcherLogDir string
+	// Whether to use llvm-next. Can be overridden at runtime,
+	// see llvm_next_flag.go.
+	useLlvmNext bool
+	// Whether to turn off the bug-for-bug compatibility with the old
+	// wrapper, e.g. dropping the ccache path during double builds.
+	// Configs can be migrated to the fixed behavior one by one,
+	// as one binary can contain several configs (see config_select.go).
+	disableOldWrapperCompat bool
 	// Flags to add to gcc and clang.
 	commonFlags []string
 	// Flags to add to gcc only.
@@ -25,9 +42,58 @@ type config struct {
 	clangPostFlags []string
 	// Toolchain root path relative to the wrapper binary.
 	rootRelPath string
+	// Package overrides file relative to the toolchain root.
+	// See package_overrides.go.
+	packageOverridesRelPath string
+	// Source rules file relative to the toolchain root.
+	// See source_rules.go.
+	sourceRulesRelPath string
+	// Directory with the warning baselines relative to the toolchain root.
+	// See warning_baseline.go.
+	warningBaselinesRelDir string
+	// Directory of the llvm-next clang relative to the toolchain root.
+	// Empty if llvm-next is installed in place of llvm.
+	llvmNextClangRelDir string
 	// Directory to store errors that were prevented with -Wno-error.
 	newWarningsDir string
-	// Version. Only used for printing via -print-cmd.
+	// Directory to store the warnings of packages with a warning baseline.
+	// See warning_baseline.go.
+	warningBaselineReportsDir string
+	// Directory with the AFDO metadata and profiles, relative to rootPath.
+	// See profile_flags.go.
+	profileRelDir string
+	// Directory to log profiles that could not be used to.
+	profileLogDir string
+	// Profiles that are older than this are not used. 0 disables the check.
+	// See profile_flags.go.
+	maxProfileAgeDays int
+	// Name of the hardening profile to use by default.
+	// See hardening_flags.go.
+	hardeningProfile string
+	// Directory with the orderfiles, relative to rootPath.
+	// See orderfile_flags.go.
+	orderfileDirRelPath string
+	// Flags for link steps. See link_flags.go.
+	linkPolicy linkPolicy
+	// Directory on the target to write coverage profiles to.
+	// See coverage_flag.go.
+	coverageProfileDir string
+	// Directory to store differences found by the shadow compiler.
+	shadowCompilerLogDir string
+	// Directory to write the flags that the compiler would silently
+	// ignore to. See flag_audit.go.
+	flagAuditLogDir string
+	// Directory to write reports about internal errors to.
+	// Empty to not write reports. See error_report.go.
+	errorReportDir string
+	// Directory to cache path lookups and compiler probes in.
+	// Empty to disable the cache. See probe_cache.go.
+	probeCacheDir string
+	// Where to report internal errors, e.g. an email address.
+	errorContact string
+	// Name of the config as passed to getConfig.
+	name string
+	// Version. Only used for printing via -print-cmd and in error reports.
 	version string
 }
 
@@ -49,22 +115,47 @@ var UseLlvmNext = "unknown"
 // Value has to be one of:
 // - "cros.hardened"
 // - "cros.nonhardened"
+// - "cros.host"
+// - "android"
+// The config can also be selected at runtime, see config_select.go.
 var ConfigName = "unknown"
 
 // Returns the configuration matching the UseCCache and ConfigName.
 func getRealConfig() (*config, error) {
-	useCCache, err := strconv.ParseBool(UseCCache)
-	if err != nil {
-		return nil, wrapErrorwithSourceLocf(err, "invalid format for UseCCache")
-	}
+	return getRealConfigForSpec("")
+}
+
+// Returns the configuration for a config spec, see config_select.go.
+// UseCCache and ConfigName are used as defaults for the parts that
+// are not given in the spec.
+func getRealConfigForSpec(spec string) (*config, error) {
 	useLlvmNext, err := strconv.ParseBool(UseLlvmNext)
 	if err != nil {
 		return nil, wrapErrorwithSourceLocf(err, "invalid format for UseLLvmNext")
 	}
-	config, err := getConfig(ConfigName, useCCache, useLlvmNext, Version)
+	return getConfigForSpec(spec, ConfigName, UseCCache, useLlvmNext, Version)
+}
+
+// Returns the configuration for a config spec. defaultConfigName and
+// defaultUseCCache are used for the parts that are not given in the spec.
+func getConfigForSpec(spec string, defaultConfigName string, defaultUseCCache string, useLlvmNext bool, version string) (*config, error) {
+	configName := defaultConfigName
+	useCCacheValue := defaultUseCCache
+	launcherKind := ""
+	if spec != "" {
+		configName, useCCacheValue, launcherKind = parseConfigSpec(spec, defaultUseCCache)
+	}
+	useCCache, err := strconv.ParseBool(useCCacheValue)
+	if err != nil {
+		return nil, wrapErrorwithSourceLocf(err, "invalid format for UseCCache")
+	}
+	config, err := getConfig(configName, useCCache, useLlvmNext, version)
 	if err != nil {
 		return nil, err
 	}
+	if launcherKind != "" {
+		config.cacheLauncher.kind = launcherKind
+	}
 	return config, nil
 }
 
@@ -83,22 +174,31 @@ func getConfig(configName string, useCCache bool, useLlvmNext bool, version stri
 		return nil, newErrorwithSourceLocf("unknown config name: %s", configName)
 	}
 	cfg.useCCache = useCCache
-	if useLlvmNext {
-		cfg.clangFlags = append(cfg.clangFlags, llvmNextFlags...)
-	}
+	cfg.useLlvmNext = useLlvmNext
+	cfg.name = configName
 	cfg.version = version
 	return &cfg, nil
 }
 
-// TODO: Enable test in config_test.go, once we have new llvm-next flags.
+// Flags to add to clang only when using llvm-next.
 var llvmNextFlags = []string{}
 
+// Flags to add to clang only when using llvm-next, AFTER user flags.
 var llvmNextPostFlags = []string{}
 
 // Full hardening.
 // Temporarily disable function splitting because of chromium:434751.
 var crosHardenedConfig = &config{
-	rootRelPath: "../../../../..",
+	rootRelPath:             "../../../../..",
+	disableOldWrapperCompat: false,
+	packageOverridesRelPath: "etc/compiler_wrapper/package_overrides.json",
+	sourceRulesRelPath:      "etc/compiler_wrapper/source_rules.json",
+	warningBaselinesRelDir:  "etc/compiler_wrapper/warning_baselines",
+	llvmNextClangRelDir:     "usr/llvm-next/bin",
+	profileRelDir:           "etc/compiler_wrapper/afdo",
+	maxProfileAgeDays:       90,
+	orderfileDirRelPath:     "etc/compiler_wrapper/orderfiles",
+	coverageProfileDir:      "/tmp/coverage",
 	commonFlags: []string{
 		"-fstack-protector-strong",
 		"-fPIE",
@@ -133,13 +233,30 @@ var crosHardenedConfig = &config{
 	clangPostFlags: []string{
 		"-Wno-implicit-int-float-conversion",
 	},
-	newWarningsDir: "/tmp/fatal_clang_warnings",
+	newWarningsDir:            "/tmp/fatal_clang_warnings",
+	warningBaselineReportsDir: "/tmp/compiler_wrapper_baseline_reports",
+	shadowCompilerLogDir:      "/tmp/shadow_compiler_logs",
+	errorReportDir:            "/tmp/compiler_wrapper_error_reports",
+	probeCacheDir:             "/tmp/compiler_wrapper_probe_cache",
+	launcherLogDir:            "/tmp/compiler_wrapper_launcher_fallbacks",
+	flagAuditLogDir:           "/tmp/compiler_wrapper_flag_audit",
+	profileLogDir:             "/tmp/compiler_wrapper_profile_logs",
+	errorContact:              "chromeos-toolchain@google.com",
 }
 
 // Flags to be added to non-hardened toolchain.
 var crosNonHardenedConfig = &config{
-	rootRelPath: "../../../../..",
-	commonFlags: []string{},
+	rootRelPath:             "../../../../..",
+	disableOldWrapperCompat: false,
+	packageOverridesRelPath: "etc/compiler_wrapper/package_overrides.json",
+	sourceRulesRelPath:      "etc/compiler_wrapper/source_rules.json",
+	warningBaselinesRelDir:  "etc/compiler_wrapper/warning_baselines",
+	llvmNextClangRelDir:     "usr/llvm-next/bin",
+	profileRelDir:           "etc/compiler_wrapper/afdo",
+	maxProfileAgeDays:       90,
+	orderfileDirRelPath:     "etc/compiler_wrapper/orderfiles",
+	coverageProfileDir:      "/tmp/coverage",
+	commonFlags:             []string{},
 	gccFlags: []string{
 		"-Wno-maybe-uninitialized",
 		"-Wno-unused-local-typedefs",
@@ -164,14 +281,31 @@ var crosNonHardenedConfig = &config{
 	clangPostFlags: []string{
 		"-Wno-implicit-int-float-conversion",
 	},
-	newWarningsDir: "/tmp/fatal_clang_warnings",
+	newWarningsDir:            "/tmp/fatal_clang_warnings",
+	warningBaselineReportsDir: "/tmp/compiler_wrapper_baseline_reports",
+	shadowCompilerLogDir:      "/tmp/shadow_compiler_logs",
+	errorReportDir:            "/tmp/compiler_wrapper_error_reports",
+	probeCacheDir:             "/tmp/compiler_wrapper_probe_cache",
+	launcherLogDir:            "/tmp/compiler_wrapper_launcher_fallbacks",
+	flagAuditLogDir:           "/tmp/compiler_wrapper_flag_audit",
+	profileLogDir:             "/tmp/compiler_wrapper_profile_logs",
+	errorContact:              "chromeos-toolchain@google.com",
 }
 
 // Flags to be added to host toolchain.
 var crosHostConfig = &config{
-	isHostWrapper: true,
-	rootRelPath:   "../..",
-	commonFlags:   []string{},
+	isHostWrapper:           true,
+	rootRelPath:             "../..",
+	disableOldWrapperCompat: false,
+	packageOverridesRelPath: "etc/compiler_wrapper/package_overrides.json",
+	sourceRulesRelPath:      "etc/compiler_wrapper/source_rules.json",
+	warningBaselinesRelDir:  "etc/compiler_wrapper/warning_baselines",
+	llvmNextClangRelDir:     "usr/llvm-next/bin",
+	profileRelDir:           "etc/compiler_wrapper/afdo",
+	maxProfileAgeDays:       90,
+	orderfileDirRelPath:     "etc/compiler_wrapper/orderfiles",
+	coverageProfileDir:      "/tmp/coverage",
+	commonFlags:             []string{},
 	gccFlags: []string{
 		"-Wno-maybe-uninitialized",
 		"-Wno-unused-local-typedefs",
@@ -197,16 +331,30 @@ var crosHostConfig = &config{
 	clangPostFlags: []string{
 		"-Wno-implicit-int-float-conversion",
 	},
-	newWarningsDir: "/tmp/fatal_clang_warnings",
+	newWarningsDir:            "/tmp/fatal_clang_warnings",
+	warningBaselineReportsDir: "/tmp/compiler_wrapper_baseline_reports",
+	shadowCompilerLogDir:      "/tmp/shadow_compiler_logs",
+	errorReportDir:            "/tmp/compiler_wrapper_error_reports",
+	probeCacheDir:             "/tmp/compiler_wrapper_probe_cache",
+	launcherLogDir:            "/tmp/compiler_wrapper_launcher_fallbacks",
+	flagAuditLogDir:           "/tmp/compiler_wrapper_flag_audit",
+	profileLogDir:             "/tmp/compiler_wrapper_profile_logs",
+	errorContact:              "chromeos-toolchain@google.com",
 }
 
 var androidConfig = &config{
-	isHostWrapper:    false,
-	isAndroidWrapper: true,
-	rootRelPath:      "./",
-	commonFlags:      []string{},
-	gccFlags:         []string{},
-	clangFlags:       []string{},
-	clangPostFlags:   []string{},
-	newWarningsDir:   "/tmp/fatal_clang_warnings",
+	isHostWrapper:           false,
+	isAndroidWrapper:        true,
+	rootRelPath:             "./",
+	disableOldWrapperCompat: false,
+	commonFlags:             []string{},
+	gccFlags:                []string{},
+	clangFlags:              []string{},
+	clangPostFlags:          []string{},
+	newWarningsDir:          "/tmp/fatal_clang_warnings",
+	shadowCompilerLogDir:    "/tmp/shadow_compiler_logs",
+	errorReportDir:          "/tmp/compiler_wrapper_error_reports",
+	probeCacheDir:           "/tmp/compiler_wrapper_probe_cache",
+	launcherLogDir:          "/tmp/compiler_wrapper_launcher_fallbacks",
+	errorContact:            "the Android LLVM toolchain team",
 }
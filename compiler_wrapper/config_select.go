@@ -0,0 +1,115 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// All configs are compiled into every wrapper binary, so that a single
+// binary can be installed under different names. The config is selected
+// by a config spec, which is a config name optionally followed by
+// ".ccache", ".sccache" or ".noccache", e.g. "cros.hardened.ccache".
+// ".sccache" enables the cache launcher like ".ccache", but uses sccache
+// instead of ccache. The spec is taken from, in this order:
+// - the env variable COMPILER_WRAPPER_CONFIG,
+// - the invoked path and the targets of its symlinks, starting with the
+//   invoked path: a sidecar file next to it with the suffix
+//   ".wrapper_config" that contains the spec, or its basename
+//   if it is one of the well known wrapper names below.
+// The linker flags in config.go are used for everything the spec
+// doesn't select.
+
+const configSpecEnvVar = "COMPILER_WRAPPER_CONFIG"
+
+const configSpecSidecarSuffix = ".wrapper_config"
+
+// Maximum number of symlinks to follow when looking for a config spec.
+const maxConfigSymlinks = 20
+
+var configSpecsByWrapperName = map[string]string{
+	"sysroot_wrapper.hardened.ccache":   "cros.hardened.ccache",
+	"sysroot_wrapper.hardened.noccache": "cros.hardened.noccache",
+	"sysroot_wrapper.ccache":            "cros.nonhardened.ccache",
+	"sysroot_wrapper.noccache":          "cros.nonhardened.noccache",
+	"clang_host_wrapper":                "cros.host.noccache",
+	"host_wrapper":                      "cros.host.noccache",
+}
+
+// Returns the configuration for the invoked wrapper.
+func selectRealConfig(env env, wrapperCmd *command) (*config, error) {
+	spec, source, err := findConfigSpec(env, wrapperCmd)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := getRealConfigForSpec(spec)
+	if err != nil && spec != "" {
+		return nil, wrapErrorwithSourceLocf(err, "invalid config spec %q from %s", spec, source)
+	}
+	return cfg, err
+}
+
+// Returns the config spec and where it was found, or "" if
+// the linker flags should be used.
+func findConfigSpec(env env, wrapperCmd *command) (spec string, source string, err error) {
+	if spec, ok := env.getenv(configSpecEnvVar); ok && spec != "" {
+		return spec, configSpecEnvVar, nil
+	}
+	wrapperPath := wrapperCmd.Path
+	if !strings.ContainsRune(wrapperPath, filepath.Separator) {
+		resolvedPath, err := resolveAgainstPathEnv(env, wrapperPath)
+		if err != nil {
+			// Note: callCompiler reports this error.
+			return "", "", nil
+		}
+		wrapperPath = resolvedPath
+	}
+	wrapperPath = getAbsCmdPath(env, &command{Path: wrapperPath})
+	for i := 0; i < maxConfigSymlinks; i++ {
+		sidecarPath := wrapperPath + configSpecSidecarSuffix
+		data, err := env.fs().readFile(sidecarPath)
+		if err == nil {
+			return strings.TrimSpace(string(data)), sidecarPath, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", wrapErrorwithSourceLocf(err, "failed to read config sidecar file %s", sidecarPath)
+		}
+		if spec, ok := configSpecsByWrapperName[filepath.Base(wrapperPath)]; ok {
+			return spec, wrapperPath, nil
+		}
+		info, err := env.fs().lstat(wrapperPath)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		target, err := env.fs().readlink(wrapperPath)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(wrapperPath), target)
+		}
+		wrapperPath = target
+	}
+	return "", "", nil
+}
+
+// Splits a config spec into the config name, the value for UseCCache and
+// the kind of the cache launcher. Returns defaultUseCCache if the spec
+// doesn't contain it, and an empty launcher kind to keep the one of the
+// config.
+func parseConfigSpec(spec string, defaultUseCCache string) (configName string, useCCache string, launcherKind string) {
+	switch {
+	case strings.HasSuffix(spec, ".noccache"):
+		return strings.TrimSuffix(spec, ".noccache"), "false", ""
+	case strings.HasSuffix(spec, ".sccache"):
+		return strings.TrimSuffix(spec, ".sccache"), "true", "sccache"
+	case strings.HasSuffix(spec, ".ccache"):
+		return strings.TrimSuffix(spec, ".ccache"), "true", ""
+	default:
+		return spec, defaultUseCCache, ""
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFindConfigSpecFromWrapperName(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		binaryPath := filepath.Join(ctx.tempDir, "compiler_wrapper")
+		ctx.writeFile(binaryPath, "")
+		wrapperPath := filepath.Join(ctx.tempDir, "sysroot_wrapper.hardened.ccache")
+		ctx.symlink("compiler_wrapper", wrapperPath)
+		linkPath := filepath.Join(ctx.tempDir, "bin", "x86_64-cros-linux-gnu-clang")
+		ctx.symlink(wrapperPath, linkPath)
+
+		spec, source := mustFindConfigSpec(ctx, linkPath)
+		if spec != "cros.hardened.ccache" || source != wrapperPath {
+			t.Errorf("unexpected spec. Got: %q from %s", spec, source)
+		}
+	})
+}
+
+func TestFindConfigSpecFromSidecarFile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		binaryPath := filepath.Join(ctx.tempDir, "compiler_wrapper")
+		ctx.writeFile(binaryPath, "")
+		ctx.writeFile(binaryPath+".wrapper_config", "android\n")
+		linkPath := filepath.Join(ctx.tempDir, "clang")
+		ctx.symlink(binaryPath, linkPath)
+
+		spec, source := mustFindConfigSpec(ctx, linkPath)
+		if spec != "android" || source != binaryPath+".wrapper_config" {
+			t.Errorf("unexpected spec. Got: %q from %s", spec, source)
+		}
+	})
+}
+
+func TestFindConfigSpecPrefersClosestMatch(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		wrapperPath := filepath.Join(ctx.tempDir, "sysroot_wrapper.hardened.ccache")
+		ctx.writeFile(wrapperPath, "")
+		linkPath := filepath.Join(ctx.tempDir, "x86_64-cros-linux-gnu-clang")
+		ctx.symlink(wrapperPath, linkPath)
+		ctx.writeFile(linkPath+".wrapper_config", "cros.nonhardened")
+
+		if spec, _ := mustFindConfigSpec(ctx, linkPath); spec != "cros.nonhardened" {
+			t.Errorf("unexpected spec. Got: %q", spec)
+		}
+		if spec, _ := mustFindConfigSpec(ctx, wrapperPath); spec != "cros.hardened.ccache" {
+			t.Errorf("unexpected spec for the wrapper. Got: %q", spec)
+		}
+	})
+}
+
+func TestFindConfigSpecPrefersEnvVar(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		wrapperPath := filepath.Join(ctx.tempDir, "clang_host_wrapper")
+		ctx.writeFile(wrapperPath, "")
+		ctx.env = []string{"COMPILER_WRAPPER_CONFIG=cros.hardened.noccache"}
+
+		spec, source := mustFindConfigSpec(ctx, wrapperPath)
+		if spec != "cros.hardened.noccache" || source != "COMPILER_WRAPPER_CONFIG" {
+			t.Errorf("unexpected spec. Got: %q from %s", spec, source)
+		}
+	})
+}
+
+func TestFindConfigSpecResolvesAgainstPath(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		wrapperPath := filepath.Join(ctx.tempDir, "bin", "clang_host_wrapper")
+		ctx.writeFile(wrapperPath, "")
+		ctx.env = []string{"PATH=" + filepath.Dir(wrapperPath)}
+
+		if spec, _ := mustFindConfigSpec(ctx, "clang_host_wrapper"); spec != "cros.host.noccache" {
+			t.Errorf("unexpected spec. Got: %q", spec)
+		}
+	})
+}
+
+func TestFindNoConfigSpecForUnknownWrapper(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		wrapperPath := filepath.Join(ctx.tempDir, "x86_64-cros-linux-gnu-clang")
+		ctx.writeFile(wrapperPath, "")
+
+		if spec, source := mustFindConfigSpec(ctx, wrapperPath); spec != "" || source != "" {
+			t.Errorf("unexpected spec. Got: %q from %s", spec, source)
+		}
+	})
+}
+
+func TestRealConfigForSpec(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	ConfigName = "cros.hardened"
+	UseCCache = "false"
+	UseLlvmNext = "false"
+
+	cfg, err := getRealConfigForSpec("cros.host.ccache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.isHostWrapper || !cfg.useCCache || cfg.name != "cros.host" {
+		t.Errorf("Expected host config with ccache. Got: %#v", cfg)
+	}
+
+	cfg, err = getRealConfigForSpec("cros.hardened.sccache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSysrootHardened(cfg) || !cfg.useCCache || cfg.cacheLauncher.kind != "sccache" {
+		t.Errorf("Expected hardened config with sccache. Got: %#v", cfg)
+	}
+
+	cfg, err = getRealConfigForSpec("android")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.isAndroidWrapper || cfg.useCCache {
+		t.Errorf("Expected android config with the default for UseCCache. Got: %#v", cfg)
+	}
+
+	cfg, err = getRealConfigForSpec("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSysrootHardened(cfg) || cfg.useCCache {
+		t.Errorf("Expected config from the linker flags. Got: %#v", cfg)
+	}
+
+	if _, err := getRealConfigForSpec("invalid.ccache"); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+}
+
+func TestOldWrapperCompatIsPerConfig(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	ConfigName = "cros.hardened"
+	UseCCache = "false"
+	UseLlvmNext = "false"
+	oldHostCompat := crosHostConfig.disableOldWrapperCompat
+	defer func() { crosHostConfig.disableOldWrapperCompat = oldHostCompat }()
+	crosHostConfig.disableOldWrapperCompat = true
+
+	cfg, err := getRealConfigForSpec("cros.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.disableOldWrapperCompat {
+		t.Errorf("Expected the compat of the host config to be disabled")
+	}
+
+	cfg, err = getRealConfigForSpec("cros.hardened")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.disableOldWrapperCompat {
+		t.Errorf("Expected the compat of the hardened config to be enabled")
+	}
+}
+
+func mustFindConfigSpec(ctx *testContext, wrapperPath string) (spec string, source string) {
+	spec, source, err := findConfigSpec(ctx, &command{Path: wrapperPath})
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	return spec, source
+}
@@ -38,7 +38,6 @@ func TestRealConfigWithUseCCacheFlag(t *testing.T) {
 	}
 }
 
-/* TODO: Re-enable this, when llvm-next is different than llvm
 func TestRealConfigWithUseLLvmFlag(t *testing.T) {
 	resetGlobals()
 	defer resetGlobals()
@@ -50,7 +49,7 @@ func TestRealConfigWithUseLLvmFlag(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if isUsingLLvmNext(cfg) {
+	if cfg.useLlvmNext {
 		t.Fatal("UseLLvmNext: Expected not to be used")
 	}
 
@@ -60,7 +59,7 @@ func TestRealConfigWithUseLLvmFlag(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !isUsingLLvmNext(cfg) {
+	if !cfg.useLlvmNext {
 		t.Fatal("UseLLvmNext: Expected to be used")
 	}
 
@@ -69,7 +68,6 @@ func TestRealConfigWithUseLLvmFlag(t *testing.T) {
 		t.Fatalf("UseLlvmNext: Expected an error, got none")
 	}
 }
-*/
 
 func TestRealConfigWithConfigNameFlag(t *testing.T) {
 	resetGlobals()
@@ -128,16 +126,6 @@ func isSysrootHardened(cfg *config) bool {
 	return false
 }
 
-// TODO: Update this with correct flag when we change llvm-next.
-func isUsingLLvmNext(cfg *config) bool {
-	for _, arg := range cfg.clangFlags {
-		if arg == "-Wno-reorder-init-list" {
-			return true
-		}
-	}
-	return false
-}
-
 func resetGlobals() {
 	// Set all global variables to a defined state.
 	UseLlvmNext = "unknown"
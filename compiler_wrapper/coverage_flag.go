@@ -0,0 +1,107 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const withCoverageKey = "WITH_COVERAGE"
+const coverageProfileDirKey = "COVERAGE_PROFILE_DIR"
+const coverageExcludeDirsKey = "COVERAGE_EXCLUDE_DIRS"
+
+func shouldBuildWithCoverage(env env) bool {
+	value, _ := env.getenv(withCoverageKey)
+	return value != ""
+}
+
+// Adds the flags for source based coverage (clang) or gcov (gcc) to all
+// compile and link invocations if WITH_COVERAGE is set.
+//
+// The profiles of the instrumented binaries are written to
+// <profile dir>/<package>/ so that the profiles of different packages
+// don't get mixed up. For clang, this is done by baking the pattern
+// into the binary via -fprofile-instr-generate=, which sets the default
+// for LLVM_PROFILE_FILE.
+func processCoverageFlags(builder *commandBuilder) {
+	if !shouldBuildWithCoverage(builder.env) {
+		return
+	}
+	for _, arg := range builder.args {
+		if arg.fromUser && isCoverageOptOutFlag(arg.value) {
+			return
+		}
+	}
+	if isExcludedFromCoverage(builder) {
+		return
+	}
+
+	profileDir, _ := builder.env.getenv(coverageProfileDirKey)
+	if profileDir == "" {
+		profileDir = builder.cfg.coverageProfileDir
+	}
+	packageDir := getCoveragePackageDir(getPackageIdentity(builder.env))
+
+	switch builder.target.compilerType {
+	case clangType:
+		profileFlag := "-fprofile-instr-generate"
+		if profileDir != "" {
+			// %m: unique id of the binary, %p: pid.
+			profileFlag += "=" + filepath.Join(profileDir, packageDir, "%m-%p.profraw")
+		}
+		builder.addPostUserArgs(profileFlag, "-fcoverage-mapping")
+	case gccType:
+		builder.addPostUserArgs("--coverage")
+		if profileDir != "" {
+			builder.addPostUserArgs("-fprofile-dir=" + filepath.Join(profileDir, packageDir))
+		}
+	}
+}
+
+// Returns true for flags that show that the invocation already takes care
+// of coverage or must not be instrumented.
+func isCoverageOptOutFlag(arg string) bool {
+	switch arg {
+	case "-fprofile-instr-generate", "-fcoverage-mapping", "--coverage",
+		"-fno-profile-instr-generate", "-fno-coverage-mapping", "-D__KERNEL__":
+		return true
+	}
+	return strings.HasPrefix(arg, "-fprofile-instr-generate=")
+}
+
+// Returns true if the cwd or one of the source files is within one of the
+// directories given in COVERAGE_EXCLUDE_DIRS. The directories are separated
+// by spaces and may contain globs, see matchPathGlob.
+func isExcludedFromCoverage(builder *commandBuilder) bool {
+	excludeDirs, _ := builder.env.getenv(coverageExcludeDirsKey)
+	if excludeDirs == "" {
+		return false
+	}
+	sources, _ := getSourcesAndOutput(builder)
+	paths := append([]string{builder.env.getwd()}, sources...)
+	for _, dir := range strings.Fields(excludeDirs) {
+		pattern := strings.TrimRight(dir, "/") + "/**"
+		for _, p := range paths {
+			if p == filepath.Clean(dir) || matchPathGlob(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getCoveragePackageDir(pkg packageIdentity) string {
+	switch {
+	case pkg.name != "" && pkg.category != "":
+		return filepath.Join(pkg.category, pkg.name)
+	case pkg.name != "":
+		return pkg.name
+	case pkg.androidModule != "":
+		return pkg.androidModule
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestOmitCoverageFlagsByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-instr-generate.*|-fcoverage-mapping"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddClangCoverageFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.coverageProfileDir = "/tmp/coverage"
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1", "CATEGORY=dev-libs", "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, mainCc,
+			"-fprofile-instr-generate=/tmp/coverage/dev-libs/foo/%m-%p.profraw", "-fcoverage-mapping"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddClangCoverageFlagsWithoutProfileDir(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.coverageProfileDir = ""
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fprofile-instr-generate"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddGccCoverageFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1", "COVERAGE_PROFILE_DIR=/cov", "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, mainCc, "--coverage", "-fprofile-dir=/cov/foo"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKeepUserCoverageFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fno-profile-instr-generate", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-instr-generate.*|-fcoverage-mapping"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestExcludeDirsFromCoverage(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1", "COVERAGE_EXCLUDE_DIRS=/other "+ctx.tempDir+"/third_party")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "third_party/lib/main.cc")))
+		if err := verifyArgCount(cmd, 0, "-fcoverage-mapping"); err != nil {
+			t.Error(err)
+		}
+
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fcoverage-mapping"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestCoverageFlagsWithSanitizer(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "WITH_COVERAGE=1")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=address", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fno-experimental-new-pass-manager"); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -15,6 +15,8 @@ import (
 const crosHardenedGoldenDir = "testdata/cros_hardened_golden"
 const crosHardenedNoCCacheGoldenDir = "testdata/cros_hardened_noccache_golden"
 const crosHardenedLlvmNextGoldenDir = "testdata/cros_hardened_llvmnext_golden"
+const crosHardenedNoCompatGoldenDir = "testdata/cros_hardened_nocompat_golden"
+const crosHardenedSCCacheGoldenDir = "testdata/cros_hardened_sccache_golden"
 
 func TestCrosHardenedConfig(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
@@ -51,6 +53,45 @@ func TestCrosHardenedConfigWithoutCCache(t *testing.T) {
 			createBisectGoldenInputs(clangX86_64),
 			createForceDisableWErrorGoldenInputs(),
 			createClangTidyGoldenInputs(gomaEnv),
+			createRustcGoldenInputs(ctx),
+		})
+	})
+}
+
+func TestCrosHardenedConfigWithSCCache(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		useLlvmNext := false
+		cfg, err := getConfigForSpec("cros.hardened.sccache", "unknown", "unknown", useLlvmNext, "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.updateConfig(cfg)
+
+		// Only run the subset of the sysroot wrapper tests that are
+		// affected by the cache launcher.
+		runGoldenRecords(ctx, crosHardenedSCCacheGoldenDir, []goldenFile{
+			createGccPathGoldenInputs(ctx, ""),
+			createRustcGoldenInputs(ctx),
+		})
+	})
+}
+
+func TestCrosHardenedConfigWithoutOldWrapperCompat(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		useLlvmNext := false
+		useCCache := true
+		cfg, err := getConfig("cros.hardened", useCCache, useLlvmNext, "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.disableOldWrapperCompat = true
+		ctx.updateConfig(cfg)
+
+		// Only run the subset of the sysroot wrapper tests that are
+		// affected by the old wrapper quirks.
+		runGoldenRecords(ctx, crosHardenedNoCompatGoldenDir, []goldenFile{
+			createForceDisableWErrorGoldenInputs(),
+			createSanitizerGoldenInputs("gcc"),
 		})
 	})
 }
@@ -76,6 +117,7 @@ func TestCrosHardenedConfigWithLlvmNext(t *testing.T) {
 			createBisectGoldenInputs(clangX86_64),
 			createForceDisableWErrorGoldenInputs(),
 			createClangTidyGoldenInputs(gomaEnv),
+			createLlvmNextSelectionGoldenInputs(),
 		})
 	})
 }
@@ -101,6 +143,8 @@ func createSyswrapperGoldenInputs(ctx *testContext) []goldenFile {
 		createBisectGoldenInputs(clangX86_64),
 		createForceDisableWErrorGoldenInputs(),
 		createClangTidyGoldenInputs(gomaEnv),
+		createLlvmNextSelectionGoldenInputs(),
+		createRustcGoldenInputs(ctx),
 	}
 }
 
@@ -259,6 +303,8 @@ func createClangPathGoldenInputs(ctx *testContext, gomaEnv string) goldenFile {
 	deepPath := "./a/b/c/d/e/f/g/x86_64-cros-linux-gnu-clang"
 	linkedDeepPath := "./symlinked/x86_64-cros-linux-gnu-clang"
 	ctx.writeFile(filepath.Join(ctx.tempDir, "/pathenv/x86_64-cros-linux-gnu-clang"), "")
+	// The linker for -fuse-ld=lld, see checkLinkerFlags.
+	ctx.writeFile(filepath.Join(ctx.tempDir, "/pathenv/ld.lld"), "")
 	ctx.symlink(deepPath, linkedDeepPath)
 	return goldenFile{
 		Name: "clang_path.json",
@@ -375,6 +421,33 @@ func createClangTidyGoldenInputs(gomaEnv string) goldenFile {
 	}
 }
 
+func createLlvmNextSelectionGoldenInputs() goldenFile {
+	return goldenFile{
+		Name: "llvm_next_selection.json",
+		Records: []goldenRecord{
+			{
+				WrapperCmd: newGoldenCmd(clangX86_64, mainCc),
+				Env:        []string{"USE_LLVM_NEXT=true"},
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(clangX86_64, mainCc),
+				Env:        []string{"USE_LLVM_NEXT=false"},
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(clangX86_64, mainCc),
+				Env: []string{
+					"LLVM_NEXT_PACKAGES=chromeos-base/foo",
+					"CATEGORY=chromeos-base",
+					"PN=foo",
+				},
+				Cmds: okResults,
+			},
+		},
+	}
+}
+
 func createClangSyntaxGoldenInputs(gomaEnv string) goldenFile {
 	return goldenFile{
 		Name: "gcc_clang_syntax.json",
@@ -549,3 +622,69 @@ func createClangArgsGoldenInputs() goldenFile {
 		},
 	}
 }
+
+func createRustcGoldenInputs(ctx *testContext) goldenFile {
+	ctx.writeFile(filepath.Join(ctx.tempDir, "/rustcpathenv/x86_64-cros-linux-gnu-clang"), "")
+	return goldenFile{
+		Name: "rustc.json",
+		Records: []goldenRecord{
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Cmds:       errorResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd("./armv7a-cros-linux-gnueabihf-rustc", mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd("./aarch64-cros-linux-gnu-rustc", mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd("./armv7m-cros-eabi-rustc", mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(filepath.Join(ctx.tempDir, "x86_64-cros-linux-gnu-rustc"), mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, "--target=sometarget", "-C", "linker=somelinker",
+					"-Clink-arg=--sysroot=/somesysroot", mainRs),
+				Cmds: okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Env:        []string{"SYSROOT=/somesysroot"},
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Env:        []string{"PATH=" + filepath.Join(ctx.tempDir, "/rustcpathenv")},
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, "-noccache", mainRs),
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Env:        []string{"FORCE_DISABLE_WERROR=1"},
+				Cmds:       okResults,
+			},
+			{
+				WrapperCmd: newGoldenCmd(rustcX86_64, mainRs),
+				Env: []string{
+					"BISECT_STAGE=someBisectStage",
+					"BISECT_DIR=someBisectDir",
+					"HOME=/user/home",
+				},
+				Cmds: okResults,
+			},
+		},
+	}
+}
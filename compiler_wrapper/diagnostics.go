@@ -0,0 +1,63 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A single diagnostic as printed by clang or gcc, e.g.
+// main.cc:3:10: warning: unused variable 'x' [-Wunused-variable]
+type diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Flag     string `json:"flag,omitempty"`
+}
+
+var diagnosticRegex = regexp.MustCompile(
+	`^(.+?):(\d+):(?:(\d+):)? (warning|error|fatal error): (.*?)(?: \[(-W[^\]]+)\])?$`)
+
+func parseDiagnostics(output string) []diagnostic {
+	diagnostics := []diagnostic{}
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticRegex.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		diagnostics = append(diagnostics, diagnostic{
+			File:     match[1],
+			Line:     lineNumber,
+			Column:   column,
+			Severity: match[4],
+			Message:  match[5],
+			Flag:     match[6],
+		})
+	}
+	return diagnostics
+}
+
+// Returns the diagnostics of a that are not contained in b.
+func diagnosticsDifference(a []diagnostic, b []diagnostic) []diagnostic {
+	bCounts := map[diagnostic]int{}
+	for _, d := range b {
+		bCounts[d]++
+	}
+	diff := []diagnostic{}
+	for _, d := range a {
+		if bCounts[d] > 0 {
+			bCounts[d]--
+			continue
+		}
+		diff = append(diff, d)
+	}
+	return diff
+}
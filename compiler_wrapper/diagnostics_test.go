@@ -0,0 +1,38 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	output := `In file included from main.cc:1:
+./foo.h:3:10: warning: unused variable 'x' [-Wunused-variable]
+    int x;
+        ^
+main.cc:12:1: error: expected ';' after top level declarator
+main.c:7: warning: gcc style without column [-Wformat=]
+1 warning and 1 error generated.
+`
+	expected := []diagnostic{
+		{File: "./foo.h", Line: 3, Column: 10, Severity: "warning", Message: "unused variable 'x'", Flag: "-Wunused-variable"},
+		{File: "main.cc", Line: 12, Column: 1, Severity: "error", Message: "expected ';' after top level declarator"},
+		{File: "main.c", Line: 7, Severity: "warning", Message: "gcc style without column", Flag: "-Wformat="},
+	}
+	if diags := parseDiagnostics(output); !reflect.DeepEqual(diags, expected) {
+		t.Errorf("unexpected diagnostics. Got: %#v", diags)
+	}
+}
+
+func TestDiagnosticsDifferenceRespectsDuplicates(t *testing.T) {
+	a := diagnostic{File: "a.c", Line: 1, Severity: "warning", Message: "a"}
+	b := diagnostic{File: "b.c", Line: 2, Severity: "warning", Message: "b"}
+	diff := diagnosticsDifference([]diagnostic{a, a, b}, []diagnostic{a})
+	if !reflect.DeepEqual(diff, []diagnostic{a, b}) {
+		t.Errorf("unexpected difference. Got: %#v", diff)
+	}
+}
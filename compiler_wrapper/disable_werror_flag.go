@@ -7,10 +7,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
-	"os"
 	"strings"
-	"syscall"
 )
 
 func shouldForceDisableWError(env env) bool {
@@ -19,11 +16,12 @@ func shouldForceDisableWError(env env) bool {
 }
 
 func doubleBuildWithWNoError(env env, cfg *config, originalCmd *command) (exitCode int, err error) {
+	originalCmd = forceColorDiagnostics(env, originalCmd)
 	originalStdoutBuffer := &bytes.Buffer{}
 	originalStderrBuffer := &bytes.Buffer{}
-	// TODO: This is a bug in the old wrapper that it drops the ccache path
-	// during double build. Fix this once we don't compare to the old wrapper anymore.
-	if originalCmd.Path == "/usr/bin/ccache" {
+	// Note: This is a bug in the old wrapper that it drops the ccache path
+	// during double build.
+	if !cfg.disableOldWrapperCompat && originalCmd.Path == "/usr/bin/ccache" {
 		originalCmd.Path = "ccache"
 	}
 	originalStdinBuffer := &bytes.Buffer{}
@@ -43,9 +41,10 @@ func doubleBuildWithWNoError(env env, cfg *config, originalCmd *command) (exitCo
 	retryStdoutBuffer := &bytes.Buffer{}
 	retryStderrBuffer := &bytes.Buffer{}
 	retryCommand := &command{
-		Path:       originalCmd.Path,
-		Args:       append(originalCmd.Args, "-Wno-error"),
-		EnvUpdates: originalCmd.EnvUpdates,
+		Path:         originalCmd.Path,
+		Args:         append(originalCmd.Args, "-Wno-error"),
+		EnvUpdates:   originalCmd.EnvUpdates,
+		launcherName: originalCmd.launcherName,
 	}
 	retryExitCode, err := wrapSubprocessErrorWithSourceLoc(retryCommand,
 		env.run(retryCommand, bytes.NewReader(originalStdinBuffer.Bytes()), retryStdoutBuffer, retryStderrBuffer))
@@ -66,15 +65,39 @@ func doubleBuildWithWNoError(env env, cfg *config, originalCmd *command) (exitCo
 	// All of the below is basically logging. If we fail at any point, it's
 	// reasonable for that to fail the build. This is all meant for FYI-like
 	// builders in the first place.
+	lines := []string{}
+	if originalStderrBuffer.Len() > 0 {
+		lines = append(lines, originalStderrBuffer.String())
+	}
+	if originalStdoutBuffer.Len() > 0 {
+		lines = append(lines, originalStdoutBuffer.String())
+	}
+	outputToLog := stripANSIEscapes(strings.Join(lines, "\n"))
+
+	jsonData := warningsJSONData{
+		Cwd:      env.getwd(),
+		Command:  append([]string{originalCmd.Path}, originalCmd.Args...),
+		Stdout:   outputToLog,
+		Package:  getPackageIdentity(env).String(),
+		Warnings: getBaselineWarnings(env, outputToLog),
+	}
+	if err := writeWarningsReport(env, cfg.newWarningsDir, "warnings_report*.json", &jsonData); err != nil {
+		return 0, err
+	}
+	return retryExitCode, nil
+}
 
+// Writes the report into warningsDir. The pattern is used for the
+// file name like in ioutil.TempFile.
+func writeWarningsReport(env env, warningsDir string, pattern string, jsonData *warningsJSONData) error {
 	// Buildbots use a nonzero umask, which isn't quite what we want: these directories should
 	// be world-readable and world-writable.
-	oldMask := syscall.Umask(0)
-	defer syscall.Umask(oldMask)
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
 
 	// Allow root and regular users to write to this without issue.
-	if err := os.MkdirAll(cfg.newWarningsDir, 0777); err != nil {
-		return 0, wrapErrorwithSourceLocf(err, "error creating warnings directory %s", cfg.newWarningsDir)
+	if err := env.fs().mkdirAll(warningsDir, 0777); err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating warnings directory %s", warningsDir)
 	}
 
 	// Have some tag to show that files aren't fully written. It would be sad if
@@ -85,44 +108,29 @@ func doubleBuildWithWNoError(env env, cfg *config, originalCmd *command) (exitCo
 	// Coming up with a consistent name for this is difficult (compiler command's
 	// SHA can clash in the case of identically named files in different
 	// directories, or similar); let's use a random one.
-	tmpFile, err := ioutil.TempFile(cfg.newWarningsDir, "warnings_report*.json"+incompleteSuffix)
+	tmpFile, err := env.fs().tempFile(warningsDir, pattern+incompleteSuffix)
 	if err != nil {
-		return 0, wrapErrorwithSourceLocf(err, "error creating warnings file")
+		return wrapErrorwithSourceLocf(err, "error creating warnings file")
 	}
 
 	if err := tmpFile.Chmod(0666); err != nil {
-		return 0, wrapErrorwithSourceLocf(err, "error chmoding the file to be world-readable/writeable")
+		return wrapErrorwithSourceLocf(err, "error chmoding the file to be world-readable/writeable")
 	}
 
-	lines := []string{}
-	if originalStderrBuffer.Len() > 0 {
-		lines = append(lines, originalStderrBuffer.String())
-	}
-	if originalStdoutBuffer.Len() > 0 {
-		lines = append(lines, originalStdoutBuffer.String())
-	}
-	outputToLog := strings.Join(lines, "\n")
-
-	jsonData := warningsJSONData{
-		Cwd:     env.getwd(),
-		Command: append([]string{originalCmd.Path}, originalCmd.Args...),
-		Stdout:  outputToLog,
-	}
 	enc := json.NewEncoder(tmpFile)
 	if err := enc.Encode(jsonData); err != nil {
 		_ = tmpFile.Close()
-		return 0, wrapErrorwithSourceLocf(err, "error writing warnings data")
+		return wrapErrorwithSourceLocf(err, "error writing warnings data")
 	}
 
 	if err := tmpFile.Close(); err != nil {
-		return 0, wrapErrorwithSourceLocf(err, "error closing warnings file")
+		return wrapErrorwithSourceLocf(err, "error closing warnings file")
 	}
 
-	if err := os.Rename(tmpFile.Name(), tmpFile.Name()[:len(tmpFile.Name())-len(incompleteSuffix)]); err != nil {
-		return 0, wrapErrorwithSourceLocf(err, "error removing incomplete suffix from warnings file")
+	if err := env.fs().rename(tmpFile.Name(), tmpFile.Name()[:len(tmpFile.Name())-len(incompleteSuffix)]); err != nil {
+		return wrapErrorwithSourceLocf(err, "error removing incomplete suffix from warnings file")
 	}
-
-	return retryExitCode, nil
+	return nil
 }
 
 // Struct used to write JSON. Fileds have to be uppercase for the json
@@ -131,4 +139,8 @@ type warningsJSONData struct {
 	Cwd     string   `json:"cwd"`
 	Command []string `json:"command"`
 	Stdout  string   `json:"stdout"`
+	// The package and its warnings, for regenerating warning
+	// baselines. See warning_baseline.go.
+	Package  string            `json:"package,omitempty"`
+	Warnings []baselineWarning `json:"warnings,omitempty"`
 }
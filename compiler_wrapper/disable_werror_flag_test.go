@@ -283,6 +283,40 @@ func TestLogWarningsWhenDoubleBuildFails(t *testing.T) {
 	})
 }
 
+func TestDoubleBuildFailsIfWarningsDirIsNotWritable(t *testing.T) {
+	withForceDisableWErrorTestContext(t, func(ctx *testContext) {
+		memfs := ctx.useMemFileSystem()
+		if err := memfs.mkdirAll(ctx.cfg.newWarningsDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		memfs.chmod(t, ctx.cfg.newWarningsDir, 0555)
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprint(stderr, "-Werror originalerror")
+				return newExitCodeError(1)
+			case 2:
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyInternalError(stderr); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stderr, "error creating warnings file") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+		for _, f := range memfs.files() {
+			if strings.HasPrefix(f, ctx.cfg.newWarningsDir) {
+				t.Errorf("unexpected warnings file %s", f)
+			}
+		}
+	})
+}
+
 func withForceDisableWErrorTestContext(t *testing.T, work func(ctx *testContext)) {
 	withTestContext(t, func(ctx *testContext) {
 		ctx.env = []string{"FORCE_DISABLE_WERROR=1"}
@@ -291,7 +325,12 @@ func withForceDisableWErrorTestContext(t *testing.T, work func(ctx *testContext)
 }
 
 func readLoggedWarnings(ctx *testContext) *warningsJSONData {
-	files, err := ioutil.ReadDir(ctx.cfg.newWarningsDir)
+	return readWarningsReport(ctx, ctx.cfg.newWarningsDir)
+}
+
+// Returns the only report in the dir, or nil if the dir doesn't exist.
+func readWarningsReport(ctx *testContext, warningsDir string) *warningsJSONData {
+	files, err := ioutil.ReadDir(warningsDir)
 	if err != nil {
 		if _, ok := err.(*os.PathError); ok {
 			return nil
@@ -301,7 +340,7 @@ func readLoggedWarnings(ctx *testContext) *warningsJSONData {
 	if len(files) != 1 {
 		ctx.t.Fatalf("expected 1 warning log file. Got: %s", files)
 	}
-	data, err := ioutil.ReadFile(filepath.Join(ctx.cfg.newWarningsDir, files[0].Name()))
+	data, err := ioutil.ReadFile(filepath.Join(warningsDir, files[0].Name()))
 	if err != nil {
 		ctx.t.Fatal(err)
 	}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "PASS"
+	doctorFail doctorStatus = "FAIL"
+	// Problems that only matter for some features, e.g. BISECT_STAGE.
+	doctorWarn doctorStatus = "WARN"
+	doctorSkip doctorStatus = "SKIP"
+)
+
+type doctorCheck struct {
+	name   string
+	status doctorStatus
+	detail string
+	fix    string
+}
+
+func processDoctorFlag(builder *commandBuilder) (runDoctor bool) {
+	builder.transformArgs(func(arg builderArg) string {
+		if arg.value == "-wrapper-doctor" {
+			runDoctor = true
+			return ""
+		}
+		return arg.value
+	})
+	return runDoctor
+}
+
+// Checks that the tools and directories the wrapper uses for the invoked
+// target exist, and prints a table with the results. Returns exit code 1
+// if one of the checks failed.
+func runDoctor(builder *commandBuilder) (exitCode int, err error) {
+	checks, err := calcDoctorChecks(builder)
+	if err != nil {
+		return 0, err
+	}
+	stdout := builder.env.stdout()
+	fmt.Fprintf(stdout, "wrapper doctor: %s\n", builder.absWrapperPath)
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, check := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.status, check.name, check.detail)
+		if check.fix != "" && (check.status == doctorFail || check.status == doctorWarn) {
+			fmt.Fprintf(w, "\t\tfix: %s\n", check.fix)
+		}
+		if check.status == doctorFail {
+			exitCode = 1
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, wrapErrorwithSourceLocf(err, "failed to print doctor results")
+	}
+	return exitCode, nil
+}
+
+func calcDoctorChecks(builder *commandBuilder) ([]*doctorCheck, error) {
+	env := builder.env
+	// The checks look at the installation as it is now,
+	// not at the results in the probe cache.
+	uncachedCfg := *builder.cfg
+	uncachedCfg.probeCacheDir = ""
+	cfg := &uncachedCfg
+	checks := []*doctorCheck{}
+	isClang := builder.target.compilerType == clangType
+	isRustc := builder.target.compilerType == rustcType
+
+	compilerBuilder := builder.clone()
+	switch {
+	case cfg.isAndroidWrapper:
+		compilerBuilder.path = getAndroidRealCompilerPath(builder)
+	case isClang:
+		if err := processClangFlags(compilerBuilder); err != nil {
+			return nil, err
+		}
+	case isRustc:
+		if err := processRustcFlags(compilerBuilder); err != nil {
+			return nil, err
+		}
+	default:
+		processGccFlags(compilerBuilder)
+	}
+	compilerPath := getAbsCmdPath(env, compilerBuilder.build())
+	checks = append(checks, checkExecutable(env, "real compiler", compilerPath,
+		"install the compiler for the target, e.g. via setup_board or by emerging the toolchain"))
+
+	if (isClang || isRustc) && !cfg.isHostWrapper && !cfg.isAndroidWrapper {
+		linkerCmd := builder.target.target + "-ld"
+		if isRustc {
+			// See processRustcFlags.
+			linkerCmd = builder.target.target + "-clang"
+		}
+		checks = append(checks, checkExecutable(env, "linker", findDoctorLinker(env, linkerCmd, builder.rootPath),
+			"install binutils for the target or add it to PATH"))
+	} else {
+		checks = append(checks, &doctorCheck{name: "linker", status: doctorSkip, detail: "found by the compiler"})
+	}
+
+	if !cfg.isHostWrapper && !cfg.isAndroidWrapper {
+		sysroot := processSysrootFlag(builder.clone())
+		checks = append(checks, checkDirectory(env, "sysroot", sysroot,
+			"run setup_board for the board or set SYSROOT"))
+	} else {
+		checks = append(checks, &doctorCheck{name: "sysroot", status: doctorSkip, detail: "not used"})
+	}
+
+	if cfg.useCCache && !cfg.isAndroidWrapper {
+		launcherKind := cfg.cacheLauncher.kind
+		if launcherKind == "" {
+			launcherKind = "ccache"
+		}
+		checks = append(checks, checkExecutable(env, "ccache", getCacheLauncherPath(cfg.cacheLauncher),
+			fmt.Sprintf("emerge dev-util/%s or build with -noccache", launcherKind)))
+	} else {
+		checks = append(checks, &doctorCheck{name: "ccache", status: doctorSkip, detail: "disabled in config"})
+	}
+
+	if gomaPath, _ := env.getenv("GOMACC_PATH"); gomaPath != "" {
+		checks = append(checks, checkExecutable(env, "gomacc", gomaPath,
+			"install goma or unset GOMACC_PATH"))
+	} else {
+		checks = append(checks, &doctorCheck{name: "gomacc", status: doctorSkip, detail: "GOMACC_PATH not set"})
+	}
+
+	if isClang {
+		checks = append(checks, checkClangResourceDir(env, cfg, compilerPath))
+	}
+
+	checks = append(checks, checkBisectDriver(env))
+	return checks, nil
+}
+
+// Returns the linker that clang finds for the target. Note: The -B dir that
+// getLinkerPath returns holds the unprefixed tools of binutils (e.g.
+// binutils-bin/<version>/ld), so we check the linker in PATH instead.
+func findDoctorLinker(env env, linkerCmd string, rootPath string) string {
+	linkerPath, err := resolveAgainstPathEnv(env, linkerCmd)
+	if err != nil {
+		// See getLinkerPath for the sdk outside of the chroot.
+		return filepath.Join(rootPath, "bin", linkerCmd)
+	}
+	if evaledPath, err := env.fs().evalSymlinks(linkerPath); err == nil {
+		return evaledPath
+	}
+	// A dangling symlink, which fails the check.
+	return linkerPath
+}
+
+func checkExecutable(env env, name string, p string, fix string) *doctorCheck {
+	check := &doctorCheck{name: name, detail: p, fix: fix}
+	info, err := env.fs().stat(p)
+	switch {
+	case os.IsNotExist(err):
+		check.status = doctorFail
+		check.detail += ": does not exist"
+	case err != nil:
+		check.status = doctorFail
+		check.detail += ": " + err.Error()
+	case info.IsDir() || info.Mode()&0111 == 0:
+		check.status = doctorFail
+		check.detail += ": not executable"
+	default:
+		check.status = doctorPass
+	}
+	return check
+}
+
+func checkDirectory(env env, name string, p string, fix string) *doctorCheck {
+	check := &doctorCheck{name: name, detail: p, fix: fix}
+	info, err := env.fs().stat(p)
+	switch {
+	case os.IsNotExist(err):
+		check.status = doctorFail
+		check.detail += ": does not exist"
+	case err != nil:
+		check.status = doctorFail
+		check.detail += ": " + err.Error()
+	case !info.IsDir():
+		check.status = doctorFail
+		check.detail += ": not a directory"
+	default:
+		check.status = doctorPass
+	}
+	return check
+}
+
+func checkClangResourceDir(env env, cfg *config, clangPath string) *doctorCheck {
+	fix := "reinstall the compiler, the resource dir contains the builtin headers"
+	resourceDir, err := getClangResourceDir(env, cfg, clangPath)
+	if err != nil {
+		return &doctorCheck{name: "clang resource dir", status: doctorFail, detail: err.Error(), fix: fix}
+	}
+	if resourceDir == "" {
+		return &doctorCheck{name: "clang resource dir", status: doctorFail,
+			detail: "clang --print-resource-dir printed nothing", fix: fix}
+	}
+	return checkDirectory(env, "clang resource dir", resourceDir, fix)
+}
+
+// The bisect driver is only needed for BISECT_STAGE, so problems with it
+// are reported as warnings.
+func checkBisectDriver(env env) *doctorCheck {
+	check := &doctorCheck{name: "bisect driver", status: doctorPass,
+		fix: "install bisect_driver.py next to the wrapper and python in PATH"}
+	wrapperPath, err := filepath.Abs(os.Args[0])
+	if err == nil {
+		wrapperPath, err = env.fs().evalSymlinks(wrapperPath)
+	}
+	if err != nil {
+		check.status = doctorWarn
+		check.detail = err.Error()
+		return check
+	}
+	check.detail = filepath.Join(filepath.Dir(wrapperPath), "bisect_driver.py")
+	if _, err := env.fs().stat(check.detail); err != nil {
+		check.status = doctorWarn
+		check.detail += ": does not exist"
+		return check
+	}
+	if _, err := resolveAgainstPathEnv(env, "python"); err != nil {
+		check.status = doctorWarn
+		check.detail = "python not found in PATH"
+	}
+	return check
+}
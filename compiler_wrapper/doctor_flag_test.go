@@ -0,0 +1,124 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestDoctorReportsMissingTools(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-wrapper-doctor"))
+		if exitCode != 1 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		for _, pattern := range []string{
+			`FAIL\s+real compiler\s+.*/usr/bin/clang: does not exist`,
+			`FAIL\s+sysroot\s+.*/usr/x86_64-cros-linux-gnu: does not exist`,
+			`fix: run setup_board`,
+			`SKIP\s+gomacc`,
+		} {
+			if !regexp.MustCompile(pattern).MatchString(ctx.stdoutString()) {
+				t.Errorf("expected %q in output. Got: %s", pattern, ctx.stdoutString())
+			}
+		}
+	})
+}
+
+func TestDoctorPassesForCompleteClangInstallation(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useCCache = false
+		resourceDir := filepath.Join(ctx.tempDir, "resource")
+		ctx.writeFile(filepath.Join(ctx.tempDir, "usr/bin/clang"), "")
+		ctx.writeFile(filepath.Join(ctx.tempDir, "bin/x86_64-cros-linux-gnu-ld"), "")
+		for _, dir := range []string{resourceDir, filepath.Join(ctx.tempDir, "usr/x86_64-cros-linux-gnu")} {
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stdout, resourceDir)
+			return nil
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-wrapper-doctor"))
+		if exitCode != 0 {
+			t.Errorf("unexpected exit code. Got: %d. Output: %s", exitCode, ctx.stdoutString())
+		}
+		for _, pattern := range []string{
+			`PASS\s+real compiler`,
+			`PASS\s+linker`,
+			`PASS\s+sysroot`,
+			`PASS\s+clang resource dir\s+` + regexp.QuoteMeta(resourceDir),
+		} {
+			if !regexp.MustCompile(pattern).MatchString(ctx.stdoutString()) {
+				t.Errorf("expected %q in output. Got: %s", pattern, ctx.stdoutString())
+			}
+		}
+		// Only the call for the resource dir, but no compile.
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestDoctorChecksLinkerSymlinkedIntoBinutils(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ldPath := filepath.Join(ctx.tempDir, "usr/x86_64-pc-linux-gnu/x86_64-cros-linux-gnu/binutils-bin/2.27.0/ld")
+		ctx.writeFile(ldPath, "")
+		if err := os.Chmod(ldPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		ctx.symlink(ldPath, "usr/bin/x86_64-cros-linux-gnu-ld")
+		ctx.env = []string{"PATH=" + filepath.Join(ctx.tempDir, "usr/bin")}
+		callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-wrapper-doctor"))
+		pattern := `PASS\s+linker\s+` + regexp.QuoteMeta(ldPath) + "\n"
+		if !regexp.MustCompile(pattern).MatchString(ctx.stdoutString()) {
+			t.Errorf("expected %q in output. Got: %s", pattern, ctx.stdoutString())
+		}
+	})
+}
+
+func TestDoctorFailsForDanglingLinkerSymlink(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.symlink("binutils-bin/2.27.0/ld", "usr/bin/x86_64-cros-linux-gnu-ld")
+		ctx.env = []string{"PATH=" + filepath.Join(ctx.tempDir, "usr/bin")}
+		callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-wrapper-doctor"))
+		pattern := `FAIL\s+linker\s+.*/usr/bin/x86_64-cros-linux-gnu-ld: does not exist`
+		if !regexp.MustCompile(pattern).MatchString(ctx.stdoutString()) {
+			t.Errorf("expected %q in output. Got: %s", pattern, ctx.stdoutString())
+		}
+	})
+}
+
+func TestDoctorChecksRealGcc(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeFile(filepath.Join(ctx.tempDir, "x86_64-cros-linux-gnu-gcc.real"), "")
+		callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, "-wrapper-doctor"))
+		if !regexp.MustCompile(`PASS\s+real compiler\s+.*x86_64-cros-linux-gnu-gcc.real`).MatchString(ctx.stdoutString()) {
+			t.Errorf("unexpected output: %s", ctx.stdoutString())
+		}
+	})
+}
+
+func TestDoctorChecksCCacheAndGomacc(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useCCache = true
+		ctx.env = append(ctx.env, "GOMACC_PATH="+filepath.Join(ctx.tempDir, "gomacc"))
+		callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, "-wrapper-doctor"))
+		for _, pattern := range []string{
+			`(PASS|FAIL)\s+ccache\s+/usr/bin/ccache`,
+			`FAIL\s+gomacc\s+.*/gomacc: does not exist`,
+		} {
+			if !regexp.MustCompile(pattern).MatchString(ctx.stdoutString()) {
+				t.Errorf("expected %q in output. Got: %s", pattern, ctx.stdoutString())
+			}
+		}
+	})
+}
@@ -10,6 +10,8 @@ import (
 	"io"
 	"os"
 	"strings"
+	"syscall"
+	"unsafe"
 )
 
 type env interface {
@@ -19,8 +21,10 @@ type env interface {
 	stdin() io.Reader
 	stdout() io.Writer
 	stderr() io.Writer
+	stderrIsTerminal() bool
 	run(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
 	exec(cmd *command) error
+	fs() fileSystem
 }
 
 type processEnv struct {
@@ -37,11 +41,13 @@ func newProcessEnv() (env, error) {
 	//   this calculation invalid.
 	// - the old python wrapper doesn't respect the PWD env variable either, so if we
 	//   did we would fail the comparison to the old wrapper.
-	wd, err := os.Readlink("/proc/self/cwd")
+	env := &processEnv{}
+	wd, err := env.fs().readlink("/proc/self/cwd")
 	if err != nil {
 		return nil, wrapErrorwithSourceLocf(err, "failed to read working directory")
 	}
-	return &processEnv{wd: wd}, nil
+	env.wd = wd
+	return env, nil
 }
 
 var _ env = (*processEnv)(nil)
@@ -70,6 +76,16 @@ func (env *processEnv) stderr() io.Writer {
 	return os.Stderr
 }
 
+func (env *processEnv) stderrIsTerminal() bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stderr.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+func (env *processEnv) fs() fileSystem {
+	return osFileSystem{}
+}
+
 func (env *processEnv) exec(cmd *command) error {
 	return execCmd(env, cmd)
 }
@@ -103,6 +119,7 @@ func (env *commandRecordingEnv) exec(cmd *command) error {
 }
 
 func (env *commandRecordingEnv) run(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	cmd = forceColorDiagnostics(env, cmd)
 	stdoutBuffer := &bytes.Buffer{}
 	stderrBuffer := &bytes.Buffer{}
 	err := env.env.run(cmd, stdin, io.MultiWriter(stdout, stdoutBuffer), io.MultiWriter(stderr, stderrBuffer))
@@ -133,14 +150,18 @@ func (env *printingEnv) run(cmd *command, stdin io.Reader, stdout io.Writer, std
 	return env.env.run(cmd, stdin, stdout, stderr)
 }
 
+// Note: The command is written in a single call, as commands can be run in
+// parallel, e.g. for clang-tidy.
 func printCmd(env env, cmd *command) {
-	fmt.Fprintf(env.stderr(), "cd '%s' &&", env.getwd())
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "cd '%s' &&", env.getwd())
 	if len(cmd.EnvUpdates) > 0 {
-		fmt.Fprintf(env.stderr(), " env '%s'", strings.Join(cmd.EnvUpdates, "' '"))
+		fmt.Fprintf(line, " env '%s'", strings.Join(cmd.EnvUpdates, "' '"))
 	}
-	fmt.Fprintf(env.stderr(), " '%s'", getAbsCmdPath(env, cmd))
+	fmt.Fprintf(line, " '%s'", getAbsCmdPath(env, cmd))
 	if len(cmd.Args) > 0 {
-		fmt.Fprintf(env.stderr(), " '%s'", strings.Join(cmd.Args, "' '"))
+		fmt.Fprintf(line, " '%s'", strings.Join(cmd.Args, "' '"))
 	}
-	io.WriteString(env.stderr(), "\n")
+	line.WriteString("\n")
+	io.WriteString(env.stderr(), line.String())
 }
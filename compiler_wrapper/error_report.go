@@ -0,0 +1,94 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+)
+
+// Struct used to write JSON. Fields have to be uppercase for the json
+// encoder to read them.
+type errorReport struct {
+	Version string `json:"version"`
+	Config  string `json:"config"`
+	Cwd     string `json:"cwd"`
+	// The command the wrapper was called with, including its env updates.
+	Command *command `json:"command"`
+	// The error and the errors it wraps, starting with the outermost one.
+	Errors []string `json:"errors"`
+	Stack  string   `json:"stack"`
+}
+
+// Calls callCompilerInternal and converts panics into internal errors,
+// so that they are reported like other internal errors.
+func callCompilerWithRecover(env env, cfg *config, inputCmd *command) (exitCode int, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			exitCode = 0
+			err = panicError{value: value, stack: debug.Stack()}
+		}
+	}()
+	return callCompilerInternal(env, cfg, inputCmd)
+}
+
+func printCompilerError(env env, cfg *config, inputCmd *command, compilerErr error) {
+	writer := env.stderr()
+	if _, ok := compilerErr.(userError); ok {
+		fmt.Fprintf(writer, "%s\n", compilerErr)
+		return
+	}
+	msg := "Internal error."
+	if cfg.errorContact != "" {
+		msg = fmt.Sprintf("Internal error. Please report to %s.", cfg.errorContact)
+	}
+	if cfg.errorReportDir == "" {
+		fmt.Fprintf(writer, "%s\n%s\n", msg, compilerErr)
+		return
+	}
+	reportPath, err := writeErrorReport(env, cfg, inputCmd, compilerErr)
+	if err != nil {
+		fmt.Fprintf(writer, "%s\n%s\nUnable to write the error report: %s\n", msg, compilerErr, err)
+		return
+	}
+	fmt.Fprintf(writer, "%s\nPlease attach the error report %s.\n%s\n", msg, reportPath, compilerErr)
+}
+
+func writeErrorReport(env env, cfg *config, inputCmd *command, compilerErr error) (reportPath string, err error) {
+	stack := getErrorStack(compilerErr)
+	if stack == nil {
+		stack = debug.Stack()
+	}
+	report := errorReport{
+		Version: cfg.version,
+		Config:  cfg.name,
+		Cwd:     env.getwd(),
+		Command: inputCmd,
+		Errors:  getErrorChain(compilerErr),
+		Stack:   string(stack),
+	}
+
+	// The report dir is shared by all users, see disable_werror_flag.go.
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
+	if err := env.fs().mkdirAll(cfg.errorReportDir, 0777); err != nil {
+		return "", wrapErrorwithSourceLocf(err, "error creating error report directory %s", cfg.errorReportDir)
+	}
+	reportFile, err := env.fs().tempFile(cfg.errorReportDir, "error_report*.json")
+	if err != nil {
+		return "", wrapErrorwithSourceLocf(err, "error creating error report file")
+	}
+	enc := json.NewEncoder(reportFile)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		_ = reportFile.Close()
+		return "", wrapErrorwithSourceLocf(err, "error writing error report")
+	}
+	if err := reportFile.Close(); err != nil {
+		return "", wrapErrorwithSourceLocf(err, "error closing error report")
+	}
+	return reportFile.Name(), nil
+}
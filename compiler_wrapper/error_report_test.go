@@ -0,0 +1,144 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteErrorReportForInternalError(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.name = "cros.hardened"
+		ctx.cfg.version = "123"
+		ctx.cfg.errorContact = "someone@example.com"
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			return errors.New("someerror")
+		}
+		inputCmd := ctx.newCommand(gccX86_64, mainCc)
+		inputCmd.EnvUpdates = []string{"A=B"}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, inputCmd))
+		if err := verifyInternalError(stderr); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stderr, "Please report to someone@example.com.") {
+			t.Errorf("missing contact. Got: %s", stderr)
+		}
+		report := readErrorReport(ctx)
+		if !strings.Contains(stderr, report.path) {
+			t.Errorf("missing report path %s. Got: %s", report.path, stderr)
+		}
+		if report.Version != "123" || report.Config != "cros.hardened" || report.Cwd != ctx.wd {
+			t.Errorf("unexpected report: %#v", report.errorReport)
+		}
+		if !reflect.DeepEqual(report.Command, inputCmd) {
+			t.Errorf("unexpected command. Got: %#v", report.Command)
+		}
+		if len(report.Errors) != 2 || !strings.Contains(report.Errors[0], "failed to execute") ||
+			report.Errors[1] != "someerror" {
+			t.Errorf("unexpected error chain. Got: %q", report.Errors)
+		}
+		if !strings.Contains(report.Stack, "wrapSubprocessErrorWithSourceLoc") {
+			t.Errorf("expected the stack of the error. Got: %s", report.Stack)
+		}
+	})
+}
+
+func TestWriteErrorReportForPanic(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			panic("somepanic")
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if !hasInternalError(stderr) || !strings.Contains(stderr, "panic: somepanic") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+		report := readErrorReport(ctx)
+		if !reflect.DeepEqual(report.Errors, []string{"panic: somepanic"}) {
+			t.Errorf("unexpected errors. Got: %q", report.Errors)
+		}
+		if !strings.Contains(report.Stack, "TestWriteErrorReportForPanic") {
+			t.Errorf("expected the stack of the panic. Got: %s", report.Stack)
+		}
+	})
+}
+
+func TestNoErrorReportForUserError(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"BISECT_STAGE=xyz",
+			"FORCE_DISABLE_WERROR=1",
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if hasInternalError(stderr) {
+			t.Errorf("unexpected internal error. Got: %s", stderr)
+		}
+		if _, err := ioutil.ReadDir(ctx.cfg.errorReportDir); err == nil {
+			t.Errorf("unexpected error report dir %s", ctx.cfg.errorReportDir)
+		}
+	})
+}
+
+func TestPrintInternalErrorIfErrorReportDirIsNotWritable(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		memfs := ctx.useMemFileSystem()
+		if err := memfs.mkdirAll(ctx.cfg.errorReportDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		memfs.chmod(t, ctx.cfg.errorReportDir, 0555)
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			return errors.New("someerror")
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if err := verifyInternalError(stderr); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stderr, "someerror") || !strings.Contains(stderr, "Unable to write the error report") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+	})
+}
+
+func TestGetErrorChain(t *testing.T) {
+	err := wrapErrorwithSourceLocf(wrapErrorwithSourceLocf(errors.New("inner"), "middle %d", 1), "outer")
+	chain := getErrorChain(err)
+	if len(chain) != 3 || !strings.HasSuffix(chain[0], ": outer") ||
+		!strings.HasSuffix(chain[1], ": middle 1") || chain[2] != "inner" {
+		t.Errorf("unexpected chain. Got: %q", chain)
+	}
+	if !strings.HasSuffix(err.Error(), ": outer: "+chain[1]+": inner") {
+		t.Errorf("unexpected message. Got: %s", err)
+	}
+}
+
+type readErrorReportResult struct {
+	errorReport
+	path string
+}
+
+func readErrorReport(ctx *testContext) *readErrorReportResult {
+	files, err := ioutil.ReadDir(ctx.cfg.errorReportDir)
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	if len(files) != 1 {
+		ctx.t.Fatalf("expected 1 error report. Got: %s", files)
+	}
+	result := &readErrorReportResult{path: filepath.Join(ctx.cfg.errorReportDir, files[0].Name())}
+	data, err := ioutil.ReadFile(result.path)
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &result.errorReport); err != nil {
+		ctx.t.Fatal(err)
+	}
+	return result
+}
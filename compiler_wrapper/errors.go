@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os/exec"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"syscall"
 )
@@ -31,25 +32,95 @@ func newErrorwithSourceLocf(format string, v ...interface{}) error {
 }
 
 func wrapErrorwithSourceLocf(err error, format string, v ...interface{}) error {
-	return newErrorwithSourceLocfInternal(2, "%s: %s", fmt.Sprintf(format, v...), err.Error())
+	wrapped := newErrorwithSourceLocfInternal(2, format, v...)
+	wrapped.cause = err
+	if cause, ok := err.(*sourceLocError); ok {
+		wrapped.stack = cause.stack
+	}
+	return wrapped
+}
+
+// An internal error with the source location where it was created.
+// Keeps the wrapped errors and the stack trace for error reports.
+type sourceLocError struct {
+	// Message prefixed with the source location.
+	msg   string
+	cause error
+	stack []byte
+}
+
+var _ error = (*sourceLocError)(nil)
+
+func (err *sourceLocError) Error() string {
+	if err.cause == nil {
+		return err.msg
+	}
+	return err.msg + ": " + err.cause.Error()
+}
+
+func (err *sourceLocError) Unwrap() error {
+	return err.cause
+}
+
+// An internal error created from a recovered panic.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+var _ error = panicError{}
+
+func (err panicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.value)
+}
+
+// Returns the messages of the error and the errors it wraps,
+// starting with the outermost one.
+func getErrorChain(err error) []string {
+	chain := []string{}
+	for err != nil {
+		sourceLocErr, ok := err.(*sourceLocError)
+		if !ok {
+			chain = append(chain, err.Error())
+			break
+		}
+		chain = append(chain, sourceLocErr.msg)
+		err = sourceLocErr.cause
+	}
+	return chain
+}
+
+// Returns the stack trace of the place where the error was created,
+// or nil if it is unknown.
+func getErrorStack(err error) []byte {
+	switch err := err.(type) {
+	case *sourceLocError:
+		return err.stack
+	case panicError:
+		return err.stack
+	}
+	return nil
 }
 
 func wrapSubprocessErrorWithSourceLoc(cmd *command, subprocessErr error) (exitCode int, err error) {
 	if subprocessErr == nil {
 		return 0, nil
 	}
-	if userErr, ok := getCCacheError(cmd, subprocessErr); ok {
-		return 0, userErr
+	if cmd != nil {
+		if userErr, ok := getCCacheError(cmd.launcherName, cmd, subprocessErr); ok {
+			return 0, userErr
+		}
 	}
 	if exitCode, ok := getExitCode(subprocessErr); ok {
 		return exitCode, nil
 	}
-	err = newErrorwithSourceLocfInternal(2, "failed to execute %#v: %s", cmd, subprocessErr)
-	return 0, err
+	wrapped := newErrorwithSourceLocfInternal(2, "failed to execute %#v", cmd)
+	wrapped.cause = subprocessErr
+	return 0, wrapped
 }
 
 // Based on the implementation of log.Output
-func newErrorwithSourceLocfInternal(skip int, format string, v ...interface{}) error {
+func newErrorwithSourceLocfInternal(skip int, format string, v ...interface{}) *sourceLocError {
 	_, file, line, ok := runtime.Caller(skip)
 	if !ok {
 		file = "???"
@@ -59,7 +130,10 @@ func newErrorwithSourceLocfInternal(skip int, format string, v ...interface{}) e
 		file = file[lastSlash+1:]
 	}
 
-	return fmt.Errorf("%s:%d: %s", file, line, fmt.Sprintf(format, v...))
+	return &sourceLocError{
+		msg:   fmt.Sprintf("%s:%d: %s", file, line, fmt.Sprintf(format, v...)),
+		stack: debug.Stack(),
+	}
 }
 
 func getExitCode(err error) (exitCode int, ok bool) {
@@ -74,13 +148,14 @@ func getExitCode(err error) (exitCode int, ok bool) {
 	return 0, false
 }
 
-func getCCacheError(compilerCmd *command, compilerCmdErr error) (ccacheErr userError, ok bool) {
-	if en, ok := compilerCmdErr.(syscall.Errno); ok && en == syscall.ENOENT &&
-		strings.Contains(compilerCmd.Path, "ccache") {
-		ccacheErr =
-			newUserErrorf("ccache not found under %s. Please install it",
-				compilerCmd.Path)
-		return ccacheErr, true
+func getCCacheError(launcherName string, compilerCmd *command, compilerCmdErr error) (ccacheErr userError, ok bool) {
+	if en, ok := compilerCmdErr.(syscall.Errno); ok && en == syscall.ENOENT && launcherName != "" {
+		if kind, err := getCacheLauncherKind(launcherName); err == nil {
+			ccacheErr =
+				newUserErrorf("%s not found under %s. Please install it",
+					kind.name, compilerCmd.Path)
+			return ccacheErr, true
+		}
 	}
 	return ccacheErr, false
 }
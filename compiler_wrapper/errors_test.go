@@ -54,7 +54,7 @@ func TestSubprocessExitCodeError(t *testing.T) {
 }
 
 func TestSubprocessCCacheError(t *testing.T) {
-	_, err := wrapSubprocessErrorWithSourceLoc(&command{Path: "/usr/bin/ccache"}, syscall.ENOENT)
+	_, err := wrapSubprocessErrorWithSourceLoc(&command{Path: "/usr/bin/ccache", launcherName: "ccache"}, syscall.ENOENT)
 	if _, ok := err.(userError); !ok {
 		t.Errorf("unexpected error type. Got: %T", err)
 	}
@@ -70,3 +70,25 @@ func TestSubprocessGeneralError(t *testing.T) {
 		t.Errorf("Error message incorrect. Got: %s", err.Error())
 	}
 }
+
+func TestSubprocessSCCacheError(t *testing.T) {
+	_, err := wrapSubprocessErrorWithSourceLoc(&command{Path: "/usr/bin/sccache", launcherName: "sccache"}, syscall.ENOENT)
+	if _, ok := err.(userError); !ok {
+		t.Errorf("unexpected error type. Got: %T", err)
+	}
+	if err.Error() != "sccache not found under /usr/bin/sccache. Please install it" {
+		t.Errorf("unexpected error message. Got: %s", err)
+	}
+}
+
+func TestSubprocessCCacheErrorUsesLauncherName(t *testing.T) {
+	_, err := wrapSubprocessErrorWithSourceLoc(&command{Path: "/opt/bin/cachewrapper", launcherName: "ccache"}, syscall.ENOENT)
+	if err.Error() != "ccache not found under /opt/bin/cachewrapper. Please install it" {
+		t.Errorf("unexpected error message. Got: %s", err)
+	}
+
+	_, err = wrapSubprocessErrorWithSourceLoc(&command{Path: "/opt/ccache/bin/clang"}, syscall.ENOENT)
+	if _, ok := err.(userError); ok {
+		t.Errorf("unexpected ccache error. Got: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The file system facet of env. All file accesses of the wrapper
+// go through it so that tests can use an in-memory file system.
+// The methods behave like the functions with the same name in the
+// os, io/ioutil and path/filepath packages.
+type fileSystem interface {
+	stat(name string) (os.FileInfo, error)
+	lstat(name string) (os.FileInfo, error)
+	readlink(name string) (string, error)
+	evalSymlinks(path string) (string, error)
+	readFile(name string) ([]byte, error)
+	readDir(dirname string) ([]os.FileInfo, error)
+	mkdirAll(path string, perm os.FileMode) error
+	openFile(name string, flag int, perm os.FileMode) (file, error)
+	tempFile(dir string, pattern string) (file, error)
+	tempDir(dir string, pattern string) (string, error)
+	rename(oldpath string, newpath string) error
+	removeAll(path string) error
+	// Sets the umask of the process and returns the previous one.
+	umask(mask int) int
+	// Returns the uid that owns the files the wrapper creates.
+	getuid() int
+	// Takes an exclusive lock on the file without blocking. Returns
+	// syscall.EAGAIN if the lock is held by someone else. The lock is
+	// released when the file is closed.
+	tryLock(f file) error
+}
+
+// An open file. Implemented by *os.File.
+type file interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Chmod(mode os.FileMode) error
+}
+
+type osFileSystem struct{}
+
+var _ fileSystem = osFileSystem{}
+
+func (osFileSystem) stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFileSystem) readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFileSystem) evalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func (osFileSystem) readFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFileSystem) readDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFileSystem) mkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) openFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Note: Not returning f directly, as a nil *os.File
+		// would be a non nil file.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) tempFile(dir string, pattern string) (file, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) tempDir(dir string, pattern string) (string, error) {
+	return ioutil.TempDir(dir, pattern)
+}
+
+func (osFileSystem) rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) removeAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) umask(mask int) int {
+	return syscall.Umask(mask)
+}
+
+func (osFileSystem) getuid() int {
+	return os.Getuid()
+}
+
+func (osFileSystem) tryLock(f file) error {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return newErrorwithSourceLocf("%s is not a file of the os file system", f.Name())
+	}
+	return syscall.Flock(int(osFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
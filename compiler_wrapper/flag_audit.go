@@ -0,0 +1,324 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The flag audit finds flags that clang silently ignores. The cros configs
+// pass -Qunused-arguments and -Wno-unknown-warning-option, so typos like
+// -Wno-unsed-variable, gcc-only flags and e.g. linker flags for compile-only
+// commands would otherwise go unnoticed.
+//
+// If COMPILER_WRAPPER_AUDIT_FLAGS is set, the wrapper checks the args of
+// every clang command and writes the flags it finds to cfg.flagAuditLogDir:
+// - "unknown" flags: flags that are not among the warning and driver options
+//   that the compiler accepts. These are probed via clang --autocomplete and
+//   are cached per compiler, see probe_cache.go.
+// - "unused" flags: flags that clang reports as unused when running the
+//   driver via -### without -Qunused-arguments.
+// The compile itself is not affected. Failures of the audit are written
+// to the log dir as well.
+
+const auditFlagsKey = "COMPILER_WRAPPER_AUDIT_FLAGS"
+
+// Driver options whose next arg is passed on to another tool.
+var auditSkippedArgOptions = map[string]bool{
+	"-Xclang":        true,
+	"-Xlinker":       true,
+	"-Xassembler":    true,
+	"-Xpreprocessor": true,
+	"-mllvm":         true,
+}
+
+// Driver options that take the value in the same arg, but without a "="
+// or "," in the option name, e.g. -DFOO=1, and a check of the value
+// if the option accepts only some values. The value can also be
+// given as the next arg.
+var auditJoinedOptions = map[string]func(env env, value string) bool{
+	"-D": nil,
+	"-I": nil,
+	"-L": nil,
+	"-U": nil,
+	"-l": nil,
+	"-O": func(env env, value string) bool {
+		switch value {
+		case "", "0", "1", "2", "3", "s", "z", "g", "fast":
+			return true
+		}
+		return false
+	},
+	// clang ignores -B prefixes that don't exist.
+	"-B": func(env env, value string) bool {
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(env.getwd(), value)
+		}
+		if _, err := env.fs().stat(value); err == nil {
+			return true
+		}
+		// A prefix of the tools, e.g. -B/usr/bin/x86_64-cros-linux-gnu-
+		if !strings.HasSuffix(value, "-") {
+			return false
+		}
+		info, err := env.fs().stat(filepath.Dir(value))
+		return err == nil && info.IsDir()
+	},
+}
+
+// E.g. "clang-11: warning: argument unused during compilation: '-L/foo'".
+var unusedArgumentRegex = regexp.MustCompile(`warning: argument unused during compilation: '([^']*)'`)
+
+type flagAuditJSONData struct {
+	Cwd      string        `json:"cwd"`
+	Package  string        `json:"package,omitempty"`
+	Compiler string        `json:"compiler"`
+	Command  []string      `json:"command"`
+	Flags    []auditedFlag `json:"flags,omitempty"`
+	// Set if the audit failed.
+	Error string `json:"error,omitempty"`
+}
+
+type auditedFlag struct {
+	Flag string `json:"flag"`
+	// "unknown" or "unused".
+	Kind string `json:"kind"`
+	// "user" if the flag was passed to the wrapper,
+	// "config" if the wrapper added it.
+	Source string `json:"source"`
+}
+
+func shouldAuditFlags(env env) bool {
+	value, _ := env.getenv(auditFlagsKey)
+	return value != ""
+}
+
+// Writes the flags of the clang command in builder that the compiler
+// ignores to the audit log. Must be called after all flags were added
+// to builder. Errors are logged as well, as the audit must not fail
+// the compile.
+func auditFlags(env env, cfg *config, builder *commandBuilder) {
+	if builder.target.compilerType != clangType {
+		return
+	}
+	compilerPath := builder.path
+	if builder.numLauncherArgs > 0 {
+		compilerPath = builder.args[builder.numLauncherArgs-1].value
+	}
+	args := builder.args[builder.numLauncherArgs:]
+	cmd := builder.build()
+	data := &flagAuditJSONData{
+		Cwd:      env.getwd(),
+		Package:  getPackageIdentity(env).String(),
+		Compiler: compilerPath,
+		Command:  append([]string{cmd.Path}, cmd.Args...),
+	}
+	knownFlags, err := getKnownCompilerFlags(env, cfg, compilerPath)
+	if err == nil {
+		data.Flags = getUnknownFlags(env, args, knownFlags)
+		var unusedFlags []auditedFlag
+		unusedFlags, err = getUnusedFlags(env, compilerPath, args)
+		data.Flags = append(data.Flags, unusedFlags...)
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	if len(data.Flags) == 0 && data.Error == "" {
+		return
+	}
+	// Note: There is nowhere to report errors of the log itself.
+	_ = logFlagAudit(env, cfg, data)
+}
+
+func getUnknownFlags(env env, args []builderArg, knownFlags map[string]bool) []auditedFlag {
+	seen := map[string]bool{}
+	unknownFlags := []auditedFlag{}
+	skipNext := false
+	for _, arg := range args {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		skipNext = auditSkippedArgOptions[arg.value]
+		if seen[arg.value] || isKnownCompilerFlag(env, arg.value, knownFlags) {
+			continue
+		}
+		seen[arg.value] = true
+		unknownFlags = append(unknownFlags, newAuditedFlag(arg, "unknown"))
+	}
+	return unknownFlags
+}
+
+func newAuditedFlag(arg builderArg, kind string) auditedFlag {
+	source := "config"
+	if arg.fromUser {
+		source = "user"
+	}
+	return auditedFlag{Flag: arg.value, Kind: kind, Source: source}
+}
+
+func isKnownCompilerFlag(env env, arg string, knownFlags map[string]bool) bool {
+	if !strings.HasPrefix(arg, "-") || arg == "-" {
+		return true
+	}
+	if isValid, ok := auditJoinedOptions[arg[:2]]; ok {
+		return isValid == nil || len(arg) == 2 || isValid(env, arg[2:])
+	}
+	if knownFlags[arg] {
+		return true
+	}
+	if isWarningFlag(arg) && knownFlags[getAuditWarningFlag(arg)] {
+		return true
+	}
+	// E.g. -std=, -Wl, or -Wframe-larger-than=
+	for i := len(arg) - 1; i > 0; i-- {
+		if (arg[i] == '=' || arg[i] == ',') && knownFlags[arg[:i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the arg is a diagnostic flag, i.e. not one of
+// the driver options starting with -W like -Wl,<arg>.
+func isWarningFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-W") && !strings.ContainsRune(arg, ',')
+}
+
+// Returns the warning flag that controls the same warning, e.g.
+// -Wunused-variable for -Wno-unused-variable and -Wno-error=unused-variable.
+func getAuditWarningFlag(arg string) string {
+	name := strings.TrimPrefix(arg, "-W")
+	name = strings.TrimPrefix(name, "no-")
+	if strings.HasPrefix(name, "error=") {
+		name = name[len("error="):]
+	}
+	return "-W" + name
+}
+
+// Returns the flags that clang reports as unused. Runs only the driver,
+// i.e. nothing is compiled.
+func getUnusedFlags(env env, compilerPath string, args []builderArg) ([]auditedFlag, error) {
+	driverArgs := []string{"-###"}
+	for _, arg := range args {
+		if arg.value != "-Qunused-arguments" {
+			driverArgs = append(driverArgs, arg.value)
+		}
+	}
+	driverCmd := &command{
+		Path: compilerPath,
+		Args: append(driverArgs, "-Wunused-command-line-argument"),
+	}
+	stderrBuffer := bytes.Buffer{}
+	err := env.run(driverCmd, nil, &bytes.Buffer{}, &stderrBuffer)
+	if _, ok := getExitCode(err); !ok {
+		return nil, wrapErrorwithSourceLocf(err, "failed to call the compiler to find unused flags: %#v", driverCmd)
+	}
+	unusedFlags := []auditedFlag{}
+	seen := map[string]bool{}
+	for _, match := range unusedArgumentRegex.FindAllStringSubmatch(stderrBuffer.String(), -1) {
+		// Flags with a separate value are printed as "-L /foo".
+		flag := strings.SplitN(match[1], " ", 2)[0]
+		if seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		arg := builderArg{value: flag}
+		for _, a := range args {
+			if a.value == flag {
+				arg = a
+				break
+			}
+		}
+		unusedFlags = append(unusedFlags, newAuditedFlag(arg, "unused"))
+	}
+	return unusedFlags, nil
+}
+
+// Returns the warning and driver options that the compiler accepts.
+// The result is cached, see probe_cache.go.
+func getKnownCompilerFlags(env env, cfg *config, compilerPath string) (map[string]bool, error) {
+	var value string
+	var err error
+	if !strings.ContainsRune(compilerPath, filepath.Separator) {
+		// See getClangResourceDir.
+		value, err = probeKnownCompilerFlags(env, compilerPath)
+	} else {
+		absCompilerPath := compilerPath
+		if !filepath.IsAbs(absCompilerPath) {
+			absCompilerPath = filepath.Join(env.getwd(), absCompilerPath)
+		}
+		value, err = cachedProbe(env, cfg, "known-flags\x00"+absCompilerPath, []string{absCompilerPath}, func() (string, error) {
+			return probeKnownCompilerFlags(env, compilerPath)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	knownFlags := map[string]bool{}
+	for _, flag := range strings.Split(value, "\n") {
+		if flag != "" {
+			knownFlags[flag] = true
+		}
+	}
+	return knownFlags, nil
+}
+
+// Returns the flags printed by clang --autocomplete, one per line.
+// Note: Completions of "-W" are the diagnostic flags, e.g. -Wunused-variable
+// and -Wno-unused-variable, completions of "-" are the driver options.
+func probeKnownCompilerFlags(env env, compilerPath string) (string, error) {
+	flags := []string{}
+	for _, prefix := range []string{"-W", "-"} {
+		probeCmd := &command{
+			Path: compilerPath,
+			Args: []string{"--autocomplete=" + prefix},
+		}
+		stdoutBuffer := bytes.Buffer{}
+		stderrBuffer := bytes.Buffer{}
+		if err := env.run(probeCmd, nil, &stdoutBuffer, &stderrBuffer); err != nil {
+			return "", wrapErrorwithSourceLocf(err,
+				"failed to call the compiler to read the known flags: %#v, stderr: %s", probeCmd, stderrBuffer.String())
+		}
+		for _, line := range strings.Split(stdoutBuffer.String(), "\n") {
+			// Lines can contain a description after a tab.
+			if flag := strings.SplitN(line, "\t", 2)[0]; flag != "" {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, "\n"), nil
+}
+
+func logFlagAudit(env env, cfg *config, data *flagAuditJSONData) error {
+	if cfg.flagAuditLogDir == "" {
+		return nil
+	}
+	// The log dir is shared by all users, see disable_werror_flag.go.
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
+	if err := env.fs().mkdirAll(cfg.flagAuditLogDir, 0777); err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating flag audit directory %s", cfg.flagAuditLogDir)
+	}
+	logFile, err := env.fs().tempFile(cfg.flagAuditLogDir, "flag_audit*.json")
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating flag audit log file")
+	}
+	if err := json.NewEncoder(logFile).Encode(data); err != nil {
+		_ = logFile.Close()
+		_ = env.fs().removeAll(logFile.Name())
+		return wrapErrorwithSourceLocf(err, "error writing flag audit log")
+	}
+	if err := logFile.Close(); err != nil {
+		return wrapErrorwithSourceLocf(err, "error closing flag audit log")
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditReportsUnknownUserWarningFlag(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-Wno-unsed-variable", "-Wno-unused-variable", mainCc)))
+		flags := readAuditedFlags(ctx)
+		if !flags[auditedFlag{"-Wno-unsed-variable", "unknown", "user"}] {
+			t.Errorf("expected -Wno-unsed-variable to be reported. Got: %v", flags)
+		}
+		if flags[auditedFlag{"-Wno-unused-variable", "unknown", "user"}] {
+			t.Errorf("unexpected report of -Wno-unused-variable. Got: %v", flags)
+		}
+	})
+}
+
+func TestAuditReportsUnknownConfigFlag(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = append(ctx.cfg.clangFlags, "-fgcc-only-flag")
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if flags := readAuditedFlags(ctx); !flags[auditedFlag{"-fgcc-only-flag", "unknown", "config"}] {
+			t.Errorf("expected -fgcc-only-flag to be reported. Got: %v", flags)
+		}
+	})
+}
+
+func TestAuditAcceptsFlagsWithValues(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-DFOO=1", "-std=c++17", "-Wl,--foo", "-Werror=unused-variable",
+				"-Wno-error=unused-variable", "-Xclang", "-foo", "-o", "main.o", mainCc)))
+		for flag := range readAuditedFlags(ctx) {
+			if flag.Source == "user" {
+				t.Errorf("unexpected report of %s", flag.Flag)
+			}
+		}
+	})
+}
+
+func TestAuditDoesNotChangeCompilerCommand(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-Wno-unsed-variable", mainCc)))
+		if err := verifyArgOrder(cmd, "-Wno-unsed-variable", mainCc); err != nil {
+			t.Error(err)
+		}
+		if ctx.cmdCount != 4 {
+			t.Errorf("expected 4 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestAuditCachesKnownFlags(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.cfg.probeCacheDir = filepath.Join(ctx.tempDir, "probe_cache")
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		ctx.cmdCount = 0
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		// The -### call and the compile.
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestAuditSkipsGcc(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, "-Wno-unsed-variable", mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestAuditReportsInvalidJoinedOptionValues(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-O4", "-Bfoo", "-B"+ctx.tempDir, "-O2", "-lfoo", mainCc)))
+		flags := readAuditedFlags(ctx)
+		for _, flag := range []string{"-O4", "-Bfoo"} {
+			if !flags[auditedFlag{flag, "unknown", "user"}] {
+				t.Errorf("expected %s to be reported. Got: %v", flag, flags)
+			}
+		}
+		for _, flag := range []string{"-O2", "-B" + ctx.tempDir, "-lfoo"} {
+			if flags[auditedFlag{flag, "unknown", "user"}] {
+				t.Errorf("unexpected report of %s", flag)
+			}
+		}
+	})
+}
+
+func TestAuditReportsUnusedFlags(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if len(cmd.Args) > 0 && cmd.Args[0] == "-###" {
+				if err := verifyArgCount(cmd, 0, "-Qunused-arguments"); err != nil {
+					return err
+				}
+				fmt.Fprint(stderr, "clang-11: warning: argument unused during compilation: '-L/foo' [-Wunused-command-line-argument]\n")
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-c", "-L/foo", mainCc)))
+		if flags := readAuditedFlags(ctx); !flags[auditedFlag{"-L/foo", "unused", "user"}] {
+			t.Errorf("expected -L/foo to be reported. Got: %v", flags)
+		}
+	})
+}
+
+func TestAuditFailureDoesNotFailCompile(t *testing.T) {
+	withFlagAuditTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if len(cmd.Args) == 1 && strings.HasPrefix(cmd.Args[0], "--autocomplete") {
+				fmt.Fprint(stderr, "unknown argument")
+				return newExitCodeError(1)
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.stderrString() != "" {
+			t.Errorf("unexpected stderr. Got: %s", ctx.stderrString())
+		}
+		if data := readFlagAuditLog(ctx); !strings.Contains(data.Error, "unknown argument") {
+			t.Errorf("unexpected error. Got: %s", data.Error)
+		}
+	})
+}
+
+func TestNoAuditByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-Wno-unsed-variable", mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func withFlagAuditTestContext(t *testing.T, work func(ctx *testContext)) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, auditFlagsKey+"=1")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch {
+			case len(cmd.Args) == 1 && cmd.Args[0] == "--autocomplete=-W":
+				fmt.Fprint(stdout, "-Wunused-variable\n-Wno-unused-variable\n")
+			case len(cmd.Args) == 1 && cmd.Args[0] == "--autocomplete=-":
+				fmt.Fprint(stdout, "-Wl,\tPass the comma separated arguments to the linker\n-Xclang\n-o\n-std=\n")
+			}
+			return nil
+		}
+		work(ctx)
+	})
+}
+
+func readAuditedFlags(ctx *testContext) map[auditedFlag]bool {
+	jsonData := readFlagAuditLog(ctx)
+	if !strings.HasSuffix(jsonData.Compiler, "clang") {
+		ctx.t.Errorf("unexpected compiler. Got: %s", jsonData.Compiler)
+	}
+	flags := map[auditedFlag]bool{}
+	for _, flag := range jsonData.Flags {
+		flags[flag] = true
+	}
+	return flags
+}
+
+func readFlagAuditLog(ctx *testContext) *flagAuditJSONData {
+	files, err := ioutil.ReadDir(ctx.cfg.flagAuditLogDir)
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	if len(files) != 1 {
+		ctx.t.Fatalf("expected 1 flag audit log file. Got: %s", files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.cfg.flagAuditLogDir, files[0].Name()))
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	jsonData := &flagAuditJSONData{}
+	if err := json.Unmarshal(data, jsonData); err != nil {
+		ctx.t.Fatal(err)
+	}
+	return jsonData
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns a human readable description of the differences between the
+// expected and the actual golden records, one line per difference.
+// Returns nil if the records are the same.
+func diffGoldenRecords(expected []goldenRecord, actual []goldenRecord) []string {
+	diffs := []string{}
+	if len(expected) != len(actual) {
+		diffs = append(diffs, fmt.Sprintf("number of records: expected %d, got %d", len(expected), len(actual)))
+	}
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		recordDiffs := diffGoldenRecord(expected[i], actual[i])
+		if len(recordDiffs) == 0 {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("record %d: %s", i, describeGoldenRecord(expected[i])))
+		for _, diff := range recordDiffs {
+			diffs = append(diffs, "  "+diff)
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	return diffs
+}
+
+func describeGoldenRecord(record goldenRecord) string {
+	cmd := record.WrapperCmd.Cmd
+	return strings.Join(append(append(append([]string{}, record.Env...), cmd.Path), cmd.Args...), " ")
+}
+
+func diffGoldenRecord(expected goldenRecord, actual goldenRecord) []string {
+	diffs := diffCommandOutput("wrapper", expected.WrapperCmd, actual.WrapperCmd)
+	if len(expected.Cmds) != len(actual.Cmds) {
+		diffs = append(diffs, fmt.Sprintf("number of commands: expected %d, got %d", len(expected.Cmds), len(actual.Cmds)))
+	}
+	for i := 0; i < len(expected.Cmds) && i < len(actual.Cmds); i++ {
+		prefix := fmt.Sprintf("cmd %d", i)
+		expectedCmd := expected.Cmds[i].Cmd
+		actualCmd := actual.Cmds[i].Cmd
+		if expectedCmd.Path != actualCmd.Path {
+			diffs = append(diffs, fmt.Sprintf("%s: path: expected %q, got %q", prefix, expectedCmd.Path, actualCmd.Path))
+		}
+		diffs = append(diffs, diffStringLists(prefix+": args", expectedCmd.Args, actualCmd.Args)...)
+		diffs = append(diffs, diffStringLists(prefix+": env updates", expectedCmd.EnvUpdates, actualCmd.EnvUpdates)...)
+		diffs = append(diffs, diffCommandOutput(prefix, expected.Cmds[i], actual.Cmds[i])...)
+	}
+	return diffs
+}
+
+func diffCommandOutput(prefix string, expected commandResult, actual commandResult) []string {
+	diffs := []string{}
+	if expected.ExitCode != actual.ExitCode {
+		diffs = append(diffs, fmt.Sprintf("%s: exit code: expected %d, got %d", prefix, expected.ExitCode, actual.ExitCode))
+	}
+	if expected.Stdout != actual.Stdout {
+		diffs = append(diffs, fmt.Sprintf("%s: stdout: expected %q, got %q", prefix, expected.Stdout, actual.Stdout))
+	}
+	if expected.Stderr != actual.Stderr {
+		diffs = append(diffs, fmt.Sprintf("%s: stderr: expected %q, got %q", prefix, expected.Stderr, actual.Stderr))
+	}
+	return diffs
+}
+
+// Reports the values that were added or removed, and whether the order
+// changed if the same values are present in both lists.
+func diffStringLists(prefix string, expected []string, actual []string) []string {
+	if reflect.DeepEqual(expected, actual) || len(expected) == 0 && len(actual) == 0 {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, value := range expected {
+		counts[value]++
+	}
+	added := []string{}
+	for _, value := range actual {
+		if counts[value] > 0 {
+			counts[value]--
+		} else {
+			added = append(added, value)
+		}
+	}
+	removed := []string{}
+	for _, value := range expected {
+		if counts[value] > 0 {
+			counts[value]--
+			removed = append(removed, value)
+		}
+	}
+	diffs := []string{}
+	if len(added) > 0 {
+		diffs = append(diffs, fmt.Sprintf("%s: added %q", prefix, added))
+	}
+	if len(removed) > 0 {
+		diffs = append(diffs, fmt.Sprintf("%s: removed %q", prefix, removed))
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		diffs = append(diffs, fmt.Sprintf("%s: reordered, expected %q, got %q", prefix, expected, actual))
+	}
+	return diffs
+}
+
+func TestDiffStringLists(t *testing.T) {
+	testData := []struct {
+		expected []string
+		actual   []string
+		diffs    []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{nil, []string{}, nil},
+		{[]string{"a"}, []string{"a", "b"}, []string{`args: added ["b"]`}},
+		{[]string{"a", "b", "b"}, []string{"b", "c"}, []string{`args: added ["c"]`, `args: removed ["a" "b"]`}},
+		{[]string{"a", "b"}, []string{"b", "a"}, []string{`args: reordered, expected ["a" "b"], got ["b" "a"]`}},
+	}
+	for _, tt := range testData {
+		if diffs := diffStringLists("args", tt.expected, tt.actual); !reflect.DeepEqual(diffs, tt.diffs) {
+			t.Errorf("unexpected diffs for %q vs %q. Got: %q, expected: %q", tt.expected, tt.actual, diffs, tt.diffs)
+		}
+	}
+}
+
+func TestDiffGoldenRecords(t *testing.T) {
+	expected := []goldenRecord{{
+		Env:        []string{"A=1"},
+		WrapperCmd: newGoldenCmd("./x86_64-cros-linux-gnu-clang", "main.cc"),
+		Cmds: []commandResult{{
+			Cmd: &command{Path: "clang", Args: []string{"-O2", "main.cc"}, EnvUpdates: []string{"X=1"}},
+		}},
+	}}
+	actual := []goldenRecord{{
+		Env:        []string{"A=1"},
+		WrapperCmd: commandResult{Cmd: expected[0].WrapperCmd.Cmd, Stderr: "warning"},
+		Cmds: []commandResult{{
+			Cmd: &command{Path: "clang", Args: []string{"main.cc", "-O2"}, EnvUpdates: []string{"X=2"}},
+		}},
+	}}
+	diffs := diffGoldenRecords(expected, actual)
+	expectedDiffs := []string{
+		"record 0: A=1 ./x86_64-cros-linux-gnu-clang main.cc",
+		`  wrapper: stderr: expected "", got "warning"`,
+		`  cmd 0: args: reordered, expected ["-O2" "main.cc"], got ["main.cc" "-O2"]`,
+		`  cmd 0: env updates: added ["X=2"]`,
+		`  cmd 0: env updates: removed ["X=1"]`,
+	}
+	if !reflect.DeepEqual(diffs, expectedDiffs) {
+		t.Errorf("unexpected diffs. Got: %q, expected: %q", diffs, expectedDiffs)
+	}
+	if diffs := diffGoldenRecords(expected, expected); diffs != nil {
+		t.Errorf("unexpected diffs for same records: %q", diffs)
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The replay runs a built wrapper binary against the golden files, using
+// this test binary as fake compiler. This validates the binary that is
+// actually deployed, and not just the code under test. E.g. run
+// TestReplayGoldenRecords with -replaybinary=/tmp/wrapper
+// -replaygolden=testdata/cros_hardened_golden -replayconfig=cros.hardened.
+var replayBinary = flag.String("replaybinary", "", "wrapper binary to replay the golden files against")
+var replayGoldenDir = flag.String("replaygolden", "", "directory with the golden files to replay")
+var replayConfig = flag.String("replayconfig", "cros.hardened", "config the wrapper binary was built with")
+
+// If set, the test binary acts as fake compiler for the replay. The value
+// is the directory with the planned results and the recorded calls.
+const goldenReplayDirKey = "GOLDEN_REPLAY_DIR"
+
+type goldenReplayCall struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+}
+
+func TestMain(m *testing.M) {
+	if replayDir := os.Getenv(goldenReplayDirKey); replayDir != "" {
+		os.Exit(runGoldenReplayFakeCompiler(replayDir))
+	}
+	os.Exit(m.Run())
+}
+
+// Records the call and responds with the planned result of the
+// n-th call of the current golden record.
+func runGoldenReplayFakeCompiler(replayDir string) int {
+	planData, err := ioutil.ReadFile(filepath.Join(replayDir, "plan.json"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	plan := []commandResult{}
+	if err := json.Unmarshal(planData, &plan); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	callData, err := json.Marshal(goldenReplayCall{Path: os.Args[0], Args: os.Args[1:], Env: os.Environ()})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Note: Creating the file exclusively gives each call a unique index,
+	// even if the wrapper runs commands in parallel.
+	for i := 0; ; i++ {
+		file, err := os.OpenFile(goldenReplayCallPath(replayDir, i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		_, err = file.Write(callData)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if i >= len(plan) {
+			return 0
+		}
+		os.Stdout.WriteString(plan[i].Stdout)
+		os.Stderr.WriteString(plan[i].Stderr)
+		return plan[i].ExitCode
+	}
+}
+
+func goldenReplayCallPath(replayDir string, index int) string {
+	return filepath.Join(replayDir, fmt.Sprintf("call%d.json", index))
+}
+
+func TestReplayGoldenRecords(t *testing.T) {
+	if *replayBinary == "" || *replayGoldenDir == "" {
+		t.Skip("-replaybinary and -replaygolden not given")
+	}
+	cfg, err := getConfig(*replayConfig, false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := filepath.Abs(*replayBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCompiler, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenPaths, err := filepath.Glob(filepath.Join(*replayGoldenDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(goldenPaths) == 0 {
+		t.Fatalf("no golden files found in %s", *replayGoldenDir)
+	}
+	for _, goldenPath := range goldenPaths {
+		t.Run(filepath.Base(goldenPath), func(t *testing.T) {
+			replayGoldenFile(t, cfg, binary, fakeCompiler, goldenPath)
+		})
+	}
+}
+
+// The goldens are recorded with the wrapper in the stable temp dir, and the
+// toolchain root is relative to the wrapper. E.g. for cros.hardened, the
+// root is /tmp/stable/../../../../.., which is "/" as ".." stops at "/".
+// To be able to install the fake compilers, the replay mirrors "/" to
+// rootDir, and nests the stable temp dir so that the root of the wrapper
+// is rootDir. The paths the wrapper uses are mapped back before comparing.
+type goldenReplayLayout struct {
+	rootDir string
+	// The golden stable temp dir and its counterpart under rootDir.
+	stableDir       string
+	replayStableDir string
+	// The relative paths from the wd to the toolchain root.
+	// Empty if they are the same.
+	relRoot       string
+	replayRelRoot string
+}
+
+func newGoldenReplayLayout(cfg *config, rootDir string, record goldenRecord) *goldenReplayLayout {
+	stableDir := filepath.Join(os.TempDir(), "stable")
+	layout := &goldenReplayLayout{
+		rootDir:         rootDir,
+		stableDir:       stableDir,
+		replayStableDir: filepath.Join(rootDir, stableDir),
+	}
+	wrapperDir := filepath.Dir(record.WrapperCmd.Cmd.Path)
+	if !filepath.IsAbs(wrapperDir) {
+		wrapperDir = filepath.Join(record.Wd, wrapperDir)
+	}
+	rootDepth := 0
+	for _, elem := range strings.Split(cfg.rootRelPath, "/") {
+		if elem == ".." {
+			rootDepth++
+		}
+	}
+	if padDepth := rootDepth - strings.Count(wrapperDir, "/"); padDepth > 0 {
+		layout.replayStableDir = filepath.Join(rootDir, strings.Repeat("pad/", padDepth), stableDir)
+		layout.relRoot, _ = filepath.Rel(record.Wd, "/")
+		layout.replayRelRoot, _ = filepath.Rel(layout.toReplay(record.Wd), rootDir)
+	}
+	return layout
+}
+
+func (layout *goldenReplayLayout) toReplay(value string) string {
+	return strings.Replace(value, layout.stableDir, layout.replayStableDir, -1)
+}
+
+func (layout *goldenReplayLayout) fromReplay(value string) string {
+	value = strings.Replace(value, layout.replayStableDir, layout.stableDir, -1)
+	value = strings.Replace(value, layout.rootDir, "", -1)
+	if layout.replayRelRoot != "" {
+		value = strings.Replace(value, layout.replayRelRoot, layout.relRoot, -1)
+	}
+	return value
+}
+
+// Returns the path of a golden command under rootDir, and false
+// if the path can't be mirrored.
+func (layout *goldenReplayLayout) resolve(wd string, p string) (string, bool) {
+	if !filepath.IsAbs(p) {
+		if !strings.Contains(p, "/") {
+			// Found via PATH, which we don't control.
+			return "", false
+		}
+		if layout.relRoot != "" && strings.HasPrefix(p, layout.relRoot+"/") {
+			p = layout.replayRelRoot + strings.TrimPrefix(p, layout.relRoot)
+		}
+		return filepath.Join(layout.toReplay(wd), p), true
+	}
+	if p != layout.stableDir && !strings.HasPrefix(p, layout.stableDir+"/") {
+		// Fixed paths like /usr/bin/ccache.
+		return "", false
+	}
+	return layout.toReplay(p), true
+}
+
+func replayGoldenFile(t *testing.T, cfg *config, binary string, fakeCompiler string, goldenPath string) {
+	goldenData, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []goldenRecord{}
+	if err := json.Unmarshal(goldenData, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if filterPattern := *filterGoldenTests; filterPattern != "" {
+		expected = filterGoldenRecords(filterPattern, []goldenFile{{Records: expected}})[0].Records
+	}
+
+	replayed := []goldenRecord{}
+	actual := []goldenRecord{}
+	for _, record := range expected {
+		if record.Wd == "" {
+			record.Wd = filepath.Join(os.TempDir(), "stable")
+		}
+		actualRecord, reason, err := replayGoldenRecordInNewRoot(t, cfg, binary, fakeCompiler, record)
+		if err != nil {
+			t.Fatalf("replaying %s: %s", describeGoldenRecord(record), err)
+		}
+		if reason != "" {
+			t.Logf("skipping %s: %s", describeGoldenRecord(record), reason)
+			continue
+		}
+		replayed = append(replayed, record)
+		actual = append(actual, actualRecord)
+	}
+	if diffs := diffGoldenRecords(replayed, actual); diffs != nil {
+		t.Errorf("%s doesn't match %s:\n%s", binary, goldenPath, strings.Join(diffs, "\n"))
+	}
+	t.Logf("replayed %d of %d records", len(replayed), len(expected))
+}
+
+// Replays the record in a new root, so that files installed for other
+// records don't change the result. Returns the reason if the record
+// can't be replayed.
+func replayGoldenRecordInNewRoot(t *testing.T, cfg *config, binary string, fakeCompiler string, record goldenRecord) (goldenRecord, string, error) {
+	rootDir, err := ioutil.TempDir("", "golden_replay")
+	if err != nil {
+		return goldenRecord{}, "", err
+	}
+	defer os.RemoveAll(rootDir)
+
+	layout := newGoldenReplayLayout(cfg, rootDir, record)
+	prepareGoldenReplaySetup(t, layout)
+	if reason := prepareGoldenReplay(layout, binary, fakeCompiler, record); reason != "" {
+		return goldenRecord{}, reason, nil
+	}
+	actual, err := replayGoldenRecord(layout, record)
+	return actual, "", err
+}
+
+// Installs the wrapper and the fake compilers at the paths used by the
+// record. Returns the reason if the record can't be replayed,
+// e.g. because it calls a command outside of the stable temp dir.
+func prepareGoldenReplay(layout *goldenReplayLayout, binary string, fakeCompiler string, record goldenRecord) string {
+	wrapperPath, ok := layout.resolve(record.Wd, record.WrapperCmd.Cmd.Path)
+	if !ok {
+		return fmt.Sprintf("wrapper %s can't be installed", record.WrapperCmd.Cmd.Path)
+	}
+	for _, cmd := range record.Cmds {
+		cmdPath, ok := layout.resolve(record.Wd, cmd.Cmd.Path)
+		if !ok {
+			return fmt.Sprintf("command %s can't be replaced by a fake", cmd.Cmd.Path)
+		}
+		if filepath.Clean(cmdPath) == filepath.Clean(wrapperPath) {
+			// E.g. the host wrapper installed as clang.
+			return fmt.Sprintf("command %s is the wrapper itself", cmd.Cmd.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(cmdPath), 0777); err != nil {
+			return err.Error()
+		}
+		os.Remove(cmdPath)
+		if err := os.Symlink(fakeCompiler, cmdPath); err != nil {
+			return err.Error()
+		}
+	}
+	// Note: Copying instead of symlinking as the wrapper resolves
+	// symlinks to find the toolchain root. If the golden setup installed
+	// the wrapper as symlink, the copy replaces the target of the symlink.
+	if target, err := os.Readlink(wrapperPath); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(wrapperPath), target)
+		}
+		wrapperPath = target
+	}
+	if err := copyGoldenReplayFile(binary, wrapperPath); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// Recreates the files that the golden tests create in the stable temp
+// dir and that are not part of the records, e.g. the linker that rustc
+// finds via PATH or symlinks to the wrapper. For this, the setup of the
+// golden inputs is run with the stable temp dir of the replay.
+func prepareGoldenReplaySetup(t *testing.T, layout *goldenReplayLayout) {
+	ctx := &testContext{t: t, tempDir: layout.replayStableDir}
+	createSyswrapperGoldenInputs(ctx)
+}
+
+func copyGoldenReplayFile(src string, dest string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	os.Remove(dest)
+	return ioutil.WriteFile(dest, data, 0777)
+}
+
+func replayGoldenRecord(layout *goldenReplayLayout, record goldenRecord) (goldenRecord, error) {
+	replayDir := filepath.Join(layout.rootDir, "replay")
+	if err := os.MkdirAll(replayDir, 0777); err != nil {
+		return goldenRecord{}, err
+	}
+	planData, err := json.Marshal(record.Cmds)
+	if err != nil {
+		return goldenRecord{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(replayDir, "plan.json"), planData, 0666); err != nil {
+		return goldenRecord{}, err
+	}
+
+	wrapperCmd := record.WrapperCmd.Cmd
+	cmd := exec.Command(layout.toReplay(wrapperCmd.Path))
+	for _, arg := range wrapperCmd.Args {
+		cmd.Args = append(cmd.Args, layout.toReplay(arg))
+	}
+	cmd.Dir = layout.toReplay(record.Wd)
+	for _, entry := range record.Env {
+		cmd.Env = append(cmd.Env, layout.toReplay(entry))
+	}
+	cmd.Env = append(cmd.Env, goldenReplayDirKey+"="+replayDir)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var ok bool
+		if exitCode, ok = getExitCode(err); !ok {
+			return goldenRecord{}, err
+		}
+	}
+
+	actual := record
+	actual.WrapperCmd = commandResult{
+		Cmd:      wrapperCmd,
+		Stdout:   layout.fromReplay(stdout.String()),
+		Stderr:   layout.fromReplay(stderr.String()),
+		ExitCode: exitCode,
+	}
+	actual.Cmds = []commandResult{}
+	for i := 0; ; i++ {
+		callData, err := ioutil.ReadFile(goldenReplayCallPath(replayDir, i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return goldenRecord{}, err
+		}
+		call := goldenReplayCall{}
+		if err := json.Unmarshal([]byte(layout.fromReplay(string(callData))), &call); err != nil {
+			return goldenRecord{}, err
+		}
+		result := commandResult{Cmd: &command{Path: call.Path, Args: call.Args}}
+		if i < len(record.Cmds) {
+			expected := record.Cmds[i]
+			result.Stdout = expected.Stdout
+			result.Stderr = expected.Stderr
+			result.ExitCode = expected.ExitCode
+			result.Cmd.EnvUpdates = getGoldenReplayEnvUpdates(expected.Cmd.EnvUpdates, call.Env)
+		}
+		actual.Cmds = append(actual.Cmds, result)
+	}
+	return actual, nil
+}
+
+// Returns the env updates as seen by the fake compiler. Only the keys of
+// the expected updates are checked, as the recorded env is the full env
+// and not the delta.
+func getGoldenReplayEnvUpdates(expectedUpdates []string, env []string) []string {
+	if len(expectedUpdates) == 0 {
+		return expectedUpdates
+	}
+	values := map[string]string{}
+	for _, entry := range env {
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			values[entry[:i]] = entry[i+1:]
+		}
+	}
+	updates := []string{}
+	for _, update := range expectedUpdates {
+		key := update
+		if i := strings.IndexByte(update, '='); i >= 0 {
+			key = update[:i]
+		}
+		updates = append(updates, key+"="+values[key])
+	}
+	return updates
+}
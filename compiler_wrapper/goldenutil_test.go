@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -88,13 +89,31 @@ func runGoldenRecords(ctx *testContext, goldenDir string, files []goldenFile) {
 				continue
 			}
 			if !bytes.Equal(compareBuffer.Bytes(), goldenFileData) {
-				ctx.t.Errorf("Commands don't match the golden file under %s. Please regenerate via -updategolden to check the differences.",
-					filePath)
+				ctx.t.Errorf("Commands don't match the golden file under %s:\n%s\nPlease regenerate via -updategolden if the changes are intended.",
+					filePath, describeGoldenDiff(goldenFileData, compareBuffer.Bytes()))
 			}
 		}
 	}
 }
 
+// Returns the structured diff of two golden files, or a note if
+// they can't be parsed.
+func describeGoldenDiff(expectedData []byte, actualData []byte) string {
+	expected := []goldenRecord{}
+	actual := []goldenRecord{}
+	if err := json.Unmarshal(expectedData, &expected); err != nil {
+		return fmt.Sprintf("failed to parse the golden file: %s", err)
+	}
+	if err := json.Unmarshal(actualData, &actual); err != nil {
+		return fmt.Sprintf("failed to parse the actual records: %s", err)
+	}
+	diffs := diffGoldenRecords(expected, actual)
+	if diffs == nil {
+		return "records are equal, only the formatting differs"
+	}
+	return strings.Join(diffs, "\n")
+}
+
 func filterGoldenRecords(pattern string, files []goldenFile) []goldenFile {
 	matcher := regexp.MustCompile(pattern)
 	newFiles := []goldenFile{}
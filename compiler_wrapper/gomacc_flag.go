@@ -4,10 +4,6 @@
 
 package main
 
-import (
-	"os"
-)
-
 func processGomaCccFlags(builder *commandBuilder) (gomaUsed bool, err error) {
 	gomaPath := ""
 	nextArgIsGomaPath := false
@@ -32,8 +28,8 @@ func processGomaCccFlags(builder *commandBuilder) (gomaUsed bool, err error) {
 		gomaPath, _ = builder.env.getenv("GOMACC_PATH")
 	}
 	if gomaPath != "" {
-		if _, err := os.Lstat(gomaPath); err == nil {
-			builder.wrapPath(gomaPath)
+		if _, err := builder.env.fs().lstat(gomaPath); err == nil {
+			builder.wrapPath("gomacc", gomaPath)
 			return true, nil
 		}
 	}
@@ -92,3 +92,17 @@ func TestOmitGomaccByDefault(t *testing.T) {
 		}
 	})
 }
+
+func TestOmitGomaccIfEnvPointsToMissingFile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		// Note: The in-memory file system makes sure that the path
+		// does not exist, independent of the machine running the test.
+		ctx.useMemFileSystem()
+		ctx.env = []string{"GOMACC_PATH=/usr/bin/gomacc"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, mainCc)))
+		if err := verifyPath(cmd, gccX86_64+".real"); err != nil {
+			t.Error(err)
+		}
+	})
+}
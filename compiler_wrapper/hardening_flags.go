@@ -0,0 +1,157 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+const hardeningProfileKey = "HARDENING_PROFILE"
+
+type hardeningOption struct {
+	// Flags to add when compiling with clang / gcc. An option
+	// without flags for a compiler is not supported by it.
+	clangFlags []string
+	gccFlags   []string
+	// Prefixes of the architectures the option applies to.
+	// Empty if it applies to all architectures.
+	arches []string
+	// User flags that disable the option. Entries ending
+	// with "=" match any value.
+	optOutFlags []string
+	// Wrapper flags that are replaced by the option.
+	replacedFlags []string
+}
+
+var fortify3HardeningOption = &hardeningOption{
+	clangFlags:    []string{"-D_FORTIFY_SOURCE=3"},
+	gccFlags:      []string{"-D_FORTIFY_SOURCE=3"},
+	optOutFlags:   []string{"-D_FORTIFY_SOURCE=", "-U_FORTIFY_SOURCE", "-D__KERNEL__"},
+	replacedFlags: []string{"-D_FORTIFY_SOURCE=2"},
+}
+
+var autoVarInitHardeningOption = &hardeningOption{
+	clangFlags: []string{
+		"-ftrivial-auto-var-init=zero",
+		"-enable-trivial-auto-var-init-zero-knowing-it-will-be-removed-from-clang",
+	},
+	gccFlags:    []string{"-ftrivial-auto-var-init=zero"},
+	optOutFlags: []string{"-ftrivial-auto-var-init="},
+}
+
+var stackClashHardeningOption = &hardeningOption{
+	clangFlags:  []string{"-fstack-clash-protection"},
+	gccFlags:    []string{"-fstack-clash-protection"},
+	arches:      []string{"x86_64", "i686", "aarch64"},
+	optOutFlags: []string{"-fno-stack-clash-protection"},
+}
+
+// The shadow call stack is kept in x18, so it must not be used otherwise.
+var shadowCallStackHardeningOption = &hardeningOption{
+	clangFlags:  []string{"-fsanitize=shadow-call-stack", "-ffixed-x18"},
+	gccFlags:    []string{"-fsanitize=shadow-call-stack", "-ffixed-x18"},
+	arches:      []string{"aarch64"},
+	optOutFlags: []string{"-fno-sanitize=shadow-call-stack"},
+}
+
+// CFI only works with LTO and hidden visibility. Not supported by gcc.
+var cfiHardeningOption = &hardeningOption{
+	clangFlags:  []string{"-fsanitize=cfi", "-flto", "-fvisibility=hidden"},
+	optOutFlags: []string{"-fno-sanitize=cfi", "-fno-lto", "-D__KERNEL__"},
+}
+
+var relroHardeningOption = &hardeningOption{
+	clangFlags:  []string{"-Wl,-z,relro,-z,now"},
+	gccFlags:    []string{"-Wl,-z,relro,-z,now"},
+	optOutFlags: []string{"-Wl,-z,norelro", "-Wl,-z,lazy", "-D__KERNEL__"},
+}
+
+var hardeningProfiles = map[string][]*hardeningOption{
+	"baseline": {
+		fortify3HardeningOption,
+		stackClashHardeningOption,
+		relroHardeningOption,
+	},
+	"strict": {
+		fortify3HardeningOption,
+		stackClashHardeningOption,
+		relroHardeningOption,
+		autoVarInitHardeningOption,
+		shadowCallStackHardeningOption,
+		cfiHardeningOption,
+	},
+	"kernel": {
+		autoVarInitHardeningOption,
+		shadowCallStackHardeningOption,
+	},
+}
+
+// Adds the flags of the hardening profile given by HARDENING_PROFILE or
+// the config. The flags are added before the user flags, and user flags
+// that disable an option (e.g. -fno-stack-clash-protection) remove it.
+func processHardeningFlags(builder *commandBuilder) error {
+	profileName, _ := builder.env.getenv(hardeningProfileKey)
+	if profileName == "" {
+		profileName = builder.cfg.hardeningProfile
+	}
+	if profileName == "" || profileName == "none" {
+		return nil
+	}
+	profile, ok := hardeningProfiles[profileName]
+	if !ok {
+		return newUserErrorf("invalid value for %s: %q", hardeningProfileKey, profileName)
+	}
+	// Hardening doesn't make sense for bare metal targets.
+	if builder.target.abi == "eabi" {
+		return nil
+	}
+
+	replacedFlags := map[string]bool{}
+	flagsToAdd := []string{}
+	for _, option := range profile {
+		var flags []string
+		switch builder.target.compilerType {
+		case clangType:
+			flags = option.clangFlags
+		case gccType:
+			flags = option.gccFlags
+		}
+		if len(flags) == 0 {
+			continue
+		}
+		if len(option.arches) > 0 && !hasAtLeastOnePrefix(builder.target.arch, option.arches) {
+			continue
+		}
+		if hasOptOutUserFlag(builder, option.optOutFlags) {
+			continue
+		}
+		for _, flag := range option.replacedFlags {
+			replacedFlags[flag] = true
+		}
+		flagsToAdd = appendMissingStrings(flagsToAdd, flags...)
+	}
+	builder.transformArgs(func(arg builderArg) string {
+		if !arg.fromUser && replacedFlags[arg.value] {
+			return ""
+		}
+		return arg.value
+	})
+	builder.addPreUserArgs(flagsToAdd...)
+	return nil
+}
+
+func hasOptOutUserFlag(builder *commandBuilder, optOutFlags []string) bool {
+	for _, arg := range builder.args {
+		if !arg.fromUser {
+			continue
+		}
+		for _, flag := range optOutFlags {
+			if arg.value == flag || (strings.HasSuffix(flag, "=") && strings.HasPrefix(arg.value, flag)) {
+				return true
+			}
+		}
+	}
+	return false
+}
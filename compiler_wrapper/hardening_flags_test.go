@@ -0,0 +1,140 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestOmitHardeningFlagsByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fstack-clash-protection|-D_FORTIFY_SOURCE=3"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddBaselineHardeningFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.hardeningProfile = "baseline"
+		ctx.cfg.commonFlags = []string{"-D_FORTIFY_SOURCE=2"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-D_FORTIFY_SOURCE=3", "-fstack-clash-protection",
+			"-Wl,-z,relro,-z,now", mainCc); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-D_FORTIFY_SOURCE=2"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-ftrivial-auto-var-init=zero"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSelectHardeningProfileViaEnv(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.hardeningProfile = "baseline"
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=none")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fstack-clash-protection"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddStrictHardeningFlagsForClang(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=strict")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./aarch64-cros-linux-gnu-clang", mainCc)))
+		for _, flag := range []string{"-ftrivial-auto-var-init=zero", "-fsanitize=shadow-call-stack",
+			"-fsanitize=cfi", "-flto", "-fvisibility=hidden"} {
+			if err := verifyArgCount(cmd, 1, flag); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestReserveX18ForClangShadowCallStack(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=kernel")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./aarch64-cros-linux-gnu-clang", mainCc)))
+		if err := verifyPath(cmd, "usr/bin/clang"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, "-fsanitize=shadow-call-stack", "-ffixed-x18", mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseGccSpellingOfHardeningFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=strict")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./aarch64-cros-linux-gnu-gcc", mainCc)))
+		if err := verifyArgOrder(cmd, "-fsanitize=shadow-call-stack", "-ffixed-x18"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-enable-trivial-auto-var-init-zero-.*|-fsanitize=cfi"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestApplyHardeningFlagsPerArch(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=strict")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./armv7a-cros-linux-gnueabihf-clang", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fstack-clash-protection|-fsanitize=shadow-call-stack"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUserFlagsDisableHardeningOptions(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=strict")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fno-stack-clash-protection", "-ftrivial-auto-var-init=pattern",
+				"-U_FORTIFY_SOURCE", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fstack-clash-protection|-ftrivial-auto-var-init=zero|-D_FORTIFY_SOURCE=3"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKernelHardeningProfile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=kernel")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-D__KERNEL__", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-ftrivial-auto-var-init=zero"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-D_FORTIFY_SOURCE=3|-Wl,-z,relro,-z,now"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForInvalidHardeningProfile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "HARDENING_PROFILE=paranoid")
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid value for HARDENING_PROFILE: "paranoid"`); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+type compilerAction int32
+
+const (
+	linkAction compilerAction = iota
+	// -c
+	assembleAction
+	// -S
+	compileAction
+	// -fsyntax-only
+	syntaxOnlyAction
+	// -E, -M, -MM
+	preprocessAction
+)
+
+func (action compilerAction) String() string {
+	switch action {
+	case assembleAction:
+		return "assemble"
+	case compileAction:
+		return "compile"
+	case syntaxOnlyAction:
+		return "syntax-only"
+	case preprocessAction:
+		return "preprocess"
+	default:
+		return "link"
+	}
+}
+
+type inputFile struct {
+	path string
+	// Language as given via -x or derived from the suffix.
+	// Empty for object files, libraries and other linker inputs.
+	language string
+}
+
+// The meaning of a compiler command line. It is computed from the
+// arguments of a commandBuilder and updated whenever the arguments change.
+type invocation struct {
+	action compilerAction
+	inputs []inputFile
+	// Value of -o. Empty if not given.
+	output string
+	// Value of -MF. Empty if not given.
+	depFile string
+	// Values of -MT and -MQ.
+	depTargets []string
+	// The .dwo file written with -gsplit-dwarf. Empty if not used.
+	splitDwarfOutput string
+	// Value of --sysroot. Empty if not given.
+	sysroot string
+	// Whether --sysroot was given, possibly with an empty value.
+	sysrootGiven bool
+	// Whether the user gave --sysroot, see builderArg.fromUser.
+	sysrootFromUser bool
+	// Flags that select the target, e.g. -target, -march or -m32,
+	// in the order given.
+	targetFlags []string
+	// Values of -B, i.e. the directories to search the linker etc. in.
+	prefixDirs []string
+	// Value of the last -fuse-ld=. Empty if not given.
+	fuseLd string
+	// True if one of the inputs is stdin.
+	readsStdin bool
+	// -shared / -r
+	shared      bool
+	relocatable bool
+	// Whether the user selected the relocation model (e.g. -fPIC, -fno-pie)
+	// or builds code that can't be position independent by default (e.g.
+	// -D__KERNEL__, -nostdlib). See pie_flags.go.
+	userRelocationModel bool
+	// Whether the user selected the kind of the linked output (e.g. -pie,
+	// -static, -shared, -r) or links without the default startfiles.
+	userLinkKind bool
+}
+
+// Flags that take the next argument as value when given without "=".
+var flagsWithSeparateValue = map[string]bool{
+	"-o": true, "-x": true, "-MF": true, "-MT": true, "-MQ": true,
+	"--sysroot": true, "-target": true, "--target": true, "-arch": true,
+	"-I": true, "-L": true, "-D": true, "-U": true, "-B": true, "-T": true,
+	"-include": true, "-imacros": true, "-isystem": true, "-iquote": true,
+	"-idirafter": true, "-isysroot": true, "-iprefix": true, "-iwithprefix": true,
+	"-include-pch": true, "-Xlinker": true, "-Xassembler": true,
+	"-Xpreprocessor": true, "-Xclang": true, "-mllvm": true, "-u": true,
+	"-e": true, "-z": true, "-gcc-toolchain": true, "-resource-dir": true,
+	"--param": true, "-l": true,
+}
+
+// Prefixes of flags that select the target.
+var targetFlagPrefixes = []string{
+	"--target=", "-march=", "-mcpu=", "-mtune=", "-mfpu=", "-mfloat-abi=", "-mabi=",
+}
+
+var targetFlags = map[string]bool{
+	"-m32": true, "-m64": true, "-mx32": true, "-mthumb": true, "-marm": true,
+}
+
+// User flags that set userRelocationModel. -D__KERNEL__ is matched
+// separately to also find -D __KERNEL__.
+var relocationModelFlags = map[string]bool{
+	"-fPIC": true, "-fPIE": true, "-fno-PIC": true, "-fno-PIE": true,
+	"-fno-pic": true, "-fno-pie": true, "-fpic": true, "-fpie": true, "-nopie": true,
+	"-nostartfiles": true, "-nostdlib": true, "-pie": true, "-static": true,
+}
+
+// User flags that set userLinkKind, besides -D__KERNEL__, -shared and -r.
+var linkKindFlags = map[string]bool{
+	"-A": true, "-fno-PIC": true, "-fno-PIE": true, "-fno-pic": true, "-fno-pie": true,
+	"-nopie": true, "-nostartfiles": true, "-nostdlib": true, "-pie": true, "-static": true,
+}
+
+var languagesBySuffix = map[string]string{
+	".c":   "c",
+	".i":   "cpp-output",
+	".cc":  "c++",
+	".cp":  "c++",
+	".cpp": "c++",
+	".CPP": "c++",
+	".cxx": "c++",
+	".c++": "c++",
+	".C":   "c++",
+	".ii":  "c++-cpp-output",
+	".m":   "objective-c",
+	".mm":  "objective-c++",
+	".M":   "objective-c++",
+	".h":   "c-header",
+	".hh":  "c++-header",
+	".hpp": "c++-header",
+	".H":   "c++-header",
+	".s":   "assembler",
+	".S":   "assembler-with-cpp",
+	".sx":  "assembler-with-cpp",
+}
+
+// Parses a command line, e.g. of a command. All args count as user args.
+func parseInvocation(args []string) *invocation {
+	return parseBuilderInvocation(createBuilderArgs( /*fromUser=*/ true, args))
+}
+
+func parseBuilderInvocation(args []builderArg) *invocation {
+	inv := &invocation{}
+	language := ""
+	splitDwarf := false
+	stages := map[compilerAction]bool{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i].value
+		fromUser := args[i].fromUser
+		value := ""
+		if flagsWithSeparateValue[arg] && i+1 < len(args) {
+			i++
+			value = args[i].value
+		}
+		if fromUser {
+			isKernel := arg == "-D__KERNEL__" || arg == "-D" && value == "__KERNEL__"
+			if isKernel || relocationModelFlags[arg] {
+				inv.userRelocationModel = true
+			}
+			if isKernel || linkKindFlags[arg] || arg == "-shared" || arg == "--shared" || arg == "-r" {
+				inv.userLinkKind = true
+			}
+		}
+		switch {
+		case arg == "-" || !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "@"):
+			lang := language
+			if lang == "" {
+				lang = languagesBySuffix[filepath.Ext(arg)]
+			}
+			if arg == "-" {
+				inv.readsStdin = true
+			}
+			inv.inputs = append(inv.inputs, inputFile{path: arg, language: lang})
+		case arg == "-x":
+			language = value
+		case strings.HasPrefix(arg, "-x"):
+			language = arg[len("-x"):]
+		case arg == "-o":
+			inv.output = value
+		case arg == "-MF":
+			inv.depFile = value
+		case strings.HasPrefix(arg, "-MF"):
+			inv.depFile = arg[len("-MF"):]
+		case arg == "-MT" || arg == "-MQ":
+			inv.depTargets = append(inv.depTargets, value)
+		case arg == "--sysroot" || strings.HasPrefix(arg, "--sysroot="):
+			if arg == "--sysroot" {
+				inv.sysroot = value
+			} else {
+				inv.sysroot = arg[len("--sysroot="):]
+			}
+			inv.sysrootGiven = true
+			inv.sysrootFromUser = inv.sysrootFromUser || fromUser
+		case arg == "-target" || arg == "--target":
+			inv.targetFlags = append(inv.targetFlags, arg, value)
+		case arg == "-B":
+			inv.prefixDirs = append(inv.prefixDirs, value)
+		case strings.HasPrefix(arg, "-B"):
+			inv.prefixDirs = append(inv.prefixDirs, arg[len("-B"):])
+		case strings.HasPrefix(arg, "-fuse-ld="):
+			inv.fuseLd = arg[len("-fuse-ld="):]
+		case targetFlags[arg] || hasAtLeastOnePrefix(arg, targetFlagPrefixes):
+			inv.targetFlags = append(inv.targetFlags, arg)
+		case arg == "-gsplit-dwarf" || arg == "-gsplit-dwarf=split":
+			splitDwarf = true
+		case arg == "-gsplit-dwarf=single":
+			splitDwarf = false
+		case arg == "-c":
+			stages[assembleAction] = true
+		case arg == "-S":
+			stages[compileAction] = true
+		case arg == "-fsyntax-only":
+			stages[syntaxOnlyAction] = true
+		case arg == "-E" || arg == "-M" || arg == "-MM":
+			stages[preprocessAction] = true
+		case arg == "-shared" || arg == "--shared":
+			inv.shared = true
+		case arg == "-r":
+			inv.relocatable = true
+		case strings.HasPrefix(arg, "-o") && !strings.HasPrefix(arg, "-ob"):
+			// -ofile. Note: -objcmt-* etc. are no output flags,
+			// but those are not used with the wrapper.
+			inv.output = arg[len("-o"):]
+		}
+		if language == "none" {
+			language = ""
+		}
+	}
+	// The earliest stage wins, e.g. -E -c only preprocesses.
+	for _, action := range []compilerAction{preprocessAction, syntaxOnlyAction, compileAction, assembleAction} {
+		if stages[action] {
+			inv.action = action
+			break
+		}
+	}
+	if splitDwarf && (inv.action == assembleAction || inv.action == linkAction) && inv.output != "" {
+		inv.splitDwarfOutput = strings.TrimSuffix(inv.output, filepath.Ext(inv.output)) + ".dwo"
+	}
+	return inv
+}
+
+// Returns the inputs that are source files, i.e. that have a language.
+func (inv *invocation) sourceInputs() []inputFile {
+	sources := []inputFile{}
+	for _, input := range inv.inputs {
+		if input.language != "" && input.path != "-" {
+			sources = append(sources, input)
+		}
+	}
+	return sources
+}
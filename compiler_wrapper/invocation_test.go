@@ -0,0 +1,169 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInvocationAction(t *testing.T) {
+	testData := []struct {
+		args   []string
+		action compilerAction
+	}{
+		{[]string{"main.o", "-o", "main"}, linkAction},
+		{[]string{"-c", "main.cc"}, assembleAction},
+		{[]string{"-S", "main.cc"}, compileAction},
+		{[]string{"-fsyntax-only", "main.cc"}, syntaxOnlyAction},
+		{[]string{"-E", "main.cc"}, preprocessAction},
+		{[]string{"-M", "main.cc"}, preprocessAction},
+		{[]string{"-c", "-E", "main.cc"}, preprocessAction},
+		{[]string{"-c", "-S", "main.cc"}, compileAction},
+	}
+	for _, tt := range testData {
+		if action := parseInvocation(tt.args).action; action != tt.action {
+			t.Errorf("unexpected action for %q. Got: %s, expected: %s", tt.args, action, tt.action)
+		}
+	}
+}
+
+func TestParseInvocationInputs(t *testing.T) {
+	inv := parseInvocation([]string{
+		"-I", "include.c", "-include", "prefix.h", "-o", "out.c",
+		"main.cc", "-x", "c", "generated.inc", "-x", "none", "asm.S", "lib.a", "-",
+	})
+	expected := []inputFile{
+		{path: "main.cc", language: "c++"},
+		{path: "generated.inc", language: "c"},
+		{path: "asm.S", language: "assembler-with-cpp"},
+		{path: "lib.a", language: ""},
+		{path: "-", language: ""},
+	}
+	if !reflect.DeepEqual(inv.inputs, expected) {
+		t.Errorf("unexpected inputs. Got: %v, expected: %v", inv.inputs, expected)
+	}
+	if !inv.readsStdin {
+		t.Error("expected stdin as input")
+	}
+	if len(inv.sourceInputs()) != 3 {
+		t.Errorf("unexpected source inputs: %v", inv.sourceInputs())
+	}
+}
+
+func TestParseInvocationJoinedLanguage(t *testing.T) {
+	inv := parseInvocation([]string{"-xc++", "main.inc"})
+	if inv.inputs[0].language != "c++" {
+		t.Errorf("unexpected language: %s", inv.inputs[0].language)
+	}
+}
+
+func TestParseInvocationSeparateParamValue(t *testing.T) {
+	inv := parseInvocation([]string{"--param", "max-inline-insns-single=10", "main.cc"})
+	expected := []inputFile{{path: "main.cc", language: "c++"}}
+	if !reflect.DeepEqual(inv.inputs, expected) {
+		t.Errorf("unexpected inputs. Got: %v, expected: %v", inv.inputs, expected)
+	}
+}
+
+func TestParseInvocationSeparateLibraryValue(t *testing.T) {
+	inv := parseInvocation([]string{"main.o", "-l", "m", "-o", "main"})
+	expected := []inputFile{{path: "main.o", language: ""}}
+	if !reflect.DeepEqual(inv.inputs, expected) {
+		t.Errorf("unexpected inputs. Got: %v, expected: %v", inv.inputs, expected)
+	}
+}
+
+func TestParseInvocationOutputs(t *testing.T) {
+	inv := parseInvocation([]string{
+		"-c", "main.cc", "-o", "out/main.o", "-MD", "-MF", "out/main.d", "-MT", "main.o", "-MQ", "$main.o", "-gsplit-dwarf",
+	})
+	if inv.output != "out/main.o" {
+		t.Errorf("unexpected output: %s", inv.output)
+	}
+	if inv.depFile != "out/main.d" {
+		t.Errorf("unexpected dep file: %s", inv.depFile)
+	}
+	if !reflect.DeepEqual(inv.depTargets, []string{"main.o", "$main.o"}) {
+		t.Errorf("unexpected dep targets: %s", inv.depTargets)
+	}
+	if inv.splitDwarfOutput != "out/main.dwo" {
+		t.Errorf("unexpected split dwarf output: %s", inv.splitDwarfOutput)
+	}
+	if parseInvocation([]string{"-S", "main.cc", "-o", "main.s", "-gsplit-dwarf"}).splitDwarfOutput != "" {
+		t.Error("unexpected split dwarf output for -S")
+	}
+}
+
+func TestParseInvocationTargetFlags(t *testing.T) {
+	inv := parseInvocation([]string{
+		"--sysroot", "/sysroot", "-target", "armv7a-cros-linux-gnueabihf", "-mthumb", "-march=armv7-a", "-O2", "main.cc",
+	})
+	if inv.sysroot != "/sysroot" {
+		t.Errorf("unexpected sysroot: %s", inv.sysroot)
+	}
+	expected := []string{"-target", "armv7a-cros-linux-gnueabihf", "-mthumb", "-march=armv7-a"}
+	if !reflect.DeepEqual(inv.targetFlags, expected) {
+		t.Errorf("unexpected target flags. Got: %s, expected: %s", inv.targetFlags, expected)
+	}
+}
+
+func TestParseInvocationSysrootOrigin(t *testing.T) {
+	inv := parseInvocation([]string{"--sysroot=", "main.cc"})
+	if !inv.sysrootGiven || !inv.sysrootFromUser || inv.sysroot != "" {
+		t.Errorf("expected empty user sysroot. Got: %+v", inv)
+	}
+	inv = parseInvocation([]string{"main.cc"})
+	if inv.sysrootGiven || inv.sysrootFromUser {
+		t.Errorf("unexpected sysroot. Got: %+v", inv)
+	}
+	inv = parseBuilderInvocation([]builderArg{
+		{value: "--sysroot", fromUser: false}, {value: "/wrapper", fromUser: false},
+		{value: "main.cc", fromUser: true},
+	})
+	if !inv.sysrootGiven || inv.sysrootFromUser || inv.sysroot != "/wrapper" {
+		t.Errorf("expected sysroot from the wrapper. Got: %+v", inv)
+	}
+}
+
+func TestParseInvocationUserPieFlags(t *testing.T) {
+	inv := parseBuilderInvocation([]builderArg{
+		{value: "-fPIE", fromUser: false}, {value: "-pie", fromUser: false},
+		{value: "main.cc", fromUser: true},
+	})
+	if inv.userRelocationModel || inv.userLinkKind {
+		t.Errorf("wrapper flags must not count as user flags. Got: %+v", inv)
+	}
+	inv = parseInvocation([]string{"-D", "__KERNEL__", "main.cc"})
+	if !inv.userRelocationModel || !inv.userLinkKind {
+		t.Errorf("expected -D __KERNEL__ to select both. Got: %+v", inv)
+	}
+	inv = parseInvocation([]string{"-shared", "main.cc"})
+	if inv.userRelocationModel || !inv.userLinkKind {
+		t.Errorf("expected -shared to only select the link kind. Got: %+v", inv)
+	}
+}
+
+func TestKeepInvocationInSyncWithArgs(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		builder, err := newCommandBuilder(ctx, ctx.cfg, ctx.newCommand(clangX86_64, "-c", mainCc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		builder.addPostUserArgs("-o", "main.o")
+		if builder.invocation.output != "main.o" {
+			t.Errorf("unexpected output: %s", builder.invocation.output)
+		}
+		builder.removeArgs("-c")
+		if builder.invocation.action != linkAction {
+			t.Errorf("unexpected action: %s", builder.invocation.action)
+		}
+		builder.wrapPath("gomacc", "gomacc")
+		builder.addPreUserArgs("-shared")
+		if len(builder.invocation.inputs) != 1 || !builder.invocation.shared {
+			t.Errorf("unexpected invocation after wrapPath: %+v", builder.invocation)
+		}
+	})
+}
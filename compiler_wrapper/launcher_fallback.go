@@ -0,0 +1,169 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Lines on stderr that show that the launcher itself failed, e.g.
+// because of a corrupted cache, and not the compiler.
+var launcherErrorPrefixes = map[string][]string{
+	"ccache":  {"ccache: error:", "ccache: FATAL:"},
+	"sccache": {"sccache: error:"},
+	"gomacc":  {"GOMA:"},
+}
+
+// Longer lines are truncated before they are checked for the prefixes.
+const maxLauncherErrorLineLength = 4096
+
+// Struct used to write JSON. Fields have to be uppercase for the json
+// encoder to read them.
+type launcherFallbackJSONData struct {
+	Cwd      string   `json:"cwd"`
+	Launcher string   `json:"launcher"`
+	Reason   string   `json:"reason"`
+	Command  []string `json:"command"`
+}
+
+// Runs the command, which calls the compiler via a launcher like ccache or
+// gomacc. If the launcher fails, i.e. it is not installed or reports an
+// error of its own, the command is retried without the launcher. Failures
+// of the compiler, including crashes, are passed through.
+func runWithLauncherFallback(env env, cfg *config, launcherName string, cmd *command) (exitCode int, err error) {
+	cmd = forceColorDiagnostics(env, cmd)
+	stdinBuffer := &bytes.Buffer{}
+	stdout := &launcherStdoutWriter{writer: env.stdout()}
+	stderr := &launcherStderrWriter{writer: env.stderr(), prefixes: launcherErrorPrefixes[launcherName]}
+	cmdErr := env.run(cmd, teeStdinIfNeeded(env, cmd, stdinBuffer), stdout, stderr)
+	stderr.flush()
+	reason := getLauncherFailure(cmdErr, stderr.errorLine)
+	if reason == "" || stdout.written {
+		// Note: Retrying after the command wrote to stdout, e.g. with -E,
+		// would repeat the output.
+		return wrapSubprocessErrorWithSourceLoc(cmd, cmdErr)
+	}
+
+	fmt.Fprintf(env.stderr(), "compiler wrapper: %s %s, retrying without it\n", launcherName, reason)
+	// Note: The log is best effort, problems with it must not
+	// break the compile.
+	_ = logLauncherFallback(env, cfg, &launcherFallbackJSONData{
+		Cwd:      env.getwd(),
+		Launcher: launcherName,
+		Reason:   reason,
+		Command:  append([]string{cmd.Path}, cmd.Args...),
+	})
+	retryCmd := &command{
+		Path:       cmd.Args[0],
+		Args:       cmd.Args[1:],
+		EnvUpdates: cmd.EnvUpdates,
+	}
+	if parseInvocation(retryCmd.Args).readsStdin {
+		return wrapSubprocessErrorWithSourceLoc(retryCmd,
+			env.run(retryCmd, bytes.NewReader(stdinBuffer.Bytes()), env.stdout(), env.stderr()))
+	}
+	return wrapSubprocessErrorWithSourceLoc(retryCmd, env.exec(retryCmd))
+}
+
+// Returns why the launcher failed, or "" if it succeeded or
+// the compiler failed. errorLine is the first error of the launcher
+// on stderr, if any.
+func getLauncherFailure(cmdErr error, errorLine string) string {
+	if cmdErr == nil {
+		return ""
+	}
+	if os.IsNotExist(cmdErr) {
+		return "not found"
+	}
+	if exitCode, ok := getExitCode(cmdErr); ok && exitCode > 0 && errorLine != "" {
+		return "failed with: " + errorLine
+	}
+	// Note: Commands that were killed by a signal are not retried, as the
+	// signal could be an OOM kill or come from make, or the compiler could
+	// have crashed.
+	return ""
+}
+
+// Forwards stdout and records whether anything was written.
+type launcherStdoutWriter struct {
+	writer  io.Writer
+	written bool
+}
+
+func (w *launcherStdoutWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.written = true
+	}
+	return w.writer.Write(p)
+}
+
+// Forwards stderr as it is written and records the first line that starts
+// with one of the prefixes. Only the current line is kept in memory.
+type launcherStderrWriter struct {
+	writer    io.Writer
+	prefixes  []string
+	line      []byte
+	errorLine string
+}
+
+func (w *launcherStderrWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			w.checkLine()
+			continue
+		}
+		if len(w.line) < maxLauncherErrorLineLength {
+			w.line = append(w.line, b)
+		}
+	}
+	return w.writer.Write(p)
+}
+
+func (w *launcherStderrWriter) flush() {
+	w.checkLine()
+}
+
+func (w *launcherStderrWriter) checkLine() {
+	line := stripANSIEscapes(string(w.line))
+	w.line = w.line[:0]
+	if w.errorLine != "" {
+		return
+	}
+	for _, prefix := range w.prefixes {
+		if strings.HasPrefix(line, prefix) {
+			w.errorLine = line
+			return
+		}
+	}
+}
+
+func logLauncherFallback(env env, cfg *config, data *launcherFallbackJSONData) error {
+	if cfg.launcherLogDir == "" {
+		return nil
+	}
+	// The log dir is shared by all users, see disable_werror_flag.go.
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
+	if err := env.fs().mkdirAll(cfg.launcherLogDir, 0777); err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating launcher log directory %s", cfg.launcherLogDir)
+	}
+	logFile, err := env.fs().tempFile(cfg.launcherLogDir, "launcher_fallback*.json")
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating launcher log file")
+	}
+	if err := json.NewEncoder(logFile).Encode(data); err != nil {
+		_ = logFile.Close()
+		return wrapErrorwithSourceLocf(err, "error writing launcher log")
+	}
+	if err := logFile.Close(); err != nil {
+		return wrapErrorwithSourceLocf(err, "error closing launcher log")
+	}
+	return nil
+}
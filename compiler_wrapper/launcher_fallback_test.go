@@ -0,0 +1,218 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRetryWithoutMissingCCache(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				if err := verifyPath(cmd, "/usr/bin/ccache"); err != nil {
+					return err
+				}
+				return syscall.ENOENT
+			case 2:
+				if err := verifyPath(cmd, gccX86_64+".real"); err != nil {
+					return err
+				}
+				return verifyArgOrder(cmd, mainCc)
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+		if !strings.Contains(ctx.stderrString(), "ccache not found, retrying without it") {
+			t.Errorf("missing warning. Got: %s", ctx.stderrString())
+		}
+		data := readLauncherFallbackLog(ctx)
+		if data.Launcher != "ccache" || data.Reason != "not found" || data.Command[0] != "/usr/bin/ccache" {
+			t.Errorf("unexpected log entry: %#v", data)
+		}
+	})
+}
+
+func TestRetryWithoutCCacheOnCacheError(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprintln(stderr, "ccache: error: Corrupt manifest")
+				return newExitCodeError(1)
+			case 2:
+				fmt.Fprint(stderr, "compilerwarning")
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		stderr := ctx.stderrString()
+		if !strings.Contains(stderr, "ccache failed with: ccache: error: Corrupt manifest") ||
+			!strings.HasSuffix(stderr, "compilerwarning") {
+			t.Errorf("unexpected stderr. Got: %s", stderr)
+		}
+	})
+}
+
+func TestRetryWithoutLauncherIfLogFails(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		// A file where the log directory should be, so that creating it fails.
+		ctx.writeFile(ctx.cfg.launcherLogDir, "")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 1 {
+				return syscall.ENOENT
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestForwardCrashOfLauncher(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		gomaPath := path.Join(ctx.tempDir, "gomacc")
+		ctx.writeFile(gomaPath, "")
+		ctx.env = []string{"GOMACC_PATH=" + gomaPath}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			return newSignalError()
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc))
+		if exitCode >= 0 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestNoRetryAfterLauncherWroteToStdout(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stdout, "somepreprocessedcode")
+			fmt.Fprintln(stderr, "ccache: error: Corrupt manifest")
+			return newExitCodeError(1)
+		}
+		ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, "-E", mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+		if ctx.stdoutString() != "somepreprocessedcode" {
+			t.Errorf("unexpected stdout. Got: %s", ctx.stdoutString())
+		}
+	})
+}
+
+func TestForwardCompilerErrorWithLauncher(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stdout, "somemessage")
+			fmt.Fprint(stderr, "main.cc:1:1: error: someerror")
+			return newExitCodeError(1)
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc))
+		if exitCode != 1 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+		if ctx.stdoutString() != "somemessage" || ctx.stderrString() != "main.cc:1:1: error: someerror" {
+			t.Errorf("unexpected output. Got stdout: %s, stderr: %s", ctx.stdoutString(), ctx.stderrString())
+		}
+	})
+}
+
+func TestRetryWithoutLauncherPassesStdin(t *testing.T) {
+	withLauncherFallbackTestContext(t, func(ctx *testContext) {
+		ctx.stdinBuffer.WriteString("someinput")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			input, err := ioutil.ReadAll(stdin)
+			if err != nil {
+				return err
+			}
+			if string(input) != "someinput" {
+				return fmt.Errorf("unexpected stdin in call %d: %s", ctx.cmdCount, input)
+			}
+			if ctx.cmdCount == 1 {
+				fmt.Fprintln(stderr, "ccache: FATAL: somefailure")
+				return newExitCodeError(1)
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, "-x", "c", "-")))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestNoLauncherFallbackWithStrictLaunchers(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		ctx.cfg.strictLaunchers = true
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprintln(stderr, "ccache: error: Corrupt manifest")
+			return newExitCodeError(1)
+		}
+		ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(gccX86_64, mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+		if files, err := ioutil.ReadDir(ctx.cfg.launcherLogDir); err == nil {
+			t.Errorf("unexpected log files: %s", files)
+		}
+	})
+}
+
+func withLauncherFallbackTestContext(t *testing.T, work func(ctx *testContext)) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		work(ctx)
+	})
+}
+
+func newSignalError() error {
+	// Using a real command, see newExitCodeError.
+	return exec.Command("/bin/sh", "-c", "kill -SEGV $$").Run()
+}
+
+func readLauncherFallbackLog(ctx *testContext) *launcherFallbackJSONData {
+	files, err := ioutil.ReadDir(ctx.cfg.launcherLogDir)
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	if len(files) != 1 {
+		ctx.t.Fatalf("expected 1 launcher log file. Got: %s", files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.cfg.launcherLogDir, files[0].Name()))
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	jsonData := &launcherFallbackJSONData{}
+	if err := json.Unmarshal(data, jsonData); err != nil {
+		ctx.t.Fatal(err)
+	}
+	return jsonData
+}
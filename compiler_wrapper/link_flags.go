@@ -0,0 +1,196 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Settings that only apply when the compiler invokes the linker.
+// Empty values leave the linker defaults alone.
+type linkPolicy struct {
+	// Value for -Wl,--build-id=, e.g. "sha1".
+	buildID string
+	// Value for -Wl,--hash-style=, e.g. "gnu".
+	hashStyle string
+	// Value for -Wl,--icf=, e.g. "all". Only used with lld and gold.
+	icf        string
+	gcSections bool
+	// Value for -Wl,--compress-debug-sections=, e.g. "zlib".
+	compressDebugSections string
+	// Maximum number of parallel LTO jobs. 0 means no limit.
+	ltoJobs int
+}
+
+// Adds the flags of the link policy of the config. The flags are added
+// before the user flags, and are skipped if the user passes a flag for the
+// same setting.
+func processLinkFlags(builder *commandBuilder) {
+	inv := builder.invocation
+	if inv.action != linkAction || len(inv.inputs) == 0 {
+		return
+	}
+	policy := builder.cfg.linkPolicy
+	userHas := func(prefixes ...string) bool {
+		return hasUserArgWithPrefix(builder, prefixes)
+	}
+	flags := []string{}
+	if policy.buildID != "" && !userHas("-Wl,--build-id", "-Wl,--no-build-id") {
+		flags = append(flags, "-Wl,--build-id="+policy.buildID)
+	}
+	if policy.hashStyle != "" && !userHas("-Wl,--hash-style") {
+		flags = append(flags, "-Wl,--hash-style="+policy.hashStyle)
+	}
+	if linker := getSelectedLinker(builder); policy.icf != "" && (linker == "lld" || linker == "gold") &&
+		!userHas("-Wl,--icf") {
+		flags = append(flags, "-Wl,--icf="+policy.icf)
+	}
+	// --gc-sections can't be used together with -r.
+	if policy.gcSections && !inv.relocatable && !userHas("-Wl,--gc-sections", "-Wl,--no-gc-sections") {
+		flags = append(flags, "-Wl,--gc-sections")
+	}
+	if policy.compressDebugSections != "" && !userHas("-Wl,--compress-debug-sections") {
+		flags = append(flags, "-Wl,--compress-debug-sections="+policy.compressDebugSections)
+	}
+	builder.addPreUserArgs(flags...)
+
+	if policy.ltoJobs > 0 {
+		ltoJobs := strconv.Itoa(policy.ltoJobs)
+		switch builder.target.compilerType {
+		case clangType:
+			if hasLtoArg(builder) && !userHas("-flto-jobs=") {
+				builder.addPreUserArgs("-flto-jobs=" + ltoJobs)
+			}
+		case gccType:
+			// -flto=N also enables LTO, so only replace plain -flto.
+			builder.transformArgs(func(arg builderArg) string {
+				if arg.value == "-flto" {
+					return "-flto=" + ltoJobs
+				}
+				return arg.value
+			})
+		}
+	}
+}
+
+func hasLtoArg(builder *commandBuilder) bool {
+	lto := false
+	for _, arg := range builder.args {
+		if arg.value == "-flto" || strings.HasPrefix(arg.value, "-flto=") {
+			lto = true
+		} else if arg.value == "-fno-lto" {
+			lto = false
+		}
+	}
+	return lto
+}
+
+// Returns the name of the linker given via -fuse-ld=, or "ld"
+// for the default linker.
+func getSelectedLinker(builder *commandBuilder) string {
+	if linker := builder.invocation.fuseLd; linker != "" {
+		return linker
+	}
+	return "ld"
+}
+
+func processPrintLinkerFlag(builder *commandBuilder) (printLinker bool) {
+	builder.transformArgs(func(arg builderArg) string {
+		if arg.value == "-print-linker" {
+			printLinker = true
+			return ""
+		}
+		return arg.value
+	})
+	return printLinker
+}
+
+// Warns if the linker selected via -fuse-ld= can't be found, e.g. if
+// -fuse-ld=lld comes from clangFlags but neither the -B directory from
+// getLinkerPath nor PATH contain ld.lld. Runs for every link step.
+func checkLinkerFlags(builder *commandBuilder) {
+	inv := builder.invocation
+	if inv.action != linkAction || inv.fuseLd == "" || filepath.IsAbs(inv.fuseLd) || len(inv.prefixDirs) == 0 {
+		return
+	}
+	if path, _ := findSelectedLinker(builder); path != "" {
+		return
+	}
+	// Without PATH, we can't tell where the compiler will look.
+	if pathEnv, _ := builder.env.getenv("PATH"); pathEnv == "" {
+		return
+	}
+	fmt.Fprintf(builder.env.stderr(), "warning: -fuse-ld=%s: none of %s found in -B %s or PATH\n", inv.fuseLd,
+		strings.Join(getLinkerCandidates(builder), ", "), strings.Join(inv.prefixDirs, " "))
+}
+
+// Returns the names that the compiler looks for to find the selected linker.
+func getLinkerCandidates(builder *commandBuilder) []string {
+	linker := getSelectedLinker(builder)
+	if filepath.IsAbs(linker) {
+		return []string{linker}
+	}
+	name := "ld"
+	if linker != "ld" {
+		name = "ld." + linker
+	}
+	return []string{builder.target.target + "-" + name, name}
+}
+
+// Returns the path of the selected linker, searching the -B directories
+// first and then PATH, like the compiler does. Returns "" if the linker
+// was not found.
+func findSelectedLinker(builder *commandBuilder) (linkerPath string, inPrefixDir bool) {
+	candidates := getLinkerCandidates(builder)
+	if filepath.IsAbs(getSelectedLinker(builder)) {
+		if fileExists(builder.env, candidates[0]) {
+			return candidates[0], false
+		}
+		return "", false
+	}
+	for _, dir := range builder.invocation.prefixDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(builder.env.getwd(), dir)
+		}
+		for _, candidate := range candidates {
+			if p := filepath.Join(dir, candidate); fileExists(builder.env, p) {
+				return p, true
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if p, err := resolveAgainstPathEnv(builder.env, candidate); err == nil {
+			return p, false
+		}
+	}
+	return "", false
+}
+
+// Prints the linker the compiler will use and where it was found.
+func printLinkerReport(builder *commandBuilder) {
+	stderr := builder.env.stderr()
+	if builder.invocation.action != linkAction {
+		fmt.Fprintf(stderr, "wrapper linker: none (%s step)\n", builder.invocation.action)
+		return
+	}
+	linkerPath, inPrefixDir := findSelectedLinker(builder)
+	switch {
+	case linkerPath == "":
+		linkerPath = "(not found)"
+	case inPrefixDir:
+		linkerPath += " (from -B)"
+	default:
+		linkerPath += " (from PATH)"
+	}
+	fmt.Fprintf(stderr, "wrapper linker: %s %s\n", getSelectedLinker(builder), linkerPath)
+}
+
+func fileExists(env env, p string) bool {
+	_, err := env.fs().stat(p)
+	return err == nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddLinkPolicyFlagsForLinkSteps(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-fuse-ld=lld"}
+		ctx.cfg.linkPolicy = linkPolicy{
+			buildID:               "sha1",
+			hashStyle:             "gnu",
+			icf:                   "all",
+			gcSections:            true,
+			compressDebugSections: "zlib",
+		}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o", "-o", "main")))
+		if err := verifyArgOrder(cmd, "-Wl,--build-id=sha1", "-Wl,--hash-style=gnu", "-Wl,--icf=all",
+			"-Wl,--gc-sections", "-Wl,--compress-debug-sections=zlib", "main.o"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOmitLinkPolicyFlagsForCompileSteps(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.linkPolicy = linkPolicy{buildID: "sha1", gcSections: true}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-Wl,.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUserFlagsOverrideLinkPolicy(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.linkPolicy = linkPolicy{buildID: "sha1", gcSections: true}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-Wl,--build-id=md5", "-r", "main.o")))
+		if err := verifyArgCount(cmd, 0, "-Wl,--build-id=sha1|-Wl,--gc-sections"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOmitIcfForDefaultLinker(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.linkPolicy = linkPolicy{icf: "all"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "main.o")))
+		if err := verifyArgCount(cmd, 0, "-Wl,--icf=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestLimitLtoJobs(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.linkPolicy = linkPolicy{ltoJobs: 4}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-flto", "main.o")))
+		if err := verifyArgCount(cmd, 1, "-flto-jobs=4"); err != nil {
+			t.Error(err)
+		}
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-flto", "main.o")))
+		if err := verifyArgOrder(cmd, "-flto=4", "main.o"); err != nil {
+			t.Error(err)
+		}
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o")))
+		if err := verifyArgCount(cmd, 0, "-flto-jobs=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPrintLinkerReport(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-fuse-ld=lld"}
+		ctx.writeFile(filepath.Join(ctx.tempDir, "path", "ld.lld"), "")
+		ctx.env = append(ctx.env, "PATH="+filepath.Join(ctx.tempDir, "path"))
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-linker", "main.o")))
+		if err := verifyArgCount(cmd, 0, "-print-linker"); err != nil {
+			t.Error(err)
+		}
+		stderr := ctx.stderrString()
+		if strings.Contains(stderr, "warning") {
+			t.Errorf("unexpected warning. Got: %s", stderr)
+		}
+		if !strings.Contains(stderr, "wrapper linker: lld "+filepath.Join(ctx.tempDir, "path", "ld.lld")+" (from PATH)") {
+			t.Errorf("missing linker report. Got: %s", stderr)
+		}
+	})
+}
+
+func TestWarnForMissingLinkerOnEveryLink(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-fuse-ld=lld"}
+		ctx.writeFile(filepath.Join(ctx.tempDir, "path", "ld"), "")
+		ctx.env = append(ctx.env, "PATH="+filepath.Join(ctx.tempDir, "path"))
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o")))
+		stderr := ctx.stderrString()
+		if !strings.Contains(stderr, "warning: -fuse-ld=lld: none of x86_64-cros-linux-gnu-ld.lld, ld.lld found in -B") ||
+			!strings.HasSuffix(strings.TrimSpace(stderr), "or PATH") {
+			t.Errorf("missing linker warning. Got: %s", stderr)
+		}
+		if strings.Contains(stderr, "wrapper linker:") {
+			t.Errorf("unexpected linker report. Got: %s", stderr)
+		}
+	})
+}
+
+func TestNoLinkerWarningForCompileSteps(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-fuse-ld=lld"}
+		ctx.env = append(ctx.env, "PATH="+filepath.Join(ctx.tempDir, "path"))
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if stderr := ctx.stderrString(); stderr != "" {
+			t.Errorf("unexpected stderr. Got: %s", stderr)
+		}
+	})
+}
+
+func TestPrintLinkerReportFindsLinkerInPrefixDir(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		linkerDir := filepath.Join(ctx.tempDir, "linker")
+		ctx.writeFile(filepath.Join(linkerDir, "x86_64-cros-linux-gnu-ld.lld"), "")
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-linker", "-fuse-ld=lld", "-B"+linkerDir, "main.o")))
+		if stderr := ctx.stderrString(); strings.Contains(stderr, "warning") ||
+			!strings.Contains(stderr, "wrapper linker: lld "+filepath.Join(linkerDir, "x86_64-cros-linux-gnu-ld.lld")) {
+			t.Errorf("unexpected linker report. Got: %s", stderr)
+		}
+	})
+}
+
+func TestPrintLinkerReportForCompileStep(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-linker", "-c", mainCc)))
+		if !strings.Contains(ctx.stderrString(), "wrapper linker: none (assemble step)") {
+			t.Errorf("unexpected linker report. Got: %s", ctx.stderrString())
+		}
+	})
+}
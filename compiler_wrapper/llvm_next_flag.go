@@ -0,0 +1,57 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const useLlvmNextKey = "USE_LLVM_NEXT"
+const llvmNextPackagesKey = "LLVM_NEXT_PACKAGES"
+
+// Returns the config to use for this invocation. If llvm-next was selected,
+// either via the UseLlvmNext linker flag or at runtime via USE_LLVM_NEXT
+// or LLVM_NEXT_PACKAGES, the returned config contains the llvm-next flags.
+func selectLlvmNext(env env, cfg *config) (*config, error) {
+	useLlvmNext, err := shouldUseLlvmNext(env, cfg.useLlvmNext)
+	if err != nil {
+		return nil, err
+	}
+	if !useLlvmNext && !cfg.useLlvmNext {
+		return cfg, nil
+	}
+	newCfg := *cfg
+	newCfg.useLlvmNext = useLlvmNext
+	if cfg.useLlvmNext {
+		// Wrappers built with UseLlvmNext are installed with llvm-next
+		// in place of llvm.
+		newCfg.llvmNextClangRelDir = ""
+	}
+	if useLlvmNext {
+		newCfg.clangFlags = append(append([]string{}, cfg.clangFlags...), llvmNextFlags...)
+		newCfg.clangPostFlags = append(append([]string{}, cfg.clangPostFlags...), llvmNextPostFlags...)
+	}
+	return &newCfg, nil
+}
+
+func shouldUseLlvmNext(env env, defaultValue bool) (bool, error) {
+	if value, _ := env.getenv(useLlvmNextKey); value != "" {
+		useLlvmNext, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, newUserErrorf("invalid value for %s: %q", useLlvmNextKey, value)
+		}
+		return useLlvmNext, nil
+	}
+	if packages, _ := env.getenv(llvmNextPackagesKey); packages != "" {
+		pkg := getPackageIdentity(env)
+		for _, pattern := range strings.Fields(packages) {
+			if pkg.matches(pattern) {
+				return true, nil
+			}
+		}
+	}
+	return defaultValue, nil
+}
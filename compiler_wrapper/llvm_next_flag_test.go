@@ -0,0 +1,161 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUseLlvmNextFromConfigByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useLlvmNext = true
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.useLlvmNext {
+			t.Error("expected llvm-next to be used")
+		}
+	})
+}
+
+func TestSelectLlvmNextViaEnv(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"USE_LLVM_NEXT=true"}
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.useLlvmNext {
+			t.Error("expected llvm-next to be used")
+		}
+		if ctx.cfg.useLlvmNext {
+			t.Error("expected the original config to be unchanged")
+		}
+	})
+}
+
+func TestDeselectLlvmNextViaEnv(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useLlvmNext = true
+		ctx.env = []string{"USE_LLVM_NEXT=false"}
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.useLlvmNext {
+			t.Error("expected llvm-next not to be used")
+		}
+	})
+}
+
+func TestSelectLlvmNextViaPackageList(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"LLVM_NEXT_PACKAGES=sys-libs/foo chromeos-base/bar",
+			"CATEGORY=chromeos-base",
+			"PN=bar",
+		}
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.useLlvmNext {
+			t.Error("expected llvm-next to be used")
+		}
+	})
+}
+
+func TestSelectLlvmNextViaPackageListWithoutCategory(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"LLVM_NEXT_PACKAGES=bar",
+			"CATEGORY=chromeos-base",
+			"PN=bar",
+		}
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.useLlvmNext {
+			t.Error("expected llvm-next to be used")
+		}
+	})
+}
+
+func TestIgnoreLlvmNextPackageListForOtherPackages(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"LLVM_NEXT_PACKAGES=sys-libs/foo",
+			"CATEGORY=chromeos-base",
+			"PN=foo",
+		}
+		cfg, err := selectLlvmNext(ctx, ctx.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.useLlvmNext {
+			t.Error("expected llvm-next not to be used")
+		}
+	})
+}
+
+func TestReportErrorForInvalidUseLlvmNextValue(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"USE_LLVM_NEXT=invalid"}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid value for USE_LLVM_NEXT: "invalid"`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseLlvmNextClangDir(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.llvmNextClangRelDir = "usr/llvm-next/bin"
+		ctx.env = []string{"USE_LLVM_NEXT=true"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, "usr/llvm-next/bin/clang"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIgnoreLlvmNextClangDirWithoutLlvmNext(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.llvmNextClangRelDir = "usr/llvm-next/bin"
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, "usr/bin/clang"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIgnoreLlvmNextClangDirIfBuiltWithLlvmNext(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useLlvmNext = true
+		ctx.cfg.llvmNextClangRelDir = "usr/llvm-next/bin"
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, "usr/bin/clang"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPrintConfigShowsLlvmNext(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"USE_LLVM_NEXT=true"}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-config", mainCc)))
+		if !strings.Contains(ctx.stderrString(), "useLlvmNext:true") {
+			t.Errorf("llvm-next selection not printed. Got: %s", ctx.stderrString())
+		}
+	})
+}
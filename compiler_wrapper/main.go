@@ -6,6 +6,8 @@
 // - main.UseCCache: Whether to use ccache.
 // - main.ConfigName: Name of the configuration to use.
 //   See config.go for the supported values.
+// The linker variables are defaults. The config can also be selected
+// by the name the binary is installed under, see config_select.go.
 //
 // The script ./build simplifies the call to `go build`.
 // E.g. ./build --use_ccache=true --config=cros.hardened will build a
@@ -15,6 +17,9 @@
 // - updategolden: To update the golden results for the wrapper. Without it,
 //   the tests will verify that the wrapper output matches the goldens.
 // - rungolden: To filter the golden tests by a regex for the wrapper env, path and args.
+// - replaybinary, replaygolden, replayconfig: To replay the golden files against a
+//   built wrapper binary, using the test binary as fake compiler.
+//   ./replay_goldens.py wraps this to check a built binary.
 //
 // Examples:
 // - run all tests in isolation:
@@ -31,12 +36,13 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg, err := getRealConfig()
+	inputCmd := newProcessCommand()
+	cfg, err := selectRealConfig(env, inputCmd)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Note: callCompiler will exec the command. Only in case of
 	// an error or when we run other commands like bisect
 	// will this os.Exit be called.
-	os.Exit(callCompiler(env, cfg, newProcessCommand()))
+	os.Exit(callCompiler(env, cfg, inputCmd))
 }
@@ -0,0 +1,678 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// An in-memory file system for tests. Relative paths are
+// relative to "/".
+type memFileSystem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	// Path of a locked file -> the open file that holds the lock.
+	locks     map[string]*memFile
+	tempCount int
+	// Applied to the modes of new files and directories.
+	mask int
+}
+
+type memNode struct {
+	data []byte
+	// Includes os.ModeDir / os.ModeSymlink.
+	mode    os.FileMode
+	target  string
+	modTime time.Time
+}
+
+var _ fileSystem = (*memFileSystem)(nil)
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{
+		nodes: map[string]*memNode{
+			"/": {mode: os.ModeDir | 0777, modTime: time.Now()},
+		},
+		locks: map[string]*memFile{},
+	}
+}
+
+// Resolves the symlinks in all path components. The last component is
+// only followed if followLast is true. The resolved path does not need
+// to exist, but its parent does.
+func (fs *memFileSystem) resolve(op string, name string, followLast bool) (string, error) {
+	return fs.resolveWithDepth(op, name, followLast, 0)
+}
+
+func (fs *memFileSystem) resolveWithDepth(op string, name string, followLast bool, depth int) (string, error) {
+	if depth > 40 {
+		return "", &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+	}
+	elems := strings.Split(strings.TrimPrefix(filepath.Join("/", name), "/"), "/")
+	current := "/"
+	for i, elem := range elems {
+		if elem == "" {
+			continue
+		}
+		isLast := i == len(elems)-1
+		current = filepath.Join(current, elem)
+		node := fs.nodes[current]
+		if node == nil {
+			if isLast {
+				return current, nil
+			}
+			return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if node.mode&os.ModeSymlink != 0 && (!isLast || followLast) {
+			target := node.target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(current), target)
+			}
+			resolved, err := fs.resolveWithDepth(op, target, true, depth+1)
+			if err != nil {
+				return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+			}
+			current = resolved
+			node = fs.nodes[current]
+		}
+		if !isLast && (node == nil || !node.mode.IsDir()) {
+			return "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return current, nil
+}
+
+func (fs *memFileSystem) lookup(op string, name string, followLast bool) (string, *memNode, error) {
+	p, err := fs.resolve(op, name, followLast)
+	if err != nil {
+		return "", nil, err
+	}
+	node := fs.nodes[p]
+	if node == nil {
+		return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return p, node, nil
+}
+
+// Checks that a new entry can be created at the resolved path p.
+func (fs *memFileSystem) checkCreate(op string, name string, p string) error {
+	parent := fs.nodes[filepath.Dir(p)]
+	if parent == nil {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	if parent.mode&0200 == 0 {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, node, err := fs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newMemFileInfo(p, node), nil
+}
+
+func (fs *memFileSystem) lstat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, node, err := fs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newMemFileInfo(p, node), nil
+}
+
+func (fs *memFileSystem) readlink(name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, node, err := fs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return node.target, nil
+}
+
+func (fs *memFileSystem) evalSymlinks(path string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, _, err := fs.lookup("lstat", path, true)
+	return p, err
+}
+
+func (fs *memFileSystem) readFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, node, err := fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte{}, node.data...), nil
+}
+
+func (fs *memFileSystem) readDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, node, err := fs.lookup("open", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	infos := []os.FileInfo{}
+	for p, child := range fs.nodes {
+		if p != dir && filepath.Dir(p) == dir {
+			infos = append(infos, newMemFileInfo(p, child))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *memFileSystem) mkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdirAllLocked(path, perm)
+}
+
+func (fs *memFileSystem) mkdirAllLocked(path string, perm os.FileMode) error {
+	p, err := fs.resolve("mkdir", path, true)
+	if err != nil {
+		parent := filepath.Dir(filepath.Join("/", path))
+		if err := fs.mkdirAllLocked(parent, perm); err != nil {
+			return err
+		}
+		if p, err = fs.resolve("mkdir", path, true); err != nil {
+			return err
+		}
+	}
+	if node := fs.nodes[p]; node != nil {
+		if !node.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if fs.nodes[filepath.Dir(p)] == nil {
+		if err := fs.mkdirAllLocked(filepath.Dir(p), perm); err != nil {
+			return err
+		}
+	}
+	if err := fs.checkCreate("mkdir", path, p); err != nil {
+		return err
+	}
+	fs.nodes[p] = &memNode{mode: os.ModeDir | perm&^os.FileMode(fs.mask), modTime: time.Now()}
+	return nil
+}
+
+func (fs *memFileSystem) openFile(name string, flag int, perm os.FileMode) (file, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, err := fs.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	node := fs.nodes[p]
+	switch {
+	case node != nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case node != nil && node.mode.IsDir() && writable:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case node != nil && writable && node.mode&0200 == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	case node == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case node == nil:
+		if err := fs.checkCreate("open", name, p); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm &^ os.FileMode(fs.mask), modTime: time.Now()}
+		fs.nodes[p] = node
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		node.data = nil
+	}
+	return &memFile{fs: fs, name: name, path: p, node: node, flag: flag}, nil
+}
+
+func (fs *memFileSystem) tempFile(dir string, pattern string) (file, error) {
+	for {
+		f, err := fs.openFile(fs.nextTempName(dir, pattern), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+func (fs *memFileSystem) tempDir(dir string, pattern string) (string, error) {
+	for {
+		name := fs.nextTempName(dir, pattern)
+		if _, err := fs.lstat(name); os.IsNotExist(err) {
+			return name, fs.mkdirAll(name, 0700)
+		}
+	}
+}
+
+func (fs *memFileSystem) nextTempName(dir string, pattern string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	fs.tempCount++
+	random := fmt.Sprint(fs.tempCount)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return filepath.Join(dir, pattern[:i]+random+pattern[i+1:])
+	}
+	return filepath.Join(dir, pattern+random)
+}
+
+func (fs *memFileSystem) rename(oldpath string, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldResolved, _, err := fs.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	newResolved, err := fs.resolve("rename", newpath, false)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkCreate("rename", newpath, newResolved); err != nil {
+		return err
+	}
+	for p, node := range fs.nodes {
+		if p == oldResolved || strings.HasPrefix(p, oldResolved+"/") {
+			delete(fs.nodes, p)
+			fs.nodes[newResolved+strings.TrimPrefix(p, oldResolved)] = node
+		}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) removeAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, err := fs.resolve("removeall", path, false)
+	if err != nil {
+		return nil
+	}
+	for nodePath := range fs.nodes {
+		if nodePath == p || strings.HasPrefix(nodePath, p+"/") {
+			delete(fs.nodes, nodePath)
+		}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) umask(mask int) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldMask := fs.mask
+	fs.mask = mask
+	return oldMask
+}
+
+func (fs *memFileSystem) getuid() int {
+	return os.Getuid()
+}
+
+func (fs *memFileSystem) tryLock(f file) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	memFile, ok := f.(*memFile)
+	if !ok || memFile.fs != fs {
+		return fmt.Errorf("%s is not a file of the in-memory file system", f.Name())
+	}
+	if holder := fs.locks[memFile.path]; holder != nil && holder != memFile {
+		return syscall.EAGAIN
+	}
+	fs.locks[memFile.path] = memFile
+	return nil
+}
+
+// Test helpers that fail the test on errors.
+
+func (fs *memFileSystem) writeFile(t *testing.T, name string, content string, perm os.FileMode) {
+	if err := fs.mkdirAll(filepath.Dir(filepath.Join("/", name)), 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.openFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (fs *memFileSystem) symlink(t *testing.T, oldname string, newname string) {
+	if err := fs.mkdirAll(filepath.Dir(filepath.Join("/", newname)), 0777); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, err := fs.resolve("symlink", newname, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.nodes[p] != nil {
+		t.Fatalf("symlink %s: file exists", newname)
+	}
+	fs.nodes[p] = &memNode{mode: os.ModeSymlink | 0777, target: oldname, modTime: time.Now()}
+}
+
+func (fs *memFileSystem) chmod(t *testing.T, name string, perm os.FileMode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, node, err := fs.lookup("chmod", name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.mode = node.mode&os.ModeType | perm
+}
+
+func (fs *memFileSystem) readFileString(t *testing.T, name string) string {
+	data, err := fs.readFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Returns the paths of all files and symlinks, sorted.
+func (fs *memFileSystem) files() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	files := []string{}
+	for p, node := range fs.nodes {
+		if !node.mode.IsDir() {
+			files = append(files, p)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+type memFile struct {
+	fs     *memFileSystem
+	name   string
+	path   string
+	node   *memNode
+	flag   int
+	offset int
+	closed bool
+}
+
+var _ file = (*memFile)(nil)
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.offset >= len(f.node.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = len(f.node.data)
+	}
+	end := f.offset + len(p)
+	if end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.fs.locks[f.path] == f {
+		delete(f.fs.locks, f.path)
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return newMemFileInfo(f.path, f.node), nil
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.mode = f.node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFileInfo(p string, node *memNode) *memFileInfo {
+	return &memFileInfo{
+		name:    filepath.Base(p),
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.modTime,
+	}
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) Mode() os.FileMode  { return info.mode }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *memFileInfo) Sys() interface{}   { return nil }
+
+func TestMemFileSystemSymlinks(t *testing.T) {
+	fs := newMemFileSystem()
+	fs.writeFile(t, "/a/real", "content", 0777)
+	fs.symlink(t, "real", "/a/link1")
+	fs.symlink(t, "/a/link1", "/b/link2")
+	fs.symlink(t, "/a/missing", "/b/broken")
+
+	if p, err := fs.evalSymlinks("/b/link2"); err != nil || p != "/a/real" {
+		t.Errorf("unexpected evalSymlinks result: %s, %v", p, err)
+	}
+	if target, err := fs.readlink("/b/link2"); err != nil || target != "/a/link1" {
+		t.Errorf("unexpected readlink result: %s, %v", target, err)
+	}
+	if content := fs.readFileString(t, "/b/link2"); content != "content" {
+		t.Errorf("unexpected content: %s", content)
+	}
+	if info, err := fs.lstat("/b/broken"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("unexpected lstat result for broken symlink: %v, %v", info, err)
+	}
+	if _, err := fs.stat("/b/broken"); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error for broken symlink. Got: %v", err)
+	}
+	if _, err := fs.evalSymlinks("/b/broken"); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error for broken symlink. Got: %v", err)
+	}
+}
+
+func TestMemFileSystemFiles(t *testing.T) {
+	fs := newMemFileSystem()
+	if err := fs.mkdirAll("/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.tempFile("/dir", "file*.incomplete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "hello")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.rename(f.Name(), "/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile, err := fs.openFile("/dir/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(appendFile, " world")
+	appendFile.Close()
+	if content := fs.readFileString(t, "/dir/file"); content != "hello world" {
+		t.Errorf("unexpected content: %s", content)
+	}
+	if files := fs.files(); len(files) != 1 || files[0] != "/dir/file" {
+		t.Errorf("unexpected files: %s", files)
+	}
+
+	fs.chmod(t, "/dir", 0555)
+	if _, err := fs.tempFile("/dir", "other"); !os.IsPermission(err) {
+		t.Errorf("expected a permission error for read only dir. Got: %v", err)
+	}
+	if _, err := fs.openFile("/missing/file", os.O_WRONLY|os.O_CREATE, 0666); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error for missing dir. Got: %v", err)
+	}
+}
+
+func TestMemFileSystemLocks(t *testing.T) {
+	fs := newMemFileSystem()
+	first, err := fs.openFile("/file", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fs.openFile("/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.tryLock(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.tryLock(second); err != syscall.EAGAIN {
+		t.Errorf("expected EAGAIN for locked file. Got: %v", err)
+	}
+	first.Close()
+	if err := fs.tryLock(second); err != nil {
+		t.Errorf("expected lock to be released on close. Got: %v", err)
+	}
+}
+
+func TestMemFileSystemMasksNewFiles(t *testing.T) {
+	fs := newMemFileSystem()
+	fs.umask(022)
+	if err := fs.mkdirAll("/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.openFile("/dir/file", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for p, perm := range map[string]os.FileMode{"/dir": 0755, "/dir/file": 0644} {
+		info, err := fs.stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Errorf("unexpected mode of %s. Got: %v", p, info.Mode())
+		}
+	}
+}
+
+// The log and report dirs are shared by all users. They have to be created
+// with the umask of the env's file system, not of the process.
+func TestLogDirsUseUmaskOfFileSystem(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		memfs := ctx.useMemFileSystem()
+		memfs.umask(022)
+		inputCmd := &command{Path: "clang"}
+		logDirs := map[string]func() error{
+			ctx.cfg.newWarningsDir: func() error {
+				return writeWarningsReport(ctx, ctx.cfg.newWarningsDir, "warnings_report*.json", &warningsJSONData{})
+			},
+			ctx.cfg.errorReportDir: func() error {
+				_, err := writeErrorReport(ctx, ctx.cfg, inputCmd, newErrorwithSourceLocf("someerror"))
+				return err
+			},
+			ctx.cfg.flagAuditLogDir: func() error {
+				return logFlagAudit(ctx, ctx.cfg, &flagAuditJSONData{})
+			},
+			ctx.cfg.launcherLogDir: func() error {
+				return logLauncherFallback(ctx, ctx.cfg, &launcherFallbackJSONData{})
+			},
+			ctx.cfg.shadowCompilerLogDir: func() error {
+				return writeShadowCompilerReport(ctx, ctx.cfg.shadowCompilerLogDir, &shadowCompilerReport{})
+			},
+		}
+		for logDir, writeLog := range logDirs {
+			if err := writeLog(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := memfs.stat(logDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0777 {
+				t.Errorf("unexpected mode of %s. Got: %v", logDir, info.Mode())
+			}
+			if mask := memfs.umask(022); mask != 022 {
+				t.Errorf("umask not restored after writing to %s. Got: %o", logDir, mask)
+			}
+		}
+	})
+}
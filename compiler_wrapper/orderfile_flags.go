@@ -0,0 +1,126 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const orderfileModeKey = "ORDERFILE_MODE"
+const orderfileDirKey = "ORDERFILE_DIR"
+const orderfileTargetsKey = "ORDERFILE_TARGETS"
+
+const (
+	generateOrderfileMode = "generate"
+	useOrderfileMode      = "use"
+)
+
+// Adds the flags to generate or use orderfiles (clang only).
+//
+// ORDERFILE_TARGETS is a space separated list of globs for the names of the
+// linked binaries (e.g. "chrome libfoo.so*"), and defaults to all binaries.
+// In "generate" mode, all compile steps are instrumented, as we don't know
+// to which binary an object file will be linked. Link steps for the targets
+// get -forder-file-instrumentation, so that the profile runtime is linked in.
+// In "use" mode, link steps for the targets use <orderfile dir>/<name>.orderfile
+// if it exists.
+// Invocations that compile and link at once get the flags of both steps.
+func processOrderfileFlags(builder *commandBuilder) error {
+	mode, _ := builder.env.getenv(orderfileModeKey)
+	if mode == "" {
+		return nil
+	}
+	if mode != generateOrderfileMode && mode != useOrderfileMode {
+		return newUserErrorf("invalid value for %s: %q", orderfileModeKey, mode)
+	}
+	inv := builder.invocation
+	compiles := inv.action != linkAction || len(inv.sourceInputs()) > 0 || inv.readsStdin
+	if compiles {
+		switch mode {
+		case generateOrderfileMode:
+			builder.addPostUserArgs("-forder-file-instrumentation")
+		case useOrderfileMode:
+			// Symbol ordering only works for functions in their own sections.
+			if !hasUserArg(builder, "-fno-function-sections") {
+				builder.addPreUserArgs("-ffunction-sections")
+			}
+		}
+	}
+	if inv.action != linkAction {
+		return nil
+	}
+
+	targetName := getLinkOutputName(builder)
+	if !isOrderfileTarget(builder.env, targetName) {
+		return nil
+	}
+	switch mode {
+	case generateOrderfileMode:
+		if !compiles {
+			builder.addPostUserArgs("-forder-file-instrumentation")
+		}
+	case useOrderfileMode:
+		orderfileDir, _ := builder.env.getenv(orderfileDirKey)
+		if orderfileDir == "" {
+			if builder.cfg.orderfileDirRelPath == "" {
+				return nil
+			}
+			orderfileDir = filepath.Join(builder.rootPath, builder.cfg.orderfileDirRelPath)
+		}
+		orderfile := filepath.Join(orderfileDir, targetName+".orderfile")
+		if _, err := builder.env.fs().stat(orderfile); err != nil {
+			if os.IsNotExist(err) {
+				// Only warn if the target was requested explicitly.
+				if targets, _ := builder.env.getenv(orderfileTargetsKey); targets != "" {
+					fmt.Fprintf(builder.env.stderr(), "warning: no orderfile for %s: %s does not exist\n", targetName, orderfile)
+				}
+				return nil
+			}
+			return wrapErrorwithSourceLocf(err, "failed to stat orderfile %s", orderfile)
+		}
+		builder.addPostUserArgs("-Wl,--symbol-ordering-file=" + orderfile)
+		// Orderfiles usually contain symbols of other configurations
+		// of the binary as well, so don't warn about missing symbols
+		// unless the user explicitly asked for it.
+		if !hasUserArg(builder, "-Wl,--warn-symbol-ordering") {
+			builder.addPostUserArgs("-Wl,--no-warn-symbol-ordering")
+		}
+	}
+	return nil
+}
+
+func isOrderfileTarget(env env, targetName string) bool {
+	targets, _ := env.getenv(orderfileTargetsKey)
+	if targets == "" {
+		return true
+	}
+	for _, pattern := range strings.Fields(targets) {
+		if matched, _ := path.Match(pattern, targetName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the base name of the binary that is linked.
+func getLinkOutputName(builder *commandBuilder) string {
+	if output := builder.invocation.output; output != "" {
+		return filepath.Base(output)
+	}
+	return "a.out"
+}
+
+func hasUserArg(builder *commandBuilder, value string) bool {
+	for _, arg := range builder.args {
+		if arg.fromUser && arg.value == value {
+			return true
+		}
+	}
+	return false
+}
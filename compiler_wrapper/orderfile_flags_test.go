@@ -0,0 +1,139 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOmitOrderfileFlagsByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-forder-file-instrumentation|-ffunction-sections"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestInstrumentCompileStepsInGenerateOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=generate", "ORDERFILE_TARGETS=chrome")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if err := verifyArgOrder(cmd, mainCc, "-forder-file-instrumentation"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestInstrumentOnlyTargetLinksInGenerateOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=generate", "ORDERFILE_TARGETS=chrome")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o", "-o", "out/chrome")))
+		if err := verifyArgCount(cmd, 1, "-forder-file-instrumentation"); err != nil {
+			t.Error(err)
+		}
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o", "-o", "out/other")))
+		if err := verifyArgCount(cmd, 0, "-forder-file-instrumentation"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseOrderfileForLinkOutput(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		orderfile := filepath.Join(ctx.tempDir, "orderfiles", "chrome.orderfile")
+		ctx.writeFile(orderfile, "")
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=use", "ORDERFILE_DIR="+filepath.Dir(orderfile))
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o", "-o", "out/chrome")))
+		if err := verifyArgOrder(cmd, "main.o", "-Wl,--symbol-ordering-file="+orderfile,
+			"-Wl,--no-warn-symbol-ordering"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKeepWarnSymbolOrderingFlag(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		orderfile := filepath.Join(ctx.tempDir, "a.out.orderfile")
+		ctx.writeFile(orderfile, "")
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=use", "ORDERFILE_DIR="+ctx.tempDir)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-Wl,--warn-symbol-ordering", "main.o")))
+		if err := verifyArgCount(cmd, 1, "-Wl,--symbol-ordering-file=.*"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Wl,--no-warn-symbol-ordering"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddFunctionSectionsWhenCompilingAndLinkingInUseOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		orderfile := filepath.Join(ctx.tempDir, "foo.orderfile")
+		ctx.writeFile(orderfile, "")
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=use", "ORDERFILE_DIR="+ctx.tempDir)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "foo.c", "-o", "foo")))
+		if err := verifyArgOrder(cmd, "-ffunction-sections", "foo.c",
+			"-Wl,--symbol-ordering-file="+orderfile); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestInstrumentOnceWhenCompilingAndLinkingInGenerateOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=generate")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "foo.c", "-o", "foo")))
+		if err := verifyArgCount(cmd, 1, "-forder-file-instrumentation"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddFunctionSectionsInUseOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=use")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if err := verifyArgOrder(cmd, "-ffunction-sections", mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestWarnForMissingOrderfileOfExplicitTarget(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=use", "ORDERFILE_DIR="+ctx.tempDir, "ORDERFILE_TARGETS=chrome")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "main.o", "-o", "chrome")))
+		if err := verifyArgCount(cmd, 0, "-Wl,--symbol-ordering-file=.*"); err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(ctx.stderrString(), "warning: no orderfile for chrome") {
+			t.Errorf("missing warning. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestReportErrorForInvalidOrderfileMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "ORDERFILE_MODE=fancy")
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid value for ORDERFILE_MODE: "fancy"`); err != nil {
+			t.Error(err)
+		}
+	})
+}
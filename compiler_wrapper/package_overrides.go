@@ -0,0 +1,214 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const packageOverridesFileKey = "COMPILER_WRAPPER_PACKAGE_OVERRIDES"
+
+// Name of the Android module that is currently being built. Soong doesn't
+// pass the module name to the compiler, so the build has to export it
+// for the wrapper, like e.g. ANDROID_LLVM_PREBUILT_COMPILER_PATH.
+const androidModuleKey = "ANDROID_MODULE_NAME"
+
+// Identity of the package that is currently being built.
+type packageIdentity struct {
+	// Portage: $CATEGORY, $PN and $P.
+	category string
+	name     string
+	nameVer  string
+	// Android: name of the module that is currently being built.
+	androidModule string
+}
+
+func getPackageIdentity(env env) packageIdentity {
+	category, _ := env.getenv("CATEGORY")
+	pn, _ := env.getenv("PN")
+	p, _ := env.getenv("P")
+	androidModule, _ := env.getenv(androidModuleKey)
+	return packageIdentity{
+		category:      category,
+		name:          pn,
+		nameVer:       p,
+		androidModule: androidModule,
+	}
+}
+
+// Returns the package as category/pn or the android module name,
+// or "" if the package is unknown.
+func (id packageIdentity) String() string {
+	switch {
+	case id.category != "" && id.name != "":
+		return id.category + "/" + id.name
+	case id.name != "":
+		return id.name
+	default:
+		return id.androidModule
+	}
+}
+
+// Returns true if the given pattern matches the package.
+// Patterns can be given as `category/pn`, `category/p`, `pn` or an android
+// module name, and may contain shell globs, e.g. `dev-libs/*`.
+func (id packageIdentity) matches(pattern string) bool {
+	candidates := []string{}
+	if id.name != "" {
+		candidates = append(candidates, id.category+"/"+id.name, id.name)
+	}
+	if id.nameVer != "" {
+		candidates = append(candidates, id.category+"/"+id.nameVer)
+	}
+	if id.androidModule != "" {
+		candidates = append(candidates, id.androidModule)
+	}
+	for _, candidate := range candidates {
+		if matched, _ := path.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// A rule in the package overrides file. The first rule whose package
+// pattern matches the current package is used.
+type packageOverride struct {
+	Package string `json:"package"`
+	// Flags to add before / after the user flags. Like for source rules,
+	// user flags override pre_flags, and post_flags override user flags.
+	PreFlags  []string `json:"pre_flags,omitempty"`
+	PostFlags []string `json:"post_flags,omitempty"`
+	// Flags to remove, regardless of whether they come from
+	// the user or from the wrapper.
+	RemoveFlags []string `json:"remove_flags,omitempty"`
+	// Forces ccache, clang-tidy, and the -Wno-error retry of
+	// FORCE_DISABLE_WERROR on or off when set.
+	CCache      *bool `json:"ccache,omitempty"`
+	ClangTidy   *bool `json:"clang_tidy,omitempty"`
+	WErrorRetry *bool `json:"werror_retry,omitempty"`
+	// Forces the compiler to "gcc" or "clang" when set.
+	Compiler string `json:"compiler,omitempty"`
+}
+
+// Returns the matching override for the current package. If no rule matches,
+// an empty override is returned that does not change anything.
+func findPackageOverride(env env, cfg *config, rootPath string) (*packageOverride, error) {
+	overridesFile, _ := env.getenv(packageOverridesFileKey)
+	if overridesFile == "" {
+		if cfg.packageOverridesRelPath == "" {
+			return &packageOverride{}, nil
+		}
+		overridesFile = filepath.Join(rootPath, cfg.packageOverridesRelPath)
+	}
+	data, err := env.fs().readFile(overridesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &packageOverride{}, nil
+		}
+		return nil, wrapErrorwithSourceLocf(err, "failed to read package overrides %s", overridesFile)
+	}
+	overrides := []*packageOverride{}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, newUserErrorf("invalid package overrides file %s: %s", overridesFile, err)
+	}
+	pkg := getPackageIdentity(env)
+	for _, override := range overrides {
+		if override.Compiler != "" && override.Compiler != "gcc" && override.Compiler != "clang" {
+			return nil, newUserErrorf("invalid compiler %q for package %s in %s", override.Compiler, override.Package, overridesFile)
+		}
+		if pkg.matches(override.Package) {
+			return override, nil
+		}
+	}
+	return &packageOverride{}, nil
+}
+
+func (override *packageOverride) applyToConfig(cfg *config) *config {
+	if override.CCache == nil {
+		return cfg
+	}
+	newCfg := *cfg
+	newCfg.useCCache = *override.CCache
+	return &newCfg
+}
+
+func (override *packageOverride) useClangTidy(defaultValue bool) bool {
+	if override.ClangTidy == nil {
+		return defaultValue
+	}
+	return *override.ClangTidy
+}
+
+func (override *packageOverride) useWErrorRetry(defaultValue bool) bool {
+	if override.WErrorRetry == nil {
+		return defaultValue
+	}
+	return *override.WErrorRetry
+}
+
+func (override *packageOverride) applyCompiler(builder *commandBuilder) error {
+	if override.Compiler == "" {
+		return nil
+	}
+	if builder.target.compilerType == clangTidyType || builder.target.compilerType == rustcType {
+		return nil
+	}
+	if builder.cfg.isAndroidWrapper {
+		return newUserErrorf("forcing the compiler is not supported for android")
+	}
+	isCxx := strings.HasSuffix(builder.target.compiler, "++")
+	newCompiler := override.Compiler
+	switch {
+	case override.Compiler == "gcc" && isCxx:
+		newCompiler = "g++"
+	case override.Compiler == "clang" && isCxx:
+		newCompiler = "clang++"
+	}
+	if newCompiler == builder.target.compiler {
+		return nil
+	}
+	newBasename := newCompiler
+	if builder.target.target != "" {
+		newBasename = builder.target.target + "-" + newCompiler
+	}
+	builder.path = filepath.Join(filepath.Dir(builder.path), newBasename)
+	if !strings.ContainsRune(builder.path, filepath.Separator) {
+		// Keep relative invocations relative, so that e.g. the
+		// clang path is calculated the same way.
+		builder.path = "." + string(filepath.Separator) + builder.path
+	}
+	builder.target.compiler = newCompiler
+	if override.Compiler == "clang" {
+		builder.target.compilerType = clangType
+	} else {
+		builder.target.compilerType = gccType
+	}
+	return nil
+}
+
+// Removes and adds flags like a source rule, see source_rules.go.
+// Needs to be called after all wrapper flags were added and before
+// the source rules, so that the more specific source rules win.
+func (override *packageOverride) processFlags(builder *commandBuilder) {
+	builder.removeArgs(override.RemoveFlags...)
+	builder.addPreUserArgs(override.PreFlags...)
+	builder.addPostUserArgs(override.PostFlags...)
+}
+
+func printPackageOverride(writer io.Writer, override *packageOverride) {
+	if override.Package == "" {
+		fmt.Fprint(writer, "wrapper package override: none\n")
+		return
+	}
+	data, _ := json.Marshal(override)
+	fmt.Fprintf(writer, "wrapper package override: %s\n", data)
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackageIdentityMatches(t *testing.T) {
+	pkg := packageIdentity{category: "dev-libs", name: "foo", nameVer: "foo-1.2"}
+	for _, pattern := range []string{"dev-libs/foo", "foo", "dev-libs/foo-1.2", "dev-libs/*", "*/foo"} {
+		if !pkg.matches(pattern) {
+			t.Errorf("expected %q to match", pattern)
+		}
+	}
+	for _, pattern := range []string{"dev-libs/bar", "bar", "sys-libs/*", ""} {
+		if pkg.matches(pattern) {
+			t.Errorf("expected %q not to match", pattern)
+		}
+	}
+}
+
+func TestAndroidModuleMatches(t *testing.T) {
+	pkg := packageIdentity{androidModule: "libfoo"}
+	if !pkg.matches("libfoo") || !pkg.matches("lib*") {
+		t.Error("expected android module to match")
+	}
+	if pkg.matches("dev-libs/libfoo") {
+		t.Error("expected android module not to match a portage package")
+	}
+	if pkg.String() != "libfoo" {
+		t.Errorf("unexpected package string. Got: %s", pkg.String())
+	}
+}
+
+func TestAddPackageOverrideFlagsForAndroidModule(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.updateConfig(androidConfig)
+		ctx.writePackageOverrides(`[
+			{"package": "libbar", "pre_flags": ["-Wno-bar"]},
+			{"package": "libfoo", "pre_flags": ["-Wno-foo"]}
+		]`)
+		ctx.env = append(ctx.env, "ANDROID_MODULE_NAME=libfoo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangAndroid, mainCc)))
+		if err := verifyArgOrder(cmd, "-Wno-foo", mainCc); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Wno-bar"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddPackageOverrideFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[
+			{"package": "dev-libs/bar", "pre_flags": ["-Wrong"]},
+			{"package": "dev-libs/foo", "pre_flags": ["-Wno-foo"], "post_flags": ["-O1"]}
+		]`)
+		ctx.env = append(ctx.env, "CATEGORY=dev-libs", "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-O2", mainCc)))
+		if err := verifyArgOrder(cmd, "-Wno-foo", "-O2", mainCc, "-O1"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Wrong"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPackageOverrideFlagsHaveSourceRulePrecedence(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-Wno-config"}
+		ctx.writePackageOverrides(`[{"package": "foo", "pre_flags": ["-Wno-package"], "post_flags": ["-O1"]}]`)
+		ctx.writeSourceRules(`[{"sources": ["**/*.cc"], "pre_flags": ["-Wno-source"], "post_flags": ["-O0"]}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-O2", mainCc)))
+		if err := verifyArgOrder(cmd, "-Wno-config", "-Wno-package", "-Wno-source", "-O2", mainCc, "-O1", "-O0"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRemovePackageOverrideFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-Wno-config"}
+		ctx.writePackageOverrides(`[{"package": "foo", "remove_flags": ["-Wno-config", "-Werror"]}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-Werror", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-Wno-config|-Werror"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDisableCCacheViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.useCCache = true
+		ctx.writePackageOverrides(`[{"package": "foo", "ccache": false}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, "usr/bin/clang"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestEnableClangTidyViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "clang_tidy": true}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 2 {
+				return verifyPath(cmd, "usr/bin/clang-tidy")
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 3 {
+			t.Errorf("expected 3 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestDisableClangTidyViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "clang_tidy": false}]`)
+		ctx.env = append(ctx.env, "PN=foo", "WITH_TIDY=1")
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestDisableWErrorRetryViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "werror_retry": false}]`)
+		ctx.env = append(ctx.env, "PN=foo", "FORCE_DISABLE_WERROR=1")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			io.WriteString(stderr, "-Werror originalerror")
+			return newExitCodeError(1)
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+		if exitCode != 1 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestForceClangViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "compiler": "clang"}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./x86_64-cros-linux-gnu-g++", mainCc)))
+		if err := verifyPath(cmd, `usr/bin/clang\+\+`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestForceGccViaPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "compiler": "gcc"}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyPath(cmd, gccX86_64+".real"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForInvalidPackageOverrideCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "compiler": "icc"}]`)
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid compiler "icc" for package foo in .*`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForInvalidPackageOverridesFile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`{`)
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "invalid package overrides file .*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIgnoreMissingPackageOverridesFileFromConfig(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.packageOverridesRelPath = "doesnotexist.json"
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+	})
+}
+
+func TestReadPackageOverridesFileFromConfig(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.rootRelPath = "root"
+		ctx.cfg.packageOverridesRelPath = "overrides.json"
+		ctx.writeFile(filepath.Join(ctx.tempDir, "root", "overrides.json"),
+			`[{"package": "foo", "post_flags": ["-Wfromconfig"]}]`)
+		ctx.env = []string{"PN=foo"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(filepath.Join(ctx.tempDir, "x86_64-cros-linux-gnu-gcc"), mainCc)))
+		if err := verifyArgCount(cmd, 1, "-Wfromconfig"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPrintConfigShowsPackageOverride(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "dev-libs/*", "post_flags": ["-O1"]}]`)
+		ctx.env = append(ctx.env, "CATEGORY=dev-libs", "PN=foo")
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-config", mainCc)))
+		if !strings.Contains(ctx.stderrString(), `wrapper package override: {"package":"dev-libs/*","post_flags":["-O1"]}`) {
+			t.Errorf("package override not printed. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func (ctx *testContext) writePackageOverrides(content string) {
+	overridesFile := filepath.Join(ctx.tempDir, "package_overrides.json")
+	ctx.writeFile(overridesFile, content)
+	ctx.env = append(ctx.env, "COMPILER_WRAPPER_PACKAGE_OVERRIDES="+overridesFile)
+}
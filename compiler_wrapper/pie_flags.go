@@ -4,28 +4,15 @@
 
 package main
 
+// Removes the -fPIE / -pie of the config if the user chose the relocation
+// model / the kind of the linked output, see invocation.userRelocationModel
+// and invocation.userLinkKind.
 func processPieFlags(builder *commandBuilder) {
-	fpieMap := map[string]bool{"-D__KERNEL__": true, "-fPIC": true, "-fPIE": true, "-fno-PIC": true, "-fno-PIE": true,
-		"-fno-pic": true, "-fno-pie": true, "-fpic": true, "-fpie": true, "-nopie": true,
-		"-nostartfiles": true, "-nostdlib": true, "-pie": true, "-static": true}
-
-	pieMap := map[string]bool{"-D__KERNEL__": true, "-A": true, "-fno-PIC": true, "-fno-PIE": true, "-fno-pic": true, "-fno-pie": true,
-		"-nopie": true, "-nostartfiles": true, "-nostdlib": true, "-pie": true, "-r": true, "--shared": true,
-		"-shared": true, "-static": true}
-
-	pie := false
 	fpie := false
+	pie := false
 	if builder.target.abi != "eabi" {
-		for _, arg := range builder.args {
-			if arg.fromUser {
-				if fpieMap[arg.value] {
-					fpie = true
-				}
-				if pieMap[arg.value] {
-					pie = true
-				}
-			}
-		}
+		fpie = builder.invocation.userRelocationModel
+		pie = builder.invocation.userLinkKind
 	}
 	builder.transformArgs(func(arg builderArg) string {
 		// Remove -nopie as it is a non-standard flag.
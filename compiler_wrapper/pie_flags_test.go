@@ -62,6 +62,34 @@ func TestOmitPieFlagsWhenKernelDefined(t *testing.T) {
 	})
 }
 
+func TestOmitPieFlagsWhenKernelDefinedWithSeparateValue(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		initPieConfig(ctx.cfg)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-D", "__KERNEL__", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-pie"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-fPIE"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOmitOnlyPieFlagForShared(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		initPieConfig(ctx.cfg)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-shared", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-pie"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 1, "-fPIE"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestAddPieFlagsForEabiEvenIfNoPieGiven(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
 		initPieConfig(ctx.cfg)
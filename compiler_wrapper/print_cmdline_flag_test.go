@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"regexp"
 	"testing"
 )
@@ -83,3 +84,35 @@ func TestPrintCmdArgs(t *testing.T) {
 		}
 	})
 }
+
+func TestPrintCmdInSingleWrite(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		stderr := &countingWriter{}
+		printCmd(&stderrEnv{ctx, stderr}, &command{
+			Path:       "/somepath",
+			Args:       []string{"-a"},
+			EnvUpdates: []string{"a=b"},
+		})
+		if stderr.writes != 1 {
+			t.Errorf("expected 1 write. Got: %d", stderr.writes)
+		}
+	})
+}
+
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+type stderrEnv struct {
+	env
+	stderrWriter io.Writer
+}
+
+func (env *stderrEnv) stderr() io.Writer {
+	return env.stderrWriter
+}
@@ -6,8 +6,7 @@ package main
 
 import "fmt"
 
-func processPrintConfigFlag(builder *commandBuilder) {
-	printConfig := false
+func processPrintConfigFlag(builder *commandBuilder) (printConfig bool) {
 	builder.transformArgs(func(arg builderArg) string {
 		if arg.value == "-print-config" {
 			printConfig = true
@@ -18,4 +17,5 @@ func processPrintConfigFlag(builder *commandBuilder) {
 	if printConfig {
 		fmt.Fprintf(builder.env.stderr(), "wrapper config: %#v\n", *builder.cfg)
 	}
+	return printConfig
 }
@@ -0,0 +1,177 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+)
+
+// The probe cache stores the results of compiler probes that need a
+// subprocess (e.g. clang --print-resource-dir) across wrapper invocations.
+// Path lookups (filepath.EvalSymlinks, the PATH walk in
+// resolveAgainstPathEnv, getLinkerPath) are not cached: A cache hit has to
+// stat every PATH candidate and symlink the lookup depended on anyway, and
+// measured as slow as the lookup itself (~50us for getLinkerPath with 8
+// PATH entries and a 2-level symlink chain).
+//
+// Every entry records the identity (inode, mtime, size, mode) of the files
+// and directories its value was derived from, and is ignored once one of
+// them changed, e.g. because the toolchain was updated. Entries are written
+// atomically via a rename, so concurrent wrappers never see partial entries.
+//
+// Every user gets a private subdirectory, as the cached paths are
+// executed / passed to the compiler and must not be writable by others.
+// Errors while reading or writing the cache are ignored, as the cache
+// is only an optimization.
+
+type probeCacheEntry struct {
+	Key string `json:"key"`
+	// Path -> identity of the file, see getFileIdentity.
+	Deps  map[string]string `json:"deps"`
+	Value string            `json:"value"`
+}
+
+// Returns the cached value for the key, or calls probe and caches its
+// result. deps are the files that the result of probe depends on.
+func cachedProbe(env env, cfg *config, key string, deps []string, probe func() (string, error)) (string, error) {
+	if cfg.probeCacheDir == "" {
+		return probe()
+	}
+	cacheDir, ok := getProbeCacheDir(env, cfg)
+	if !ok {
+		return probe()
+	}
+	depIdentities := map[string]string{}
+	for _, dep := range deps {
+		identity, err := getFileIdentity(env, dep)
+		if err != nil {
+			return probe()
+		}
+		depIdentities[dep] = identity
+	}
+	entryPath := getProbeCacheEntryPath(cacheDir, key)
+	if entry, ok := readProbeCacheEntry(env, entryPath); ok && entry.Key == key &&
+		reflect.DeepEqual(entry.Deps, depIdentities) {
+		return entry.Value, nil
+	}
+	// Note: The identities of the deps are calculated before calling probe
+	// so that a toolchain update in between invalidates the new entry.
+	value, err := probe()
+	if err != nil {
+		return "", err
+	}
+	_ = writeProbeCacheEntry(env, cacheDir, entryPath, &probeCacheEntry{
+		Key:   key,
+		Deps:  depIdentities,
+		Value: value,
+	})
+	return value, nil
+}
+
+// Returns the private cache dir of the current user, creating it if needed.
+// Returns false if the dir can't be created or could be written by others.
+func getProbeCacheDir(env env, cfg *config) (string, bool) {
+	uid := env.fs().getuid()
+	cacheDir := filepath.Join(cfg.probeCacheDir, strconv.Itoa(uid))
+	// The parent dir is shared by all users, see disable_werror_flag.go.
+	oldMask := env.fs().umask(0)
+	err := env.fs().mkdirAll(cfg.probeCacheDir, 0777)
+	if err == nil {
+		err = env.fs().mkdirAll(cacheDir, 0700)
+	}
+	env.fs().umask(oldMask)
+	if err != nil {
+		return "", false
+	}
+	info, err := env.fs().lstat(cacheDir)
+	if err != nil || !info.IsDir() || info.Mode().Perm()&0022 != 0 {
+		return "", false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != uid {
+		return "", false
+	}
+	return cacheDir, true
+}
+
+func getProbeCacheEntryPath(cacheDir string, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:])+".json")
+}
+
+// Returns a string that changes when the file is replaced or modified.
+// Symlinks also include the identity of their target. Files that don't
+// exist have the identity "missing", so that entries can depend on the
+// absence of a file.
+func getFileIdentity(env env, path string) (string, error) {
+	info, err := env.fs().lstat(path)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	identity := formatFileIdentity(info)
+	if info.Mode()&os.ModeSymlink != 0 {
+		targetInfo, err := env.fs().stat(path)
+		switch {
+		case os.IsNotExist(err):
+			identity += " -> missing"
+		case err != nil:
+			return "", err
+		default:
+			identity += " -> " + formatFileIdentity(targetInfo)
+		}
+	}
+	return identity, nil
+}
+
+func formatFileIdentity(info os.FileInfo) string {
+	var inode uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = stat.Ino
+	}
+	return fmt.Sprintf("%d:%d:%d:%o", inode, info.ModTime().UnixNano(), info.Size(), info.Mode())
+}
+
+func readProbeCacheEntry(env env, entryPath string) (*probeCacheEntry, bool) {
+	data, err := env.fs().readFile(entryPath)
+	if err != nil {
+		return nil, false
+	}
+	entry := &probeCacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func writeProbeCacheEntry(env env, cacheDir string, entryPath string, entry *probeCacheEntry) error {
+	tmpFile, err := env.fs().tempFile(cacheDir, "entry*.tmp")
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating probe cache entry")
+	}
+	if err := json.NewEncoder(tmpFile).Encode(entry); err != nil {
+		_ = tmpFile.Close()
+		_ = env.fs().removeAll(tmpFile.Name())
+		return wrapErrorwithSourceLocf(err, "error writing probe cache entry")
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = env.fs().removeAll(tmpFile.Name())
+		return wrapErrorwithSourceLocf(err, "error closing probe cache entry")
+	}
+	if err := env.fs().rename(tmpFile.Name(), entryPath); err != nil {
+		_ = env.fs().removeAll(tmpFile.Name())
+		return wrapErrorwithSourceLocf(err, "error renaming probe cache entry")
+	}
+	return nil
+}
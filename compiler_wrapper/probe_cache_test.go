@@ -0,0 +1,135 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProbeCacheSkipsProbeForUnchangedClang(t *testing.T) {
+	withProbeCacheTestContext(t, func(ctx *testContext) {
+		clangPath := filepath.Join(ctx.tempDir, "clang")
+		ctx.writeFile(clangPath, "")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprintf(stdout, "/somedir%d\n", ctx.cmdCount)
+			return nil
+		}
+		for i := 0; i < 2; i++ {
+			resourceDir, err := getClangResourceDir(ctx, ctx.cfg, clangPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resourceDir != "/somedir1" {
+				t.Errorf("unexpected resource dir. Got: %s", resourceDir)
+			}
+		}
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+
+		// Simulates a toolchain update.
+		ctx.writeFile(clangPath, "newclang")
+		resourceDir, err := getClangResourceDir(ctx, ctx.cfg, clangPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resourceDir != "/somedir2" {
+			t.Errorf("unexpected resource dir after update. Got: %s", resourceDir)
+		}
+	})
+}
+
+func TestProbeCacheIgnoresCacheDirWritableByOthers(t *testing.T) {
+	withProbeCacheTestContext(t, func(ctx *testContext) {
+		cacheDir := filepath.Join(ctx.cfg.probeCacheDir, strconv.Itoa(os.Getuid()))
+		if err := os.MkdirAll(cacheDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(cacheDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		clangPath := filepath.Join(ctx.tempDir, "clang")
+		ctx.writeFile(clangPath, "")
+		for i := 0; i < 2; i++ {
+			if _, err := getClangResourceDir(ctx, ctx.cfg, clangPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+		if files, err := ioutil.ReadDir(cacheDir); err != nil || len(files) != 0 {
+			t.Errorf("expected no cache entries. Got: %s, err: %s", files, err)
+		}
+	})
+}
+
+func TestProbeCacheWithConcurrentWriters(t *testing.T) {
+	withProbeCacheTestContext(t, func(ctx *testContext) {
+		depPath := filepath.Join(ctx.tempDir, "dep")
+		ctx.writeFile(depPath, "")
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := cachedProbe(ctx, ctx.cfg, "somekey", []string{depPath}, func() (string, error) {
+					return "somevalue", nil
+				})
+				if err != nil || value != "somevalue" {
+					t.Errorf("unexpected result. Got: %s, err: %s", value, err)
+				}
+			}()
+		}
+		wg.Wait()
+		cacheDir := filepath.Join(ctx.cfg.probeCacheDir, strconv.Itoa(os.Getuid()))
+		files, err := ioutil.ReadDir(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".json") {
+			t.Errorf("expected 1 cache entry. Got: %s", files)
+		}
+	})
+}
+
+func TestProbeCacheDoesNotCachePathLookups(t *testing.T) {
+	withProbeCacheTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if _, err := os.Stat(ctx.cfg.probeCacheDir); !os.IsNotExist(err) {
+			t.Errorf("expected no probe cache. Got err: %v", err)
+		}
+	})
+}
+
+func TestProbeCacheIsNotUsedByDefault(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		clangPath := filepath.Join(ctx.tempDir, "clang")
+		ctx.writeFile(clangPath, "")
+		for i := 0; i < 2; i++ {
+			if _, err := getClangResourceDir(ctx, ctx.cfg, clangPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func withProbeCacheTestContext(t *testing.T, work func(ctx *testContext)) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.probeCacheDir = filepath.Join(ctx.tempDir, "probe_cache")
+		work(ctx)
+	})
+}
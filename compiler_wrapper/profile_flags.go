@@ -0,0 +1,255 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const profileDirKey = "COMPILER_WRAPPER_PROFILE_DIR"
+
+// The profile directory contains the metadata files from afdo_metadata
+// and the profiles they name. The metadata maps a key to the name of the
+// latest profile:
+//   - kernel_afdo.json is keyed by the kernel package name, e.g.
+//     chromeos-kernel-4_4. Kernel profile names have no extension, the
+//     profiles are installed as <name>.afdo.
+//   - chrome_afdo.json is keyed by the -march value of the compile,
+//     with "benchmark" as the fallback.
+//
+// Profiles ending in .profdata are instrumented (PGO) profiles, all
+// others are sample (AFDO) profiles. A remapping file is used if it is
+// installed next to the profile as <profile>.remap.
+//
+// The profile names encode the milestone and usually the creation date,
+// e.g. R82-12874.0-1581330812 or chromeos-chrome-amd64-79.0.3943.1_rc-r1.
+// We don't use profiles that are out of date, see checkProfileStaleness.
+const (
+	chromeAfdoMetadataFile = "chrome_afdo.json"
+	kernelAfdoMetadataFile = "kernel_afdo.json"
+	chromeAfdoFallbackKey  = "benchmark"
+	// Profiles for the tip of tree usually lag behind by one milestone.
+	maxChromeProfileMilestoneLag = 1
+)
+
+var releaseProfileNameRegex = regexp.MustCompile(`^R(\d+)-[\d.]+-(\d+)$`)
+var chromeProfileNameRegex = regexp.MustCompile(`^chromeos-chrome-[^-]+-(\d+)\.`)
+
+type afdoMetadataEntry struct {
+	Name string `json:"name"`
+}
+
+// Returns the path of the profile to use for the current package,
+// or an empty string if the package has no profile.
+func findProfile(builder *commandBuilder) (string, error) {
+	profileDir, _ := builder.env.getenv(profileDirKey)
+	if profileDir == "" {
+		if builder.cfg.profileRelDir == "" {
+			return "", nil
+		}
+		profileDir = filepath.Join(builder.rootPath, builder.cfg.profileRelDir)
+	}
+	pn, _ := builder.env.getenv("PN")
+	var metadataFile string
+	var keys []string
+	switch {
+	case pn == "chromeos-chrome":
+		metadataFile = chromeAfdoMetadataFile
+		keys = []string{chromeAfdoFallbackKey}
+		for _, arg := range builder.args {
+			if strings.HasPrefix(arg.value, "-march=") {
+				keys = append(keys, arg.value[len("-march="):])
+			}
+		}
+	case strings.HasPrefix(pn, "chromeos-kernel-"):
+		metadataFile = kernelAfdoMetadataFile
+		keys = []string{pn}
+	default:
+		return "", nil
+	}
+	metadataFile = filepath.Join(profileDir, metadataFile)
+	data, err := builder.env.fs().readFile(metadataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", wrapErrorwithSourceLocf(err, "failed to read afdo metadata %s", metadataFile)
+	}
+	metadata := map[string]afdoMetadataEntry{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return "", newUserErrorf("invalid afdo metadata file %s: %s", metadataFile, err)
+	}
+	// The last -march wins, the fallback key comes first.
+	for i := len(keys) - 1; i >= 0; i-- {
+		entry, ok := metadata[keys[i]]
+		if !ok {
+			continue
+		}
+		if entry.Name == "" {
+			return "", newUserErrorf("missing profile name for %s in %s", keys[i], metadataFile)
+		}
+		name := entry.Name
+		if filepath.Ext(name) != ".afdo" && filepath.Ext(name) != ".profdata" {
+			name += ".afdo"
+		}
+		return filepath.Join(profileDir, name), nil
+	}
+	return "", nil
+}
+
+// Adds -fprofile-sample-use / -fprofile-use for the profile of the current
+// package. If the profile can't be used, we warn, log the problem and build
+// without it.
+func processProfileFlags(builder *commandBuilder) error {
+	for _, arg := range builder.args {
+		if isProfileFlag(arg.value) {
+			return nil
+		}
+	}
+	profilePath, err := findProfile(builder)
+	if err != nil || profilePath == "" {
+		return err
+	}
+	problem := checkProfileFile(builder.env, profilePath)
+	if problem == "" {
+		problem = checkProfileStaleness(builder, profilePath)
+	}
+	if problem != "" {
+		fmt.Fprintf(builder.env.stderr(), "warning: not using profile %s: %s\n", profilePath, problem)
+		// The log is best effort, a failure to write it must not fail the compile.
+		_ = logProfileProblem(builder.env, builder.cfg, &profileProblemJSONData{
+			Cwd:     builder.env.getwd(),
+			Package: getPackageIdentity(builder.env).String(),
+			Profile: profilePath,
+			Problem: problem,
+		})
+		return nil
+	}
+	var flags []string
+	if filepath.Ext(profilePath) == ".profdata" {
+		flags = append(flags, "-fprofile-use="+profilePath)
+	} else {
+		flags = append(flags, "-fprofile-sample-use="+profilePath)
+	}
+	remappingPath := profilePath + ".remap"
+	if _, err := builder.env.fs().stat(remappingPath); err == nil {
+		flags = append(flags, "-fprofile-remapping-file="+remappingPath)
+	}
+	builder.addPreUserArgs(flags...)
+	return nil
+}
+
+// Returns a description of why the given profile can't be used,
+// or an empty string if it is fine.
+func checkProfileFile(env env, profilePath string) string {
+	f, err := env.fs().openFile(profilePath, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "file does not exist"
+		}
+		return err.Error()
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err.Error()
+	}
+	if info.IsDir() {
+		return "not a file"
+	}
+	return ""
+}
+
+// Returns a description of why the given profile is out of date, or an
+// empty string if it is current or we can't tell from its name.
+func checkProfileStaleness(builder *commandBuilder, profilePath string) string {
+	name := strings.TrimSuffix(filepath.Base(profilePath), filepath.Ext(profilePath))
+	milestone := 0
+	if match := releaseProfileNameRegex.FindStringSubmatch(name); match != nil {
+		milestone, _ = strconv.Atoi(match[1])
+		if created, err := strconv.ParseInt(match[2], 10, 64); err == nil && builder.cfg.maxProfileAgeDays > 0 {
+			createdTime := time.Unix(created, 0)
+			if time.Since(createdTime) > time.Duration(builder.cfg.maxProfileAgeDays)*24*time.Hour {
+				return fmt.Sprintf("profile was created on %s, more than %d days ago",
+					createdTime.UTC().Format("2006-01-02"), builder.cfg.maxProfileAgeDays)
+			}
+		}
+	} else if match := chromeProfileNameRegex.FindStringSubmatch(name); match != nil {
+		milestone, _ = strconv.Atoi(match[1])
+	}
+
+	pn, _ := builder.env.getenv("PN")
+	pv, _ := builder.env.getenv("PV")
+	if pn != "chromeos-chrome" || milestone == 0 {
+		return ""
+	}
+	// E.g. 82.0.4056.0_rc. The live ebuild has no usable version.
+	pvMilestone, err := strconv.Atoi(strings.SplitN(pv, ".", 2)[0])
+	if err != nil || pvMilestone == 0 {
+		return ""
+	}
+	if milestone < pvMilestone-maxChromeProfileMilestoneLag {
+		return fmt.Sprintf("profile is for milestone %d, but %s is milestone %d", milestone, pn, pvMilestone)
+	}
+	return ""
+}
+
+type profileProblemJSONData struct {
+	Cwd     string `json:"cwd"`
+	Package string `json:"package"`
+	Profile string `json:"profile"`
+	Problem string `json:"problem"`
+}
+
+func logProfileProblem(env env, cfg *config, data *profileProblemJSONData) error {
+	if cfg.profileLogDir == "" {
+		return nil
+	}
+	// The log dir is shared by all users, see disable_werror_flag.go.
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
+	if err := env.fs().mkdirAll(cfg.profileLogDir, 0777); err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating profile log directory %s", cfg.profileLogDir)
+	}
+	logFile, err := env.fs().tempFile(cfg.profileLogDir, "profile*.json")
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating profile log file")
+	}
+	if err := json.NewEncoder(logFile).Encode(data); err != nil {
+		_ = logFile.Close()
+		return wrapErrorwithSourceLocf(err, "error writing profile log")
+	}
+	if err := logFile.Close(); err != nil {
+		return wrapErrorwithSourceLocf(err, "error closing profile log")
+	}
+	return nil
+}
+
+// Returns true for flags that show that the user takes care of
+// profiles already. Note that -fprofile-instr-generate is also added
+// by WITH_COVERAGE.
+func isProfileFlag(arg string) bool {
+	for _, prefix := range []string{
+		"-fprofile-sample-use",
+		"-fprofile-use",
+		"-fprofile-instr-use",
+		"-fprofile-instr-generate",
+		"-fprofile-generate",
+		"-fauto-profile",
+		"-fno-profile-sample-use",
+	} {
+		if arg == prefix || strings.HasPrefix(arg, prefix+"=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddKernelSampleProfileFlags(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{
+			"chromeos-kernel-4_4": {"name": "R82-12874.0-1581330812"},
+			"chromeos-kernel-3_18": {"name": "R82-12861.0-1580725956"}
+		}`)
+		profile := ctx.writeProfileFile("R82-12874.0-1581330812.afdo", "")
+		ctx.env = append(ctx.env, "CATEGORY=sys-kernel", "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-sample-use="+profile, mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMatchChromeProfileAgainstMarch(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("chrome_afdo.json", `{
+			"silvermont": {"name": "R79-3931.2-1571659204.afdo"},
+			"benchmark": {"name": "chromeos-chrome-amd64-79.0.3943.1_rc-r1.afdo"}
+		}`)
+		silvermont := ctx.writeProfileFile("R79-3931.2-1571659204.afdo", "")
+		benchmark := ctx.writeProfileFile("chromeos-chrome-amd64-79.0.3943.1_rc-r1.afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-chrome")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-march=silvermont", mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-sample-use="+silvermont, mainCc); err != nil {
+			t.Error(err)
+		}
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-march=goldmont", mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-sample-use="+benchmark, mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddInstrumentedProfileFlagsWithRemappingFile(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "foo.profdata"}}`)
+		profile := ctx.writeProfileFile("foo.profdata", "")
+		remapping := ctx.writeProfileFile("foo.profdata.remap", "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-use="+profile, "-fprofile-remapping-file="+remapping, mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestNoProfileFlagsForOtherPackages(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "foo"}}`)
+		ctx.writeProfileFile("foo.afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-5_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestLogAndSkipMissingProfile(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "foo"}}`)
+		ctx.env = append(ctx.env, "CATEGORY=sys-kernel", "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(ctx.stderrString(), "warning: not using profile") {
+			t.Errorf("expected a warning. Got: %s", ctx.stderrString())
+		}
+		data := readProfileLog(ctx)
+		if data.Package != "sys-kernel/chromeos-kernel-4_4" {
+			t.Errorf("unexpected package. Got: %s", data.Package)
+		}
+		if data.Profile != filepath.Join(ctx.tempDir, "afdo", "foo.afdo") {
+			t.Errorf("unexpected profile. Got: %s", data.Profile)
+		}
+		if data.Problem != "file does not exist" {
+			t.Errorf("unexpected problem. Got: %s", data.Problem)
+		}
+	})
+}
+
+func TestSkipProfileIfLogFails(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "foo"}}`)
+		// Creating the log dir fails as there is a file in its place.
+		ctx.writeFile(ctx.cfg.profileLogDir, "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSkipProfileOlderThanMaxAge(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.cfg.maxProfileAgeDays = 90
+		created := time.Now().Add(-100 * 24 * time.Hour)
+		name := fmt.Sprintf("R82-12874.0-%d", created.Unix())
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "`+name+`"}}`)
+		ctx.writeProfileFile(name+".afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+		problem := "profile was created on " + created.UTC().Format("2006-01-02") + ", more than 90 days ago"
+		if !strings.Contains(ctx.stderrString(), problem) {
+			t.Errorf("expected %q in stderr. Got: %s", problem, ctx.stderrString())
+		}
+		if data := readProfileLog(ctx); data.Problem != problem {
+			t.Errorf("unexpected problem. Got: %s", data.Problem)
+		}
+	})
+}
+
+func TestUseProfileYoungerThanMaxAge(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.cfg.maxProfileAgeDays = 90
+		name := fmt.Sprintf("R82-12874.0-%d", time.Now().Add(-80*24*time.Hour).Unix())
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "`+name+`"}}`)
+		profile := ctx.writeProfileFile(name+".afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-sample-use="+profile, mainCc); err != nil {
+			t.Error(err)
+		}
+		if ctx.stderrString() != "" {
+			t.Errorf("unexpected stderr. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestSkipChromeProfileForOlderMilestone(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("chrome_afdo.json", `{
+			"benchmark": {"name": "chromeos-chrome-amd64-79.0.3943.1_rc-r1.afdo"}
+		}`)
+		profile := ctx.writeProfileFile("chromeos-chrome-amd64-79.0.3943.1_rc-r1.afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-chrome", "PV=80.0.3987.0_rc")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgOrder(cmd, "-fprofile-sample-use="+profile, mainCc); err != nil {
+			t.Error(err)
+		}
+
+		ctx.env = append(ctx.env, "PV=81.0.4044.0_rc")
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 0, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+		problem := "profile is for milestone 79, but chromeos-chrome is milestone 81"
+		if !strings.Contains(ctx.stderrString(), problem) {
+			t.Errorf("expected %q in stderr. Got: %s", problem, ctx.stderrString())
+		}
+	})
+}
+
+func TestKeepUserProfileFlags(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {"name": "foo"}}`)
+		ctx.writeProfileFile("foo.afdo", "")
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fprofile-sample-use=user.afdo", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fprofile-sample-use=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForMissingProfileName(t *testing.T) {
+	withProfileTestContext(t, func(ctx *testContext) {
+		ctx.writeProfileFile("kernel_afdo.json", `{"chromeos-kernel-4_4": {}}`)
+		ctx.env = append(ctx.env, "PN=chromeos-kernel-4_4")
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `missing profile name for chromeos-kernel-4_4 in .*`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func withProfileTestContext(t *testing.T, work func(ctx *testContext)) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "COMPILER_WRAPPER_PROFILE_DIR="+filepath.Join(ctx.tempDir, "afdo"))
+		work(ctx)
+	})
+}
+
+func (ctx *testContext) writeProfileFile(name string, content string) string {
+	path := filepath.Join(ctx.tempDir, "afdo", name)
+	ctx.writeFile(path, content)
+	return path
+}
+
+func readProfileLog(ctx *testContext) *profileProblemJSONData {
+	files, err := ioutil.ReadDir(ctx.cfg.profileLogDir)
+	if err != nil {
+		ctx.t.Fatalf("error reading profile log dir: %s", err)
+	}
+	if len(files) != 1 {
+		ctx.t.Fatalf("expected 1 profile log file. Got: %s", files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.cfg.profileLogDir, files[0].Name()))
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	profileData := &profileProblemJSONData{}
+	if err := json.Unmarshal(data, profileData); err != nil {
+		ctx.t.Fatal(err)
+	}
+	return profileData
+}
@@ -0,0 +1,81 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+# Copyright 2020 The Chromium OS Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style license that can be
+# found in the LICENSE file.
+
+"""Checks a built wrapper binary against the golden files.
+
+The golden files are replayed against the binary, with fake compilers that
+respond with the recorded results. The fake compilers and the replay are
+part of the go test binary of the wrapper, see goldenreplay_test.go.
+Use --build_replay_tool to build that binary once, e.g. to copy it to a
+machine without go, and --replay_tool to use it.
+"""
+
+from __future__ import print_function
+
+import argparse
+import os.path
+import subprocess
+import sys
+import tempfile
+
+
+def parse_args():
+  parser = argparse.ArgumentParser()
+  parser.add_argument(
+      '--config',
+      required=True,
+      choices=['cros.hardened', 'cros.nonhardened', 'cros.host', 'android'])
+  parser.add_argument('--binary', type=str, help='wrapper binary to check')
+  parser.add_argument(
+      '--golden_dir',
+      type=str,
+      help='directory with the golden files, e.g. testdata/cros_hardened_golden'
+  )
+  parser.add_argument(
+      '--replay_tool', type=str, help='prebuilt replay tool to use')
+  parser.add_argument(
+      '--build_replay_tool',
+      type=str,
+      help='only build the replay tool to the given path')
+  args = parser.parse_args()
+  if not args.build_replay_tool and not (args.binary and args.golden_dir):
+    parser.error('--binary and --golden_dir are required')
+  return args
+
+
+def build_replay_tool(output_file):
+  subprocess.check_call(
+      ['go', 'test', '-c', '-o',
+       os.path.abspath(output_file)],
+      cwd=os.path.dirname(os.path.abspath(__file__)))
+
+
+def replay(replay_tool, args):
+  return subprocess.call([
+      replay_tool,
+      '-test.run=^TestReplayGoldenRecords$',
+      '-test.v',
+      '-replaybinary=' + os.path.abspath(args.binary),
+      '-replaygolden=' + os.path.abspath(args.golden_dir),
+      '-replayconfig=' + args.config,
+  ])
+
+
+def main():
+  args = parse_args()
+  if args.build_replay_tool:
+    build_replay_tool(args.build_replay_tool)
+    return 0
+  if args.replay_tool:
+    return replay(os.path.abspath(args.replay_tool), args)
+  with tempfile.TemporaryDirectory() as tmp_dir:
+    replay_tool = os.path.join(tmp_dir, 'golden_replay')
+    build_replay_tool(replay_tool)
+    return replay(replay_tool, args)
+
+
+if __name__ == '__main__':
+  sys.exit(main())
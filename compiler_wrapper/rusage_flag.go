@@ -24,9 +24,10 @@ func logRusage(env env, logFileName string, compilerCmd *command) (exitCode int,
 		return 0, err
 	}
 	compilerCmdWithoutRusage := &command{
-		Path:       compilerCmd.Path,
-		Args:       compilerCmd.Args,
-		EnvUpdates: append(compilerCmd.EnvUpdates, "GETRUSAGE="),
+		Path:         compilerCmd.Path,
+		Args:         compilerCmd.Args,
+		EnvUpdates:   append(compilerCmd.EnvUpdates, "GETRUSAGE="),
+		launcherName: compilerCmd.launcherName,
 	}
 	startTime := time.Now()
 	exitCode, err = wrapSubprocessErrorWithSourceLoc(compilerCmdWithoutRusage,
@@ -46,11 +47,11 @@ func logRusage(env env, logFileName string, compilerCmd *command) (exitCode int,
 	maxMemUsed := rusageAfter.Maxrss
 	absCompilerPath := getAbsCmdPath(env, compilerCmd)
 
-	if err := os.MkdirAll(filepath.Dir(logFileName), 0777); err != nil {
+	if err := env.fs().mkdirAll(filepath.Dir(logFileName), 0777); err != nil {
 		return 0, wrapErrorwithSourceLocf(err, "error creating rusage log directory %s", logFileName)
 	}
 	// Note: using file mode 0666 so that a root-created log is writable by others.
-	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	logFile, err := env.fs().openFile(logFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
 		return 0, wrapErrorwithSourceLocf(err, "error creating rusage logfile %s", logFileName)
 	}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Arches of Rust targets whose name differs from the cros arch.
+var rustArches = map[string]string{
+	"armv7a": "armv7",
+	"armv7m": "thumbv7m",
+	"armv8m": "thumbv8m.main",
+}
+
+func prepareRustcCommand(builder *commandBuilder) (sysroot string, err error) {
+	sysroot = ""
+	if !builder.cfg.isHostWrapper {
+		// rustc's --sysroot is the location of the Rust standard library,
+		// so the sysroot of the target is only passed to the linker.
+		sysroot = getSysroot(builder)
+		if !hasUserRustcCodegenArg(builder, "link-arg=--sysroot") {
+			builder.addPreUserArgs("-Clink-arg=--sysroot=" + sysroot)
+		}
+	}
+	if err := processRustcFlags(builder); err != nil {
+		return "", err
+	}
+	return sysroot, nil
+}
+
+func processRustcFlags(builder *commandBuilder) error {
+	if builder.cfg.isHostWrapper {
+		builder.path += ".real"
+		return nil
+	}
+	env := builder.env
+	// Like clang, one rustc supports all targets.
+	rustcDir := filepath.Join(builder.rootPath, "usr/bin/")
+	if !filepath.IsAbs(builder.path) {
+		// See processClangFlags.
+		var err error
+		rustcDir, err = filepath.Rel(env.getwd(), rustcDir)
+		if err != nil {
+			return wrapErrorwithSourceLocf(err, "failed to make rustcDir %s relative to %s.", rustcDir, env.getwd())
+		}
+	}
+	builder.path = filepath.Join(rustcDir, "rustc")
+
+	if !hasUserArgWithPrefix(builder, []string{"--target"}) {
+		rustTarget, err := getRustTarget(builder.target)
+		if err != nil {
+			return err
+		}
+		builder.addPreUserArgs("--target", rustTarget)
+	}
+	if !hasUserRustcCodegenArg(builder, "linker=") {
+		// Link via the clang wrapper of the target, so that the
+		// linker gets the same flags as for C / C++.
+		linkerCmd := builder.target.target + "-clang"
+		linkerDir := getLinkerPath(env, builder.cfg, linkerCmd, builder.rootPath)
+		builder.addPreUserArgs("-Clinker=" + filepath.Join(linkerDir, linkerCmd))
+	}
+	return nil
+}
+
+// Returns the Rust target for the cros target, e.g.
+// armv7-unknown-linux-gnueabihf for armv7a-cros-linux-gnueabihf.
+func getRustTarget(target builderTarget) (string, error) {
+	arch := target.arch
+	if rustArch, ok := rustArches[arch]; ok {
+		arch = rustArch
+	}
+	switch target.sys {
+	case "linux":
+		return arch + "-unknown-linux-" + target.abi, nil
+	case "":
+		// Bare metal targets, e.g. armv7m-cros-eabi.
+		return arch + "-none-" + target.abi, nil
+	default:
+		return "", newUserErrorf("unsupported rust target: %s", target.target)
+	}
+}
+
+// Returns whether the user passed a codegen option with the given prefix,
+// e.g. "linker=" for "-C linker=cc", "-Clinker=cc" or "--codegen linker=cc".
+func hasUserRustcCodegenArg(builder *commandBuilder, prefix string) bool {
+	args := builder.args
+	for i, arg := range args {
+		if !arg.fromUser {
+			continue
+		}
+		option := ""
+		switch {
+		case arg.value == "-C" || arg.value == "--codegen":
+			if i+1 < len(args) {
+				option = args[i+1].value
+			}
+		case strings.HasPrefix(arg.value, "--codegen="):
+			option = arg.value[len("--codegen="):]
+		case strings.HasPrefix(arg.value, "-C"):
+			option = arg.value[len("-C"):]
+		}
+		if strings.HasPrefix(option, prefix) {
+			return true
+		}
+	}
+	return false
+}
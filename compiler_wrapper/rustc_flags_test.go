@@ -0,0 +1,133 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRustTargetForCrosTarget(t *testing.T) {
+	for _, tt := range []struct {
+		target     builderTarget
+		rustTarget string
+	}{
+		{builderTarget{arch: "x86_64", vendor: "cros", sys: "linux", abi: "gnu"}, "x86_64-unknown-linux-gnu"},
+		{builderTarget{arch: "i686", vendor: "pc", sys: "linux", abi: "gnu"}, "i686-unknown-linux-gnu"},
+		{builderTarget{arch: "armv7a", vendor: "cros", sys: "linux", abi: "gnueabihf"}, "armv7-unknown-linux-gnueabihf"},
+		{builderTarget{arch: "aarch64", vendor: "cros", sys: "linux", abi: "gnu"}, "aarch64-unknown-linux-gnu"},
+		{builderTarget{arch: "armv7m", vendor: "cros", abi: "eabi"}, "thumbv7m-none-eabi"},
+	} {
+		actual, err := getRustTarget(tt.target)
+		if err != nil {
+			t.Error(err)
+		} else if actual != tt.rustTarget {
+			t.Errorf("unexpected rust target for %#v. Got: %s", tt.target, actual)
+		}
+	}
+}
+
+func TestRejectUnknownRustTarget(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./x86_64-cros-win-gnu-rustc", mainRs)))
+		if err := verifyNonInternalError(stderr, "unsupported rust target: x86_64-cros-win-gnu"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddRustcTargetAndLinker(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(rustcX86_64, mainRs)))
+		if err := verifyPath(cmd, "usr/bin/rustc"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, "-Clink-arg=--sysroot=.*/usr/x86_64-cros-linux-gnu",
+			"--target", "x86_64-unknown-linux-gnu", "-Clinker=.*/bin/x86_64-cros-linux-gnu-clang", mainRs); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "--sysroot=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKeepUserRustcTargetAndLinker(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(rustcX86_64, "--target", "sometarget", "--codegen=linker=somelinker",
+				"-C", "link-arg=--sysroot=/somesysroot", mainRs)))
+		if err := verifyArgOrder(cmd, "--target", "sometarget", "--codegen=linker=somelinker",
+			"-C", "link-arg=--sysroot=/somesysroot", mainRs); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Clink.*"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 1, "--target"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseRealRustcForHostWrapper(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.isHostWrapper = true
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./rustc", mainRs)))
+		if err := verifyPath(cmd, "./rustc.real"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, mainRs); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 1, ".*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOmitCCacheForRustc(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(rustcX86_64, mainRs)))
+		if err := verifyPath(cmd, "usr/bin/rustc"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyNoEnvUpdate(cmd, "CCACHE_DIR="); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseSCCacheForRustc(t *testing.T) {
+	withCCacheEnabledTestContext(t, func(ctx *testContext) {
+		ctx.cfg.cacheLauncher = cacheLauncher{kind: "sccache"}
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(rustcX86_64, mainRs)))
+		if err := verifyPath(cmd, "/usr/bin/sccache"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, "usr/bin/rustc", mainRs); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIgnorePackageOverrideFlagsForRustc(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writePackageOverrides(`[{"package": "foo", "compiler": "gcc", "pre_flags": ["-Wno-foo"]}]`)
+		ctx.env = append(ctx.env, "PN=foo")
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(rustcX86_64, mainRs)))
+		if err := verifyPath(cmd, "usr/bin/rustc"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Wno-foo"); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -8,51 +8,240 @@ import (
 	"strings"
 )
 
-func processSanitizerFlags(builder *commandBuilder) {
-	hasCoverageFlags := false
-	hasSanitizeFlags := false
-	hasSanitizeFuzzerFlags := false
+type sanitizerPolicy struct {
+	// Flags that don't work together with the sanitizer. They are removed
+	// from the command line.
+	incompatibleFlags []string
+	// Flags to add when compiling with clang. gcc doesn't need any
+	// additional flags for the sanitizers it supports.
+	clangFlags []string
+	// Whether gcc doesn't implement the sanitizer at all.
+	clangOnly bool
+	// Prefixes of the architectures that support the sanitizer.
+	// Empty if all architectures are supported.
+	supportedArches []string
+	// Prefixes of flags of which at least one needs to be given
+	// together with the sanitizer (clang only).
+	requiredClangFlags []string
+}
+
+// Flags not supported by sanitizers (ASan etc.)
+var defaultSanitizerIncompatibleFlags = []string{
+	"-D_FORTIFY_SOURCE=1",
+	"-D_FORTIFY_SOURCE=2",
+	"-D_FORTIFY_SOURCE=3",
+	"-Wl,--no-undefined",
+	"-Wl,-z,defs",
+}
+
+var fuzzerSanitizerPolicy = &sanitizerPolicy{
+	incompatibleFlags: defaultSanitizerIncompatibleFlags,
+	clangFlags: []string{
+		// TODO: This flag should be removed once fuzzer works with new pass manager
+		"-fno-experimental-new-pass-manager",
+	},
+}
+
+var hwasanSanitizerPolicy = &sanitizerPolicy{
+	incompatibleFlags: defaultSanitizerIncompatibleFlags,
+	supportedArches:   []string{"aarch64"},
+}
+
+var sanitizerPolicies = map[string]*sanitizerPolicy{
+	"fuzzer":           fuzzerSanitizerPolicy,
+	"fuzzer-no-link":   fuzzerSanitizerPolicy,
+	"hwaddress":        hwasanSanitizerPolicy,
+	"kernel-hwaddress": hwasanSanitizerPolicy,
+	"memory": {
+		incompatibleFlags: defaultSanitizerIncompatibleFlags,
+		supportedArches:   []string{"x86_64"},
+		clangOnly:         true,
+	},
+	"thread": {
+		incompatibleFlags: defaultSanitizerIncompatibleFlags,
+		supportedArches:   []string{"x86_64", "aarch64"},
+	},
+	"cfi": {
+		incompatibleFlags:  defaultSanitizerIncompatibleFlags,
+		requiredClangFlags: []string{"-flto"},
+		clangOnly:          true,
+	},
+}
+
+// Used for all sanitizers without an explicit policy, e.g.
+// address, kernel-address and undefined.
+var defaultSanitizerPolicy = &sanitizerPolicy{
+	incompatibleFlags: defaultSanitizerIncompatibleFlags,
+}
+
+func getSanitizerPolicy(sanitizer string) *sanitizerPolicy {
+	if policy, ok := sanitizerPolicies[sanitizer]; ok {
+		return policy
+	}
+	if strings.HasPrefix(sanitizer, "cfi-") {
+		return sanitizerPolicies["cfi"]
+	}
+	return defaultSanitizerPolicy
+}
+
+type enabledSanitizer struct {
+	name string
+	// Whether the sanitizer was enabled by a user flag, in contrast
+	// to e.g. a flag from the config or a hardening profile.
+	fromUser bool
+}
+
+// Returns the sanitizers that are enabled by all args, taking
+// -fno-sanitize= into account. The order is the order in which the
+// sanitizers were first enabled.
+func getEnabledSanitizers(builder *commandBuilder) []enabledSanitizer {
+	enabled := []enabledSanitizer{}
 	for _, arg := range builder.args {
-		// TODO: This should probably be -fsanitize= to not match on
-		// e.g. -fsanitize-blacklist
-		if arg.fromUser {
-			if strings.HasPrefix(arg.value, "-fsanitize") {
-				hasSanitizeFlags = true
-				if strings.Contains(arg.value, "fuzzer") {
-					hasSanitizeFuzzerFlags = true
+		if list := strings.TrimPrefix(arg.value, "-fsanitize="); list != arg.value {
+			for _, name := range strings.Split(list, ",") {
+				if name == "" {
+					continue
+				}
+				if i := indexOfSanitizer(enabled, name); i >= 0 {
+					enabled[i].fromUser = enabled[i].fromUser || arg.fromUser
+				} else {
+					enabled = append(enabled, enabledSanitizer{name: name, fromUser: arg.fromUser})
+				}
+			}
+		} else if list := strings.TrimPrefix(arg.value, "-fno-sanitize="); list != arg.value {
+			for _, name := range strings.Split(list, ",") {
+				if name == "all" {
+					enabled = enabled[:0]
+				} else if i := indexOfSanitizer(enabled, name); i >= 0 {
+					enabled = append(enabled[:i], enabled[i+1:]...)
 				}
-			} else if arg.value == "-fprofile-instr-generate" {
-				hasCoverageFlags = true
 			}
 		}
 	}
-	if hasSanitizeFlags {
-		// Flags not supported by sanitizers (ASan etc.)
-		unsupportedSanitizerFlags := map[string]bool{
-			"-D_FORTIFY_SOURCE=1": true,
-			"-D_FORTIFY_SOURCE=2": true,
-			"-Wl,--no-undefined":  true,
-			"-Wl,-z,defs":         true,
+	return enabled
+}
+
+func indexOfSanitizer(sanitizers []enabledSanitizer, name string) int {
+	for i, sanitizer := range sanitizers {
+		if sanitizer.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func processSanitizerFlags(builder *commandBuilder) error {
+	hasCoverageFlags := false
+	hasSanitizerCoverage := false
+	for _, arg := range builder.args {
+		// Note: Also considering non user args here for WITH_COVERAGE.
+		if arg.value == "-fprofile-instr-generate" || strings.HasPrefix(arg.value, "-fprofile-instr-generate=") {
+			hasCoverageFlags = true
+		}
+		if arg.fromUser && strings.HasPrefix(arg.value, "-fsanitize-coverage=") {
+			hasSanitizerCoverage = true
 		}
+	}
+	sanitizers := getEnabledSanitizers(builder)
+	if len(sanitizers) == 0 && !hasSanitizerCoverage {
+		return nil
+	}
 
-		builder.transformArgs(func(arg builderArg) string {
-			// TODO: This is a bug in the old wrapper to not filter
-			// non user args for gcc. Fix this once we don't compare to the old wrapper anymore.
-			if (builder.target.compilerType != gccType || arg.fromUser) &&
-				unsupportedSanitizerFlags[arg.value] {
-				return ""
+	incompatibleFlags := map[string]bool{}
+	if hasSanitizerCoverage {
+		// -fsanitize-coverage= instruments the code like a sanitizer
+		// does, even without one being enabled.
+		for _, flag := range defaultSanitizerIncompatibleFlags {
+			incompatibleFlags[flag] = true
+		}
+	}
+	flagsToAdd := []string{}
+	for _, sanitizer := range sanitizers {
+		policy := getSanitizerPolicy(sanitizer.name)
+		if arch := builder.target.arch; arch != "" && len(policy.supportedArches) > 0 &&
+			!hasAtLeastOnePrefix(arch, policy.supportedArches) {
+			return newUserErrorf("-fsanitize=%s is not supported on %s", sanitizer.name, arch)
+		}
+		// Note: Sanitizers from non user args, e.g. from a hardening
+		// profile, don't filter flags, to match the old wrapper.
+		if sanitizer.fromUser {
+			for _, flag := range policy.incompatibleFlags {
+				incompatibleFlags[flag] = true
 			}
-			return arg.value
-		})
-		if builder.target.compilerType == clangType {
-			// hasSanitizeFlags && hasCoverageFlags is to work around crbug.com/1013622
-			if hasSanitizeFuzzerFlags || (hasSanitizeFlags && hasCoverageFlags) {
-				fuzzerFlagsToAdd := []string{
-					// TODO: This flag should be removed once fuzzer works with new pass manager
-					"-fno-experimental-new-pass-manager",
-				}
-				builder.addPreUserArgs(fuzzerFlagsToAdd...)
+		}
+		switch builder.target.compilerType {
+		case clangType:
+			if len(policy.requiredClangFlags) > 0 && !hasEnabledArgWithPrefix(builder, policy.requiredClangFlags) {
+				return newUserErrorf("-fsanitize=%s requires one of %s", sanitizer.name,
+					strings.Join(policy.requiredClangFlags, ", "))
+			}
+			flagsToAdd = appendMissingStrings(flagsToAdd, policy.clangFlags...)
+		case gccType:
+			if policy.clangOnly {
+				return newUserErrorf("-fsanitize=%s is not supported by gcc", sanitizer.name)
 			}
 		}
 	}
+	// hasCoverageFlags is to work around crbug.com/1013622
+	if builder.target.compilerType == clangType && hasCoverageFlags {
+		flagsToAdd = appendMissingStrings(flagsToAdd, fuzzerSanitizerPolicy.clangFlags...)
+	}
+
+	builder.transformArgs(func(arg builderArg) string {
+		// Note: This is a bug in the old wrapper to not filter
+		// non user args for gcc.
+		oldWrapperCompat := !builder.cfg.disableOldWrapperCompat && builder.target.compilerType == gccType
+		if (!oldWrapperCompat || arg.fromUser) &&
+			incompatibleFlags[arg.value] {
+			return ""
+		}
+		return arg.value
+	})
+	builder.addPreUserArgs(flagsToAdd...)
+	return nil
+}
+
+// Returns whether any arg has one of the given -f prefixes and is not
+// disabled again by a later -fno- flag, e.g. -flto followed by -fno-lto.
+func hasEnabledArgWithPrefix(builder *commandBuilder, prefixes []string) bool {
+	enabled := false
+	for _, arg := range builder.args {
+		if hasAtLeastOnePrefix(arg.value, prefixes) {
+			enabled = true
+			continue
+		}
+		for _, prefix := range prefixes {
+			if arg.value == "-fno-"+strings.TrimPrefix(prefix, "-f") {
+				enabled = false
+			}
+		}
+	}
+	return enabled
+}
+
+func hasUserArgWithPrefix(builder *commandBuilder, prefixes []string) bool {
+	for _, arg := range builder.args {
+		if arg.fromUser && hasAtLeastOnePrefix(arg.value, prefixes) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMissingStrings(values []string, newValues ...string) []string {
+	for _, v := range newValues {
+		if !containsString(values, v) {
+			values = append(values, v)
+		}
+	}
+	return values
 }
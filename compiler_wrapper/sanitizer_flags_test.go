@@ -5,6 +5,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -150,3 +151,162 @@ func TestKeepSanitizerCoverageFlagsForClang(t *testing.T) {
 		}
 	})
 }
+
+func TestIgnoreSanitizerOptionsWithoutSanitizer(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize-blacklist=list.txt", "-Wl,--no-undefined", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-Wl,--no-undefined"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestFilterUnsupportedSanitizerFlagsIfSanitizerCoverageGiven(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize-coverage=trace-pc-guard", "-D_FORTIFY_SOURCE=2", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-D_FORTIFY_SOURCE=2"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddSanitizerCoverageFlagsForSanitizerCoverageWithClang(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize-coverage=trace-pc-guard", "-fprofile-instr-generate", mainCc)))
+		if err := verifyArgOrder(cmd, "-fno-experimental-new-pass-manager",
+			"-fsanitize-coverage=trace-pc-guard", mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKeepSanitizerFlagsIfSanitizerIsDisabledAgain(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=address,undefined", "-fno-sanitize=address,undefined",
+				"-Wl,--no-undefined", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-Wl,--no-undefined"); err != nil {
+			t.Error(err)
+		}
+
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=address", "-fno-sanitize=all", "-Wl,--no-undefined", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-Wl,--no-undefined"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestParseSanitizerLists(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		builder, err := newCommandBuilder(ctx, ctx.cfg, ctx.newCommand(clangX86_64,
+			"-fsanitize=address,undefined", "-fno-sanitize=undefined", "-fsanitize=fuzzer,address", mainCc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, sanitizer := range getEnabledSanitizers(builder) {
+			names = append(names, sanitizer.name)
+		}
+		if strings.Join(names, ",") != "address,fuzzer" {
+			t.Errorf("unexpected sanitizers. Got: %s", names)
+		}
+	})
+}
+
+func TestAddFuzzerFlagsForFuzzerInSanitizerList(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=address,fuzzer-no-link", mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fno-experimental-new-pass-manager"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForSanitizerOnUnsupportedArch(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=hwaddress", mainCc)))
+		if err := verifyNonInternalError(stderr, "-fsanitize=hwaddress is not supported on x86_64"); err != nil {
+			t.Error(err)
+		}
+
+		stderr = ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccArmV7, "-fsanitize=memory", mainCc)))
+		if !strings.Contains(stderr, "-fsanitize=memory is not supported on armv7m") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+	})
+}
+
+func TestAllowSanitizerOnSupportedArch(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand("./aarch64-cros-linux-gnu-clang", "-fsanitize=hwaddress", mainCc)))
+	})
+}
+
+func TestReportErrorForCfiWithoutLto(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=cfi-icall", mainCc)))
+		if err := verifyNonInternalError(stderr, "-fsanitize=cfi-icall requires one of -flto"); err != nil {
+			t.Error(err)
+		}
+
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=cfi", "-flto=thin", mainCc)))
+
+		stderr = ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=cfi", "-flto", "-fno-lto", mainCc)))
+		if !strings.Contains(stderr, "-fsanitize=cfi requires one of -flto") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+	})
+}
+
+func TestCheckCfiWithLtoFromConfig(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.commonFlags = []string{"-flto"}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-fsanitize=cfi", mainCc)))
+
+		ctx.cfg.commonFlags = []string{"-fsanitize=cfi"}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "-fsanitize=cfi requires one of -flto"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAllowCfiFromStrictHardeningProfile(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.hardeningProfile = "strict"
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyArgCount(cmd, 1, "-fsanitize=cfi"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReportErrorForClangOnlySanitizerWithGcc(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-fsanitize=memory", mainCc)))
+		if err := verifyNonInternalError(stderr, "-fsanitize=memory is not supported by gcc"); err != nil {
+			t.Error(err)
+		}
+
+		stderr = ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "-fsanitize=cfi-icall", "-flto", mainCc)))
+		if !strings.Contains(stderr, "-fsanitize=cfi-icall is not supported by gcc") {
+			t.Errorf("unexpected error. Got: %s", stderr)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const shadowCompilerKey = "SHADOW_COMPILER"
+const shadowCompilerModeKey = "SHADOW_COMPILER_MODE"
+
+type shadowCompilerMode int32
+
+const (
+	// Run the shadow compiler with -fsyntax-only.
+	shadowSyntaxOnly shadowCompilerMode = iota
+	// Run a full compile of the shadow compiler into a temporary output.
+	shadowFullCompile
+)
+
+type shadowCompilerSettings struct {
+	path string
+	mode shadowCompilerMode
+}
+
+// Returns nil if no shadow compiler was requested.
+func getShadowCompilerSettings(env env) (*shadowCompilerSettings, error) {
+	shadowPath, _ := env.getenv(shadowCompilerKey)
+	if shadowPath == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(shadowPath) && !strings.ContainsRune(shadowPath, filepath.Separator) {
+		resolvedPath, err := resolveAgainstPathEnv(env, shadowPath)
+		if err != nil {
+			return nil, newUserErrorf("%s: %s", shadowCompilerKey, err)
+		}
+		shadowPath = resolvedPath
+	}
+	settings := &shadowCompilerSettings{path: shadowPath}
+	modeValue, _ := env.getenv(shadowCompilerModeKey)
+	switch modeValue {
+	case "", "syntax":
+		settings.mode = shadowSyntaxOnly
+	case "compile":
+		settings.mode = shadowFullCompile
+	default:
+		return nil, newUserErrorf("%s must be one of syntax, compile. Got: %q", shadowCompilerModeKey, modeValue)
+	}
+	return settings, nil
+}
+
+// Returns the type of the shadow compiler based on its name, e.g.
+// clangType for clang-12 and gccType for x86_64-cros-linux-gnu-gcc.
+func getShadowCompilerType(settings *shadowCompilerSettings) compilerType {
+	if strings.Contains(filepath.Base(settings.path), "clang") {
+		return clangType
+	}
+	return gccType
+}
+
+// Calculates the command for the shadow compiler. builder must be a clone of
+// the main builder before any config flags were added. The shadow compiler
+// gets the flags of the config for its own compiler type, but no launchers
+// like ccache or gomacc.
+func calcShadowCommand(settings *shadowCompilerSettings, builder *commandBuilder, sourceRules []*sourceRule, pkgOverride *packageOverride) (*command, error) {
+	shadowType := getShadowCompilerType(settings)
+	cxx := strings.HasSuffix(builder.target.compiler, "++")
+	builder.target.compilerType = shadowType
+	switch shadowType {
+	case clangType:
+		builder.target.compiler = "clang"
+		if cxx {
+			builder.target.compiler = "clang++"
+		}
+		if builder.cfg.isAndroidWrapper {
+			builder.addPreUserArgs(builder.cfg.clangFlags...)
+			builder.addPreUserArgs(builder.cfg.commonFlags...)
+		} else if _, err := prepareClangCommand(builder); err != nil {
+			return nil, err
+		}
+	default:
+		if builder.cfg.isAndroidWrapper {
+			return nil, newUserErrorf("%s: the android wrapper only supports clang. Got: %s", shadowCompilerKey, settings.path)
+		}
+		builder.target.compiler = "gcc"
+		if cxx {
+			builder.target.compiler = "g++"
+		}
+		if _, err := prepareGccCommand(builder); err != nil {
+			return nil, err
+		}
+	}
+	pkgOverride.processFlags(builder)
+	processSourceRules(builder, sourceRules)
+	removeDependencyFileArgs(builder)
+	builder.path = settings.path
+	return builder.build(), nil
+}
+
+// Don't let the shadow compiler overwrite the dependency files
+// of the primary compiler.
+func removeDependencyFileArgs(builder *commandBuilder) {
+	nextArgIsDepFile := false
+	builder.transformArgs(func(arg builderArg) string {
+		if nextArgIsDepFile {
+			nextArgIsDepFile = false
+			return ""
+		}
+		switch arg.value {
+		case "-MD", "-MMD":
+			return ""
+		case "-MF", "-MT", "-MQ":
+			nextArgIsDepFile = true
+			return ""
+		}
+		if hasAtLeastOnePrefix(arg.value, []string{"-MF", "-MT", "-MQ"}) {
+			return ""
+		}
+		return arg.value
+	})
+}
+
+func runWithShadowCompiler(env env, cfg *config, settings *shadowCompilerSettings, compilerCmd *command, shadowCmd *command) (exitCode int, err error) {
+	compilerCmd = forceColorDiagnostics(env, compilerCmd)
+	stdinBuffer := &bytes.Buffer{}
+	stderrBuffer := &bytes.Buffer{}
+	exitCode, err = wrapSubprocessErrorWithSourceLoc(compilerCmd,
+		env.run(compilerCmd, teeStdinIfNeeded(env, compilerCmd, stdinBuffer), env.stdout(), io.MultiWriter(env.stderr(), stderrBuffer)))
+	if err != nil {
+		return 0, err
+	}
+
+	// Note: The shadow compiler must never fail the build, so all errors
+	// from here on are only recorded in the report.
+	shadowStderr, shadowExitCode, shadowErr := runShadowCommand(env, settings, shadowCmd, stdinBuffer)
+	primaryDiags := parseDiagnostics(stripANSIEscapes(stderrBuffer.String()))
+	shadowDiags := parseDiagnostics(stripANSIEscapes(shadowStderr))
+	report := shadowCompilerReport{
+		Cwd:              env.getwd(),
+		Command:          append([]string{compilerCmd.Path}, compilerCmd.Args...),
+		ExitCode:         exitCode,
+		ShadowCommand:    append([]string{shadowCmd.Path}, shadowCmd.Args...),
+		ShadowExitCode:   shadowExitCode,
+		PrimaryOnlyDiags: diagnosticsDifference(primaryDiags, shadowDiags),
+		ShadowOnlyDiags:  diagnosticsDifference(shadowDiags, primaryDiags),
+	}
+	if shadowErr != nil {
+		report.ShadowError = shadowErr.Error()
+	}
+	if shadowErr != nil || shadowExitCode != exitCode ||
+		len(report.PrimaryOnlyDiags) > 0 || len(report.ShadowOnlyDiags) > 0 {
+		// Note: Errors while writing the report are ignored on purpose.
+		_ = writeShadowCompilerReport(env, cfg.shadowCompilerLogDir, &report)
+	}
+	return exitCode, nil
+}
+
+func runShadowCommand(env env, settings *shadowCompilerSettings, shadowCmd *command, stdinBuffer *bytes.Buffer) (stderr string, exitCode int, err error) {
+	switch settings.mode {
+	case shadowFullCompile:
+		tmpDir, err := env.fs().tempDir("", "shadow_compiler")
+		if err != nil {
+			return "", 0, err
+		}
+		defer env.fs().removeAll(tmpDir)
+		if !replaceOutputArg(shadowCmd, filepath.Join(tmpDir, "shadow.out")) {
+			// Without an explicit output we would overwrite the
+			// output of the primary compiler.
+			shadowCmd.Args = append(shadowCmd.Args, "-fsyntax-only")
+		}
+	default:
+		shadowCmd.Args = append(shadowCmd.Args, "-fsyntax-only")
+	}
+	stderrBuffer := &bytes.Buffer{}
+	exitCode, err = wrapSubprocessErrorWithSourceLoc(shadowCmd,
+		env.run(shadowCmd, bytes.NewReader(stdinBuffer.Bytes()), ioutil.Discard, stderrBuffer))
+	return stderrBuffer.String(), exitCode, err
+}
+
+// Replaces the value of the -o argument. Returns false if there was no -o argument.
+func replaceOutputArg(cmd *command, newOutput string) bool {
+	found := false
+	for i, arg := range cmd.Args {
+		if arg == "-o" && i+1 < len(cmd.Args) {
+			cmd.Args[i+1] = newOutput
+			found = true
+		} else if strings.HasPrefix(arg, "-o") && len(arg) > 2 {
+			cmd.Args[i] = "-o" + newOutput
+			found = true
+		}
+	}
+	return found
+}
+
+func writeShadowCompilerReport(env env, logDir string, report *shadowCompilerReport) error {
+	// Allow root and regular users to write to this without issue.
+	oldMask := env.fs().umask(0)
+	defer env.fs().umask(oldMask)
+	if err := env.fs().mkdirAll(logDir, 0777); err != nil {
+		return err
+	}
+	logFile, err := env.fs().tempFile(logDir, "shadow_report*.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(logFile).Encode(report); err != nil {
+		_ = logFile.Close()
+		return err
+	}
+	return logFile.Close()
+}
+
+// Struct used to write JSON. Fields have to be uppercase for the json
+// encoder to read them.
+type shadowCompilerReport struct {
+	Cwd              string       `json:"cwd"`
+	Command          []string     `json:"command"`
+	ExitCode         int          `json:"exitcode"`
+	ShadowCommand    []string     `json:"shadow_command"`
+	ShadowExitCode   int          `json:"shadow_exitcode"`
+	ShadowError      string       `json:"shadow_error,omitempty"`
+	PrimaryOnlyDiags []diagnostic `json:"primary_only_diagnostics"`
+	ShadowOnlyDiags  []diagnostic `json:"shadow_only_diagnostics"`
+}
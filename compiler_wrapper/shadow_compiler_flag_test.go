@@ -0,0 +1,367 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCallShadowCompilerAfterPrimaryCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				if err := verifyPath(cmd, "usr/bin/clang"); err != nil {
+					return err
+				}
+				return verifyArgCount(cmd, 0, "-fsyntax-only")
+			case 2:
+				if err := verifyPath(cmd, "/tmp/shadow/clang"); err != nil {
+					return err
+				}
+				return verifyArgOrder(cmd, mainCc, "-fsyntax-only")
+			default:
+				return fmt.Errorf("unexpected call %#v", cmd)
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestCallShadowCompilerForGcc(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 1 {
+				return verifyPath(cmd, gccX86_64+".real")
+			}
+			return verifyPath(cmd, "/tmp/shadow/clang")
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestResolveShadowCompilerAgainstPath(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeFile(filepath.Join(ctx.tempDir, "shadowbin", "clang-next"), "")
+		ctx.env = []string{
+			"SHADOW_COMPILER=clang-next",
+			"PATH=" + filepath.Join(ctx.tempDir, "shadowbin"),
+		}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 2 {
+				return verifyPath(cmd, filepath.Join(ctx.tempDir, "shadowbin", "clang-next"))
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+	})
+}
+
+func TestOmitLaunchersForShadowCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		gomaPath := path.Join(ctx.tempDir, "gomacc")
+		ctx.writeFile(gomaPath, "")
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"GOMACC_PATH=" + gomaPath,
+		}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 1 {
+				return verifyPath(cmd, gomaPath)
+			}
+			if err := verifyPath(cmd, "/tmp/shadow/clang"); err != nil {
+				return err
+			}
+			return verifyArgCount(cmd, 0, ".*usr/bin/clang")
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+	})
+}
+
+func TestOmitDependencyFilesForShadowCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 2 {
+				if err := verifyArgCount(cmd, 0, "-MD|-MF|-MT|main.d|main.o"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-MD", "-MF", "main.d", "-MTmain.o", mainCc)))
+	})
+}
+
+func TestShadowCompilerCompileModeUsesTempOutput(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"SHADOW_COMPILER_MODE=compile",
+		}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 2 {
+				if err := verifyArgCount(cmd, 0, "-fsyntax-only"); err != nil {
+					return err
+				}
+				if err := verifyArgCount(cmd, 0, "main.o"); err != nil {
+					return err
+				}
+				return verifyArgOrder(cmd, "-o", ".*/shadow.out")
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc, "-o", "main.o")))
+	})
+}
+
+func TestShadowCompilerCompileModeWithoutOutputFallsBackToSyntaxOnly(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"SHADOW_COMPILER_MODE=compile",
+		}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 2 {
+				return verifyArgCount(cmd, 1, "-fsyntax-only")
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+	})
+}
+
+func TestReportErrorForInvalidShadowCompilerMode(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"SHADOW_COMPILER_MODE=invalid",
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "SHADOW_COMPILER_MODE must be one of syntax, compile.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestShadowCompilerDoesNotFailBuild(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				return nil
+			case 2:
+				fmt.Fprint(stderr, "main.cc:1:2: error: shadowerror")
+				return newExitCodeError(1)
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if strings.Contains(ctx.stderrString(), "shadowerror") {
+			t.Errorf("shadow compiler stderr was forwarded. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestShadowCompilerForwardsExitCodeOfPrimaryCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				return newExitCodeError(23)
+			case 2:
+				return errors.New("someerror")
+			}
+			return nil
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+		if exitCode != 23 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+	})
+}
+
+func TestForwardStdinToShadowCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if stdinStr := ctx.readAllString(stdin); stdinStr != "someinput" {
+				return fmt.Errorf("unexpected stdin. Got: %s", stdinStr)
+			}
+			return nil
+		}
+		io.WriteString(&ctx.stdinBuffer, "someinput")
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-x", "c", "-")))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestWriteShadowCompilerReportOnDifferences(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprintln(stderr, "main.cc:1:2: warning: common [-Wcommon]")
+			case 2:
+				fmt.Fprintln(stderr, "main.cc:1:2: warning: common [-Wcommon]")
+				fmt.Fprintln(stderr, "main.cc:3:4: warning: new [-Wnew]")
+			}
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+
+		report := readShadowCompilerReport(ctx)
+		if report.ExitCode != 0 || report.ShadowExitCode != 0 {
+			t.Errorf("unexpected exit codes. Got: %#v", report)
+		}
+		if len(report.PrimaryOnlyDiags) != 0 {
+			t.Errorf("unexpected primary only diagnostics. Got: %#v", report.PrimaryOnlyDiags)
+		}
+		if len(report.ShadowOnlyDiags) != 1 || report.ShadowOnlyDiags[0].Flag != "-Wnew" {
+			t.Errorf("unexpected shadow only diagnostics. Got: %#v", report.ShadowOnlyDiags)
+		}
+	})
+}
+
+func TestNoShadowCompilerReportWithoutDifferences(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprintln(stderr, "main.cc:1:2: warning: common [-Wcommon]")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if files, _ := ioutil.ReadDir(ctx.cfg.shadowCompilerLogDir); len(files) != 0 {
+			t.Errorf("expected no shadow compiler reports. Got: %d", len(files))
+		}
+	})
+}
+
+func TestReportErrorForShadowCompilerWithGetRusage(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"GETRUSAGE=" + filepath.Join(ctx.tempDir, "rusage.log"),
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "GETRUSAGE is meaningless with SHADOW_COMPILER"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUseGccFlagsForGccShadowCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-someclangflag"}
+		ctx.cfg.gccFlags = []string{"-somegccflag"}
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/x86_64-cros-linux-gnu-gcc"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 1 {
+				return verifyArgCount(cmd, 1, "-someclangflag")
+			}
+			if err := verifyPath(cmd, "/tmp/shadow/x86_64-cros-linux-gnu-gcc"); err != nil {
+				return err
+			}
+			if err := verifyArgCount(cmd, 0, "-someclangflag"); err != nil {
+				return err
+			}
+			return verifyArgCount(cmd, 1, "-somegccflag")
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestUseClangFlagsForClangShadowCompiler(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-someclangflag"}
+		ctx.cfg.gccFlags = []string{"-somegccflag"}
+		ctx.env = []string{"SHADOW_COMPILER=/tmp/shadow/clang"}
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			if ctx.cmdCount == 1 {
+				return verifyArgCount(cmd, 1, "-somegccflag")
+			}
+			if err := verifyArgCount(cmd, 0, "-somegccflag"); err != nil {
+				return err
+			}
+			return verifyArgCount(cmd, 1, "-someclangflag")
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, mainCc)))
+		if ctx.cmdCount != 2 {
+			t.Errorf("expected 2 calls. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestReportErrorForShadowCompilerWithForceDisableWError(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = []string{
+			"SHADOW_COMPILER=/tmp/shadow/clang",
+			"FORCE_DISABLE_WERROR=1",
+		}
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "SHADOW_COMPILER is meaningless with FORCE_DISABLE_WERROR"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func readShadowCompilerReport(ctx *testContext) *shadowCompilerReport {
+	files, err := ioutil.ReadDir(ctx.cfg.shadowCompilerLogDir)
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	if len(files) != 1 {
+		ctx.t.Fatalf("expected 1 shadow compiler report. Got: %d", len(files))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.cfg.shadowCompilerLogDir, files[0].Name()))
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	report := &shadowCompilerReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		ctx.t.Fatal(err)
+	}
+	return report
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const sourceRulesFileKey = "COMPILER_WRAPPER_SOURCE_RULES"
+
+// A rule that adds or removes flags based on the source files and the
+// output file of the invocation. Patterns are matched against the absolute
+// path of the files and may contain `**` to match any number of directories.
+//
+// Precedence: pre_flags are added before the user flags, so user flags
+// override them. post_flags are added after the user flags, so they override
+// user flags. remove_flags are removed from the wrapper flags as well as from
+// the user flags. All matching rules are applied in the order of the rules file.
+type sourceRule struct {
+	Sources     []string `json:"sources,omitempty"`
+	Outputs     []string `json:"outputs,omitempty"`
+	PreFlags    []string `json:"pre_flags,omitempty"`
+	PostFlags   []string `json:"post_flags,omitempty"`
+	RemoveFlags []string `json:"remove_flags,omitempty"`
+}
+
+func loadSourceRules(env env, cfg *config, rootPath string) ([]*sourceRule, error) {
+	rulesFile, _ := env.getenv(sourceRulesFileKey)
+	if rulesFile == "" {
+		if cfg.sourceRulesRelPath == "" {
+			return nil, nil
+		}
+		rulesFile = filepath.Join(rootPath, cfg.sourceRulesRelPath)
+	}
+	data, err := env.fs().readFile(rulesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, wrapErrorwithSourceLocf(err, "failed to read source rules %s", rulesFile)
+	}
+	rules := []*sourceRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, newUserErrorf("invalid source rules file %s: %s", rulesFile, err)
+	}
+	for _, rule := range rules {
+		for _, pattern := range append(append([]string{}, rule.Sources...), rule.Outputs...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, newUserErrorf("invalid pattern %q in %s", pattern, rulesFile)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func processSourceRules(builder *commandBuilder, rules []*sourceRule) {
+	if len(rules) == 0 {
+		return
+	}
+	sources, output := getSourcesAndOutput(builder)
+	for _, rule := range rules {
+		if !rule.matches(sources, output) {
+			continue
+		}
+		builder.removeArgs(rule.RemoveFlags...)
+		builder.addPreUserArgs(rule.PreFlags...)
+		builder.addPostUserArgs(rule.PostFlags...)
+	}
+}
+
+// A rule matches if at least one of the source patterns matches one of the
+// sources and at least one of the output patterns matches the output. Empty
+// pattern lists match everything.
+func (rule *sourceRule) matches(sources []string, output string) bool {
+	if len(rule.Sources) > 0 && !matchesAnyPathGlob(rule.Sources, sources) {
+		return false
+	}
+	if len(rule.Outputs) > 0 && (output == "" || !matchesAnyPathGlob(rule.Outputs, []string{output})) {
+		return false
+	}
+	return true
+}
+
+// Returns the absolute paths of the source files and the output file
+// given by the user.
+func getSourcesAndOutput(builder *commandBuilder) (sources []string, output string) {
+	absPath := func(p string) string {
+		if filepath.IsAbs(p) {
+			return filepath.Clean(p)
+		}
+		return filepath.Join(builder.env.getwd(), p)
+	}
+	for _, input := range builder.invocation.sourceInputs() {
+		sources = append(sources, absPath(input.path))
+	}
+	if builder.invocation.output != "" {
+		output = absPath(builder.invocation.output)
+	}
+	return sources, output
+}
+
+func matchesAnyPathGlob(patterns []string, paths []string) bool {
+	for _, pattern := range patterns {
+		for _, p := range paths {
+			if matchPathGlob(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Like path.Match, but `**` matches any number of path elements.
+func matchPathGlob(pattern string, p string) bool {
+	return matchPathElements(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchPathElements(patternElems []string, pathElems []string) bool {
+	if len(patternElems) == 0 {
+		return len(pathElems) == 0
+	}
+	if patternElems[0] == "**" {
+		for i := 0; i <= len(pathElems); i++ {
+			if matchPathElements(patternElems[1:], pathElems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathElems) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(patternElems[0], pathElems[0]); !matched {
+		return false
+	}
+	return matchPathElements(patternElems[1:], pathElems[1:])
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	testData := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"/src/*.c", "/src/main.c", true},
+		{"/src/*.c", "/src/sub/main.c", false},
+		{"/src/**/*.c", "/src/main.c", true},
+		{"/src/**/*.c", "/src/a/b/main.c", true},
+		{"**/generated/*", "/out/gen/generated/parser.c", true},
+		{"**/generated/*", "/out/gen/parser.c", false},
+		{"/src/**", "/src/a/b/main.c", true},
+		{"/other/**", "/src/main.c", false},
+	}
+	for _, tt := range testData {
+		if matches := matchPathGlob(tt.pattern, tt.path); matches != tt.matches {
+			t.Errorf("matchPathGlob(%q, %q) = %t, expected %t", tt.pattern, tt.path, matches, tt.matches)
+		}
+	}
+}
+
+func TestAddSourceRuleFlagsForMatchingSource(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeSourceRules(`[
+			{"sources": ["**/generated/*.c"], "pre_flags": ["-Wno-pre"], "post_flags": ["-O1"]},
+			{"sources": ["**/other/*.c"], "post_flags": ["-Wrong"]}
+		]`)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-O2", "generated/parser.c")))
+		if err := verifyArgOrder(cmd, "-Wno-pre", "-O2", "generated/parser.c", "-O1"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "-Wrong"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMatchSourceRulesAgainstCwd(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeSourceRules(`[{"sources": ["` + ctx.tempDir + `/*.c"], "post_flags": ["-Wcwd"]}]`)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(gccX86_64, "main.c")))
+		if err := verifyArgCount(cmd, 1, "-Wcwd"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAddSourceRuleFlagsForMatchingOutput(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeSourceRules(`[{"outputs": ["**/third_party/**"], "post_flags": ["-Wno-error"]}]`)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc, "-o", "out/third_party/main.o")))
+		if err := verifyArgCount(cmd, 1, "-Wno-error"); err != nil {
+			t.Error(err)
+		}
+
+		cmd = ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-c", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-Wno-error"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRemoveSourceRuleFlags(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.cfg.clangFlags = []string{"-Wconfig"}
+		ctx.writeSourceRules(`[{"sources": ["**/*.cc"], "remove_flags": ["-Wconfig", "-Werror"]}]`)
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-Werror", mainCc)))
+		if err := verifyArgCount(cmd, 0, "-Wconfig|-Werror"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestShowSourceRuleFlagsInPrintCmdline(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeSourceRules(`[{"sources": ["**/*.cc"], "post_flags": ["-Wfromrule"]}]`)
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "-print-cmdline", mainCc)))
+		if !strings.Contains(ctx.stderrString(), "'-Wfromrule'") {
+			t.Errorf("source rule flags not printed. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestReportErrorForInvalidSourceRulePattern(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.writeSourceRules(`[{"sources": ["[-"]}]`)
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid pattern "\[-" in .*`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func (ctx *testContext) writeSourceRules(content string) {
+	rulesFile := filepath.Join(ctx.tempDir, "source_rules.json")
+	ctx.writeFile(rulesFile, content)
+	ctx.env = append(ctx.env, "COMPILER_WRAPPER_SOURCE_RULES="+rulesFile)
+}
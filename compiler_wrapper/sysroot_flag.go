@@ -6,17 +6,20 @@ package main
 
 import (
 	"path/filepath"
-	"strings"
 )
 
 func processSysrootFlag(builder *commandBuilder) string {
-	fromUser := false
-	for _, arg := range builder.args {
-		if arg.fromUser && strings.HasPrefix(arg.value, "--sysroot=") {
-			fromUser = true
-			break
-		}
+	fromUser := builder.invocation.sysrootFromUser
+	sysroot := getSysroot(builder)
+	if !fromUser {
+		builder.addPreUserArgs("--sysroot=" + sysroot)
 	}
+	return sysroot
+}
+
+// Returns the sysroot from the SYSROOT env variable or the bundled sysroot,
+// and removes SYSROOT from the env of the compiler.
+func getSysroot(builder *commandBuilder) string {
 	sysroot, syrootPresent := builder.env.getenv("SYSROOT")
 	if syrootPresent {
 		builder.updateEnv("SYSROOT=")
@@ -25,8 +28,5 @@ func processSysrootFlag(builder *commandBuilder) string {
 		// Use the bundled sysroot by default.
 		sysroot = filepath.Join(builder.rootPath, "usr", builder.target.target)
 	}
-	if !fromUser {
-		builder.addPreUserArgs("--sysroot=" + sysroot)
-	}
 	return sysroot
 }
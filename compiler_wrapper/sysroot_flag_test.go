@@ -27,6 +27,32 @@ func TestOmitSysrootGivenUserDefinedSysroot(t *testing.T) {
 	})
 }
 
+func TestOmitSysrootGivenUserDefinedSeparateSysroot(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "--sysroot", "/somepath", mainCc)))
+		if err := verifyArgOrder(cmd, "--sysroot", "/somepath", mainCc); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgCount(cmd, 0, "--sysroot=.*"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOmitSysrootGivenUserDefinedEmptySysroot(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		cmd := ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, "--sysroot=", mainCc)))
+		if err := verifyArgCount(cmd, 1, "--sysroot.*"); err != nil {
+			t.Error(err)
+		}
+		if err := verifyArgOrder(cmd, "--sysroot=", mainCc); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestSetSysrootFlagFromEnv(t *testing.T) {
 	withTestContext(t, func(ctx *testContext) {
 		ctx.env = []string{"SYSROOT=/envpath"}
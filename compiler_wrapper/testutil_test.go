@@ -14,13 +14,16 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 )
 
 const mainCc = "main.cc"
+const mainRs = "main.rs"
 const clangAndroid = "./clang"
 const clangX86_64 = "./x86_64-cros-linux-gnu-clang"
 const gccX86_64 = "./x86_64-cros-linux-gnu-gcc"
+const rustcX86_64 = "./x86_64-cros-linux-gnu-rustc"
 const gccX86_64Eabi = "./x86_64-cros-eabi-gcc"
 const gccArmV7 = "./armv7m-cros-linux-gnu-gcc"
 const gccArmV7Eabi = "./armv7m-cros-eabi-gcc"
@@ -40,6 +43,14 @@ type testContext struct {
 	stdinBuffer  bytes.Buffer
 	stdoutBuffer bytes.Buffer
 	stderrBuffer bytes.Buffer
+	// Guards cmdCount and lastCmd, as e.g. clang-tidy is run in parallel.
+	// cmdMock is called without holding it, so that commands can
+	// complete in any order.
+	cmdMutex sync.Mutex
+	// The os file system, or a *memFileSystem, see useMemFileSystem.
+	fsys fileSystem
+	// Value for stderrIsTerminal.
+	stderrTerminal bool
 }
 
 func withTestContext(t *testing.T, work func(ctx *testContext)) {
@@ -56,6 +67,7 @@ func withTestContext(t *testing.T, work func(ctx *testContext)) {
 		tempDir: tempDir,
 		env:     nil,
 		cfg:     &config{},
+		fsys:    osFileSystem{},
 	}
 	ctx.updateConfig(&config{})
 
@@ -102,9 +114,27 @@ func (ctx *testContext) stderrString() string {
 	return ctx.stderrBuffer.String()
 }
 
+func (ctx *testContext) stderrIsTerminal() bool {
+	return ctx.stderrTerminal
+}
+
+func (ctx *testContext) fs() fileSystem {
+	return ctx.fsys
+}
+
+// Switches to an in-memory file system that contains the temp dir.
+// writeFile and symlink write to it afterwards.
+func (ctx *testContext) useMemFileSystem() *memFileSystem {
+	memfs := newMemFileSystem()
+	if err := memfs.mkdirAll(ctx.tempDir, 0777); err != nil {
+		ctx.t.Fatal(err)
+	}
+	ctx.fsys = memfs
+	return memfs
+}
+
 func (ctx *testContext) run(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
-	ctx.cmdCount++
-	ctx.lastCmd = cmd
+	ctx.recordCmd(cmd)
 	if ctx.cmdMock != nil {
 		return ctx.cmdMock(cmd, stdin, stdout, stderr)
 	}
@@ -112,14 +142,20 @@ func (ctx *testContext) run(cmd *command, stdin io.Reader, stdout io.Writer, std
 }
 
 func (ctx *testContext) exec(cmd *command) error {
-	ctx.cmdCount++
-	ctx.lastCmd = cmd
+	ctx.recordCmd(cmd)
 	if ctx.cmdMock != nil {
 		return ctx.cmdMock(cmd, ctx.stdin(), ctx.stdout(), ctx.stderr())
 	}
 	return nil
 }
 
+func (ctx *testContext) recordCmd(cmd *command) {
+	ctx.cmdMutex.Lock()
+	defer ctx.cmdMutex.Unlock()
+	ctx.cmdCount++
+	ctx.lastCmd = cmd
+}
+
 func (ctx *testContext) must(exitCode int) *command {
 	if exitCode != 0 {
 		ctx.t.Fatalf("expected no error, but got exit code %d. Stderr: %s",
@@ -138,6 +174,15 @@ func (ctx *testContext) mustFail(exitCode int) string {
 func (ctx *testContext) updateConfig(cfg *config) {
 	*ctx.cfg = *cfg
 	ctx.cfg.newWarningsDir = filepath.Join(ctx.tempDir, "fatal_clang_warnings")
+	ctx.cfg.warningBaselineReportsDir = filepath.Join(ctx.tempDir, "baseline_reports")
+	ctx.cfg.shadowCompilerLogDir = filepath.Join(ctx.tempDir, "shadow_compiler_logs")
+	ctx.cfg.errorReportDir = filepath.Join(ctx.tempDir, "error_reports")
+	ctx.cfg.launcherLogDir = filepath.Join(ctx.tempDir, "launcher_fallbacks")
+	ctx.cfg.flagAuditLogDir = filepath.Join(ctx.tempDir, "flag_audit")
+	ctx.cfg.profileLogDir = filepath.Join(ctx.tempDir, "profile_logs")
+	// Note: The probe cache would skip commands in later calls,
+	// so tests have to enable it explicitly.
+	ctx.cfg.probeCacheDir = ""
 }
 
 func (ctx *testContext) newCommand(path string, args ...string) *command {
@@ -154,6 +199,10 @@ func (ctx *testContext) writeFile(fullFileName string, fileContent string) {
 	if !filepath.IsAbs(fullFileName) {
 		fullFileName = filepath.Join(ctx.tempDir, fullFileName)
 	}
+	if memfs, ok := ctx.fsys.(*memFileSystem); ok {
+		memfs.writeFile(ctx.t, fullFileName, fileContent, 0777)
+		return
+	}
 	if err := os.MkdirAll(filepath.Dir(fullFileName), 0777); err != nil {
 		ctx.t.Fatal(err)
 	}
@@ -169,6 +218,10 @@ func (ctx *testContext) symlink(oldname string, newname string) {
 	if !filepath.IsAbs(newname) {
 		newname = filepath.Join(ctx.tempDir, newname)
 	}
+	if memfs, ok := ctx.fsys.(*memFileSystem); ok {
+		memfs.symlink(ctx.t, oldname, newname)
+		return
+	}
 	if err := os.MkdirAll(filepath.Dir(newname), 0777); err != nil {
 		ctx.t.Fatal(err)
 	}
@@ -0,0 +1,356 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Warning baselines allow to enforce "no new warnings" for packages that
+// have a backlog of warnings. The baselines dir contains a file per package,
+// e.g. dev-libs/foo.json, with the known warnings of the package. The
+// wrapper checks the warnings of every compile of a package with a baseline
+// against it and fails or reports if there are new warnings. Only the file
+// of the current package is read.
+//
+// Warnings are keyed by file and flag, but not by line, so that unrelated
+// changes to a file don't turn known warnings into new ones. Files are
+// relative to the source dir of the package ($S), so that the baseline
+// applies to new versions of the package as well. Warnings that -Werror
+// turned into errors are known warnings as well: if all of them are in the
+// baseline, the compile is retried with -Wno-error.
+//
+// The wrapper writes a report for every compile with warnings into
+// cfg.warningBaselineReportsDir. `-wrapper-regenerate-warning-baselines`
+// updates the baselines of the packages in these reports, e.g. after a
+// full build.
+
+const warningBaselinesDirKey = "COMPILER_WRAPPER_WARNING_BASELINES"
+
+const regenerateWarningBaselinesFlag = "-wrapper-regenerate-warning-baselines"
+
+// Contents of a baseline file.
+type warningBaseline struct {
+	// "fail" (the default) to fail compiles with new warnings,
+	// or "report" to only print them.
+	Mode     string            `json:"mode,omitempty"`
+	Warnings []baselineWarning `json:"warnings"`
+	// The package of the baseline, see packageIdentity.String.
+	pkg string
+}
+
+type baselineWarning struct {
+	File string `json:"file"`
+	Flag string `json:"flag"`
+	// Number of times the warning occurs in a single compile.
+	Count int `json:"count"`
+}
+
+type baselineWarningKey struct {
+	file string
+	flag string
+}
+
+func getWarningBaselinesDir(env env, cfg *config, rootPath string) string {
+	if baselinesDir, _ := env.getenv(warningBaselinesDirKey); baselinesDir != "" {
+		return baselinesDir
+	}
+	if cfg.warningBaselinesRelDir == "" {
+		return ""
+	}
+	return filepath.Join(rootPath, cfg.warningBaselinesRelDir)
+}
+
+func getWarningBaselineFile(baselinesDir string, pkg string) string {
+	return filepath.Join(baselinesDir, pkg+".json")
+}
+
+// Returns the baseline of the current package, or nil if there is none.
+func findWarningBaseline(env env, cfg *config, rootPath string) (*warningBaseline, error) {
+	pkg := getPackageIdentity(env).String()
+	if pkg == "" {
+		return nil, nil
+	}
+	baselinesDir := getWarningBaselinesDir(env, cfg, rootPath)
+	if baselinesDir == "" {
+		return nil, nil
+	}
+	return loadWarningBaseline(env, getWarningBaselineFile(baselinesDir, pkg), pkg)
+}
+
+// Returns nil if the file doesn't exist.
+func loadWarningBaseline(env env, baselineFile string, pkg string) (*warningBaseline, error) {
+	data, err := env.fs().readFile(baselineFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, wrapErrorwithSourceLocf(err, "failed to read warning baseline %s", baselineFile)
+	}
+	baseline := &warningBaseline{}
+	if err := json.Unmarshal(data, baseline); err != nil {
+		return nil, newUserErrorf("invalid warning baseline %s: %s", baselineFile, err)
+	}
+	if baseline.Mode != "" && baseline.Mode != "fail" && baseline.Mode != "report" {
+		return nil, newUserErrorf("invalid mode %q in %s", baseline.Mode, baselineFile)
+	}
+	baseline.pkg = pkg
+	return baseline, nil
+}
+
+// Runs the compiler and checks its warnings against the baseline. If the
+// compile fails because of -Werror, it is retried with -Wno-error if all
+// warnings are known, or if forceDisableWError is set (see
+// FORCE_DISABLE_WERROR), so that only new warnings fail the compile.
+// The output of the compiler is forwarded while it runs, so the output of
+// a retry follows the errors of the first run.
+func runWithWarningBaseline(env env, cfg *config, baseline *warningBaseline, compilerCmd *command, forceDisableWError bool) (exitCode int, err error) {
+	compilerCmd = forceColorDiagnostics(env, compilerCmd)
+	stdinBuffer := &bytes.Buffer{}
+	stderrBuffer := &bytes.Buffer{}
+	exitCode, err = wrapSubprocessErrorWithSourceLoc(compilerCmd,
+		env.run(compilerCmd, teeStdinIfNeeded(env, compilerCmd, stdinBuffer), env.stdout(), io.MultiWriter(env.stderr(), stderrBuffer)))
+	if err != nil {
+		return 0, err
+	}
+	if exitCode != 0 && strings.Contains(stderrBuffer.String(), "-Werror") {
+		warnings := getBaselineWarnings(env, stripANSIEscapes(stderrBuffer.String()))
+		if forceDisableWError || len(baseline.newWarnings(warnings)) == 0 {
+			retryCmd := &command{
+				Path:         compilerCmd.Path,
+				Args:         append(compilerCmd.Args, "-Wno-error"),
+				EnvUpdates:   compilerCmd.EnvUpdates,
+				launcherName: compilerCmd.launcherName,
+			}
+			retryStderrBuffer := &bytes.Buffer{}
+			retryExitCode, err := wrapSubprocessErrorWithSourceLoc(retryCmd,
+				env.run(retryCmd, bytes.NewReader(stdinBuffer.Bytes()), env.stdout(), io.MultiWriter(env.stderr(), retryStderrBuffer)))
+			if err != nil {
+				return 0, err
+			}
+			// Like doubleBuildWithWNoError, the compile succeeds if
+			// the retry succeeded.
+			if retryExitCode == 0 {
+				exitCode = 0
+				stderrBuffer = retryStderrBuffer
+			}
+		}
+	}
+	if exitCode != 0 {
+		return exitCode, nil
+	}
+	output := stripANSIEscapes(stderrBuffer.String())
+	warnings := getBaselineWarnings(env, output)
+	if len(warnings) == 0 {
+		return 0, nil
+	}
+	if cfg.warningBaselineReportsDir != "" {
+		// The report is best effort, a failure to write it must not
+		// fail the compile.
+		_ = writeWarningsReport(env, cfg.warningBaselineReportsDir, "baseline_report*.json", &warningsJSONData{
+			Cwd:      env.getwd(),
+			Command:  append([]string{compilerCmd.Path}, compilerCmd.Args...),
+			Stdout:   output,
+			Package:  baseline.pkg,
+			Warnings: warnings,
+		})
+	}
+	newWarnings := baseline.newWarnings(warnings)
+	if len(newWarnings) == 0 {
+		return 0, nil
+	}
+	stderr := env.stderr()
+	fmt.Fprintf(stderr, "compiler wrapper: new warnings that are not in the baseline of %s:\n", baseline.pkg)
+	for _, w := range newWarnings {
+		fmt.Fprintf(stderr, "  %s: %s (%d new)\n", w.File, w.Flag, w.Count)
+	}
+	if baseline.Mode == "report" {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// Returns the warnings that occur more often than in the baseline.
+// Count is the number of additional occurrences.
+func (baseline *warningBaseline) newWarnings(warnings []baselineWarning) []baselineWarning {
+	knownCounts := map[baselineWarningKey]int{}
+	for _, w := range baseline.Warnings {
+		knownCounts[baselineWarningKey{w.File, w.Flag}] = w.Count
+	}
+	newWarnings := []baselineWarning{}
+	for _, w := range warnings {
+		if known := knownCounts[baselineWarningKey{w.File, w.Flag}]; w.Count > known {
+			newWarnings = append(newWarnings, baselineWarning{File: w.File, Flag: w.Flag, Count: w.Count - known})
+		}
+	}
+	return newWarnings
+}
+
+// Returns the warnings in the compiler output, counted by file and flag.
+// Warnings that were turned into errors via -Werror are included.
+func getBaselineWarnings(env env, output string) []baselineWarning {
+	counts := map[baselineWarningKey]int{}
+	for _, d := range parseDiagnostics(output) {
+		flag := getBaselineWarningFlag(d.Flag)
+		if d.Severity != "warning" && !(d.Severity == "error" && flag != d.Flag) {
+			continue
+		}
+		counts[baselineWarningKey{getBaselineWarningFile(env, d.File), flag}]++
+	}
+	return sortedBaselineWarnings(counts)
+}
+
+// Returns the flag of the warning without -Werror, e.g. -Wunused-variable
+// for -Werror,-Wunused-variable (clang) and -Werror=unused-variable (gcc).
+func getBaselineWarningFlag(flag string) string {
+	parts := strings.Split(flag, ",")
+	flag = parts[len(parts)-1]
+	if strings.HasPrefix(flag, "-Werror=") {
+		return "-W" + flag[len("-Werror="):]
+	}
+	return flag
+}
+
+// Returns the file relative to the source dir of the package if it is
+// inside of it, and the absolute path otherwise.
+func getBaselineWarningFile(env env, file string) string {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(env.getwd(), file)
+	}
+	file = filepath.Clean(file)
+	if srcDir, _ := env.getenv("S"); srcDir != "" {
+		if rel, err := filepath.Rel(srcDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return file
+}
+
+func sortedBaselineWarnings(counts map[baselineWarningKey]int) []baselineWarning {
+	warnings := []baselineWarning{}
+	for key, count := range counts {
+		warnings = append(warnings, baselineWarning{File: key.file, Flag: key.flag, Count: count})
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].File != warnings[j].File {
+			return warnings[i].File < warnings[j].File
+		}
+		return warnings[i].Flag < warnings[j].Flag
+	})
+	return warnings
+}
+
+// Returns the directory with the reports if the flag to regenerate the
+// baselines was given. The directory defaults to
+// cfg.warningBaselineReportsDir and can be given as
+// -wrapper-regenerate-warning-baselines=<dir>.
+func processRegenerateWarningBaselinesFlag(builder *commandBuilder) (reportsDir string, regenerate bool) {
+	builder.transformArgs(func(arg builderArg) string {
+		switch {
+		case arg.value == regenerateWarningBaselinesFlag:
+			reportsDir = builder.cfg.warningBaselineReportsDir
+			regenerate = true
+			return ""
+		case strings.HasPrefix(arg.value, regenerateWarningBaselinesFlag+"="):
+			reportsDir = arg.value[len(regenerateWarningBaselinesFlag+"="):]
+			regenerate = true
+			return ""
+		}
+		return arg.value
+	})
+	return reportsDir, regenerate
+}
+
+// Writes the baselines of the packages in the reports in reportsDir with
+// the maximum count per warning over all reports of a package. Baselines
+// of packages without reports are kept as they are. Prints the updated
+// files to stdout.
+func regenerateWarningBaselines(env env, cfg *config, rootPath string, reportsDir string) (exitCode int, err error) {
+	baselinesDir := getWarningBaselinesDir(env, cfg, rootPath)
+	if baselinesDir == "" {
+		return 0, newUserErrorf("no warning baselines dir configured, set %s", warningBaselinesDirKey)
+	}
+	files, err := env.fs().readDir(reportsDir)
+	if err != nil {
+		return 0, wrapErrorwithSourceLocf(err, "failed to read the warnings reports in %s", reportsDir)
+	}
+	counts := map[string]map[baselineWarningKey]int{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		reportFile := filepath.Join(reportsDir, f.Name())
+		data, err := env.fs().readFile(reportFile)
+		if err != nil {
+			return 0, wrapErrorwithSourceLocf(err, "failed to read warnings report %s", reportFile)
+		}
+		report := &warningsJSONData{}
+		if err := json.Unmarshal(data, report); err != nil {
+			return 0, newUserErrorf("invalid warnings report %s: %s", reportFile, err)
+		}
+		if report.Package == "" {
+			continue
+		}
+		if counts[report.Package] == nil {
+			counts[report.Package] = map[baselineWarningKey]int{}
+		}
+		for _, w := range report.Warnings {
+			key := baselineWarningKey{w.File, w.Flag}
+			if w.Count > counts[report.Package][key] {
+				counts[report.Package][key] = w.Count
+			}
+		}
+	}
+	pkgs := []string{}
+	for pkg := range counts {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		baselineFile := getWarningBaselineFile(baselinesDir, pkg)
+		baseline, err := loadWarningBaseline(env, baselineFile, pkg)
+		if err != nil {
+			return 0, err
+		}
+		if baseline == nil {
+			baseline = &warningBaseline{}
+		}
+		baseline.Warnings = sortedBaselineWarnings(counts[pkg])
+		if err := writeWarningBaseline(env, baselineFile, baseline); err != nil {
+			return 0, err
+		}
+		fmt.Fprintln(env.stdout(), baselineFile)
+	}
+	return 0, nil
+}
+
+func writeWarningBaseline(env env, baselineFile string, baseline *warningBaseline) error {
+	data, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "failed to encode the warning baseline")
+	}
+	if err := env.fs().mkdirAll(filepath.Dir(baselineFile), 0777); err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating warning baselines directory %s", filepath.Dir(baselineFile))
+	}
+	f, err := env.fs().openFile(baselineFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return wrapErrorwithSourceLocf(err, "error creating warning baseline %s", baselineFile)
+	}
+	if _, err := fmt.Fprintf(f, "%s\n", data); err != nil {
+		_ = f.Close()
+		return wrapErrorwithSourceLocf(err, "error writing warning baseline %s", baselineFile)
+	}
+	if err := f.Close(); err != nil {
+		return wrapErrorwithSourceLocf(err, "error closing warning baseline %s", baselineFile)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPassKnownBaselineWarnings(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": [
+		{"file": "main.cc", "flag": "-Wunused-variable", "count": 2}]}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if strings.Contains(ctx.stderrString(), "new warnings") {
+			t.Errorf("unexpected new warnings. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestFailNewBaselineWarnings(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": [
+		{"file": "main.cc", "flag": "-Wunused-variable", "count": 1}]}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+			fmt.Fprint(stderr, "main.cc:2:1: warning: unused variable 'y' [-Wunused-variable]\n")
+			fmt.Fprint(stderr, "main.cc:3:1: warning: comparison of integers [-Wsign-compare]\n")
+			return nil
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+		if exitCode != 1 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		stderr := ctx.stderrString()
+		if !strings.Contains(stderr, "new warnings that are not in the baseline of dev-libs/foo") ||
+			!strings.Contains(stderr, "main.cc: -Wsign-compare (1 new)") ||
+			!strings.Contains(stderr, "main.cc: -Wunused-variable (1 new)") {
+			t.Errorf("unexpected stderr. Got: %s", stderr)
+		}
+	})
+}
+
+func TestOnlyReportNewBaselineWarningsInReportMode(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"mode": "report", "warnings": []}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:3:1: warning: comparison of integers [-Wsign-compare]\n")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if !strings.Contains(ctx.stderrString(), "main.cc: -Wsign-compare (1 new)") {
+			t.Errorf("unexpected stderr. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestForwardOutputWhileCompilingWithWarningBaseline(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stdout, "someoutput")
+			fmt.Fprint(stderr, "main.cc:3:1: warning: comparison of integers [-Wsign-compare]\n")
+			if ctx.stdoutString() != "someoutput" || !strings.Contains(ctx.stderrString(), "-Wsign-compare") {
+				t.Errorf("output not forwarded while compiling. Stdout: %q, stderr: %q", ctx.stdoutString(), ctx.stderrString())
+			}
+			return nil
+		}
+		callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+	})
+}
+
+func TestWriteBaselineReportsIntoSeparateDir(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": [
+		{"file": "main.cc", "flag": "-Wunused-variable", "count": 1}]}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if readLoggedWarnings(ctx) != nil {
+			t.Errorf("unexpected report in %s", ctx.cfg.newWarningsDir)
+		}
+		report := readWarningsReport(ctx, ctx.cfg.warningBaselineReportsDir)
+		if report == nil || report.Package != "dev-libs/foo" ||
+			fmt.Sprint(report.Warnings) != fmt.Sprint([]baselineWarning{{"main.cc", "-Wunused-variable", 1}}) {
+			t.Errorf("unexpected report. Got: %#v", report)
+		}
+	})
+}
+
+func TestIgnoreBaselineReportErrors(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": [
+		{"file": "main.cc", "flag": "-Wunused-variable", "count": 1}]}`, func(ctx *testContext) {
+		// Creating the reports dir fails as there is a file in its place.
+		ctx.writeFile(ctx.cfg.warningBaselineReportsDir, "")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+	})
+}
+
+func TestForwardCompilerErrorsWithWarningBaseline(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:3:1: error: someerror\n")
+			return newExitCodeError(23)
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+		if exitCode != 23 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		if strings.Contains(ctx.stderrString(), "new warnings") {
+			t.Errorf("unexpected new warnings. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestIgnoreWarningBaselineOfOtherPackages(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "PN=bar")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:3:1: warning: comparison of integers [-Wsign-compare]\n")
+			return nil
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if readWarningsReport(ctx, ctx.cfg.warningBaselineReportsDir) != nil {
+			t.Error("expected no warnings report")
+		}
+	})
+}
+
+func TestRetryKnownWErrorWarningsWithBaseline(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": [
+		{"file": "main.cc", "flag": "-Wunused-variable", "count": 1}]}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprint(stderr, "main.cc:1:1: error: unused variable 'x' [-Werror,-Wunused-variable]\n")
+				return newExitCodeError(1)
+			case 2:
+				if err := verifyArgOrder(cmd, mainCc, "-Wno-error"); err != nil {
+					return err
+				}
+				fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		ctx.must(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		// The output of both runs is forwarded.
+		if stderr := ctx.stderrString(); !strings.HasSuffix(stderr, "warning: unused variable 'x' [-Wunused-variable]\n") ||
+			strings.Contains(stderr, "new warnings") {
+			t.Errorf("unexpected stderr. Got: %s", stderr)
+		}
+	})
+}
+
+func TestNoRetryForNewWErrorWarningsWithBaseline(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			fmt.Fprint(stderr, "main.cc:1:1: error: unused variable 'x' [-Werror,-Wunused-variable]\n")
+			return newExitCodeError(1)
+		}
+		ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if ctx.cmdCount != 1 {
+			t.Errorf("expected 1 call. Got: %d", ctx.cmdCount)
+		}
+	})
+}
+
+func TestApplyWarningBaselineWithForceDisableWError(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "FORCE_DISABLE_WERROR=1")
+		ctx.cmdMock = func(cmd *command, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			switch ctx.cmdCount {
+			case 1:
+				fmt.Fprint(stderr, "main.cc:1:1: error: unused variable 'x' [-Werror,-Wunused-variable]\n")
+				return newExitCodeError(1)
+			case 2:
+				fmt.Fprint(stderr, "main.cc:1:1: warning: unused variable 'x' [-Wunused-variable]\n")
+				return nil
+			default:
+				t.Fatalf("unexpected command: %#v", cmd)
+				return nil
+			}
+		}
+		exitCode := callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc))
+		if exitCode != 1 {
+			t.Errorf("unexpected exit code. Got: %d", exitCode)
+		}
+		if !strings.Contains(ctx.stderrString(), "main.cc: -Wunused-variable (1 new)") {
+			t.Errorf("unexpected stderr. Got: %s", ctx.stderrString())
+		}
+	})
+}
+
+func TestRejectInvalidWarningBaselineMode(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"mode": "warn", "warnings": []}`, func(ctx *testContext) {
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, `invalid mode "warn" in .*/dev-libs/foo.json`); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRejectGetRusageWithWarningBaseline(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"warnings": []}`, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "GETRUSAGE="+filepath.Join(ctx.tempDir, "rusage.log"))
+		stderr := ctx.mustFail(callCompiler(ctx, ctx.cfg, ctx.newCommand(clangX86_64, mainCc)))
+		if err := verifyNonInternalError(stderr, "GETRUSAGE is meaningless with the warning baseline of dev-libs/foo"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestGetBaselineWarnings(t *testing.T) {
+	withTestContext(t, func(ctx *testContext) {
+		ctx.env = append(ctx.env, "S="+filepath.Join(ctx.tempDir, "src"))
+		output := strings.Join([]string{
+			"src/a.cc:1:1: warning: unused variable 'x' [-Wunused-variable]",
+			"src/a.cc:9:1: error: unused variable 'y' [-Werror,-Wunused-variable]",
+			"/usr/include/b.h:2:3: error: comparison of integers [-Werror=sign-compare]",
+			"src/a.cc:10:1: error: someerror",
+			"src/a.cc:11:1: note: somenote",
+		}, "\n")
+		warnings := getBaselineWarnings(ctx, output)
+		expected := []baselineWarning{
+			{File: "/usr/include/b.h", Flag: "-Wsign-compare", Count: 1},
+			{File: "a.cc", Flag: "-Wunused-variable", Count: 2},
+		}
+		if fmt.Sprint(warnings) != fmt.Sprint(expected) {
+			t.Errorf("unexpected warnings. Got: %v", warnings)
+		}
+	})
+}
+
+func TestRegenerateWarningBaselines(t *testing.T) {
+	withWarningBaselineTestContext(t, `{"mode": "report", "warnings": [
+		{"file": "old.cc", "flag": "-Wunused-variable", "count": 1}]}`, func(ctx *testContext) {
+		barBaseline := `{"warnings": [{"file": "bar.cc", "flag": "-Wunused-variable", "count": 1}]}`
+		ctx.writeFile(filepath.Join(ctx.tempDir, "baselines/dev-libs/bar.json"), barBaseline)
+		reportsDir := filepath.Join(ctx.tempDir, "reports")
+		writeWarningsReportForTest(ctx, reportsDir, "1.json", "dev-libs/foo", baselineWarning{"a.cc", "-Wsign-compare", 1})
+		writeWarningsReportForTest(ctx, reportsDir, "2.json", "dev-libs/foo", baselineWarning{"a.cc", "-Wsign-compare", 3})
+		writeWarningsReportForTest(ctx, reportsDir, "3.json", "baz", baselineWarning{"baz.cc", "-Wshadow", 1})
+		ctx.must(callCompiler(ctx, ctx.cfg,
+			ctx.newCommand(clangX86_64, regenerateWarningBaselinesFlag+"="+reportsDir)))
+		if ctx.cmdCount != 0 {
+			t.Errorf("expected no calls. Got: %d", ctx.cmdCount)
+		}
+		for _, tt := range []struct {
+			file     string
+			baseline warningBaseline
+		}{
+			{"dev-libs/foo.json", warningBaseline{Mode: "report", Warnings: []baselineWarning{{"a.cc", "-Wsign-compare", 3}}}},
+			{"dev-libs/bar.json", warningBaseline{Warnings: []baselineWarning{{"bar.cc", "-Wunused-variable", 1}}}},
+			{"baz.json", warningBaseline{Warnings: []baselineWarning{{"baz.cc", "-Wshadow", 1}}}},
+		} {
+			data, err := ioutil.ReadFile(filepath.Join(ctx.tempDir, "baselines", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseline := warningBaseline{}
+			if err := json.Unmarshal(data, &baseline); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(baseline) != fmt.Sprint(tt.baseline) {
+				t.Errorf("unexpected baseline for %s. Got: %v", tt.file, baseline)
+			}
+		}
+		if stdout := ctx.stdoutString(); !strings.Contains(stdout, "baz.json") || strings.Contains(stdout, "bar.json") {
+			t.Errorf("unexpected stdout. Got: %s", stdout)
+		}
+	})
+}
+
+func withWarningBaselineTestContext(t *testing.T, baseline string, work func(ctx *testContext)) {
+	withTestContext(t, func(ctx *testContext) {
+		baselinesDir := filepath.Join(ctx.tempDir, "baselines")
+		ctx.writeFile(filepath.Join(baselinesDir, "dev-libs/foo.json"), baseline)
+		ctx.env = append(ctx.env, warningBaselinesDirKey+"="+baselinesDir,
+			"CATEGORY=dev-libs", "PN=foo", "S="+ctx.tempDir)
+		work(ctx)
+	})
+}
+
+func writeWarningsReportForTest(ctx *testContext, dir string, name string, pkg string, warnings ...baselineWarning) {
+	data, err := json.Marshal(&warningsJSONData{Package: pkg, Warnings: warnings})
+	if err != nil {
+		ctx.t.Fatal(err)
+	}
+	ctx.writeFile(filepath.Join(dir, name), string(data))
+}